@@ -19,7 +19,9 @@ package pkg
 import (
 	"context"
 	"fmt"
+	"os"
 	"path/filepath"
+	"time"
 
 	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
 	stash "stash.appscode.dev/apimachinery/client/clientset/versioned"
@@ -32,6 +34,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
 	appcatalog "kmodules.xyz/custom-resources/apis/appcatalog/v1alpha1"
 	appcatalog_cs "kmodules.xyz/custom-resources/client/clientset/versioned"
 	v1 "kmodules.xyz/offshoot-api/api/v1"
@@ -42,10 +45,13 @@ func NewCmdBackup() *cobra.Command {
 		masterURL      string
 		kubeconfigPath string
 		opt            = postgresOptions{
-			waitTimeout: 300,
+			waitTimeout:    300,
+			jobs:           1,
+			maxConcurrency: 1,
+			dumpFormat:     DumpFormatPlain,
+			dumpChecksums:  make(map[string]streamChecksum),
 			backupOptions: restic.BackupOptions{
-				Host:          restic.DefaultHost,
-				StdinFileName: PgDumpFile,
+				Host: restic.DefaultHost,
 			},
 			setupOptions: restic.SetupOptions{
 				ScratchDir:  restic.DefaultScratchDir,
@@ -89,7 +95,8 @@ func NewCmdBackup() *cobra.Command {
 
 			var backupOutput *restic.BackupOutput
 			backupOutput, err = opt.backupPostgreSQL(targetRef)
-			if err != nil {
+			// the output of a backup that has taken snapshots tells which of its hosts have failed
+			if err != nil && backupOutput == nil {
 				backupOutput = &restic.BackupOutput{
 					BackupTargetStatus: api_v1beta1.BackupTargetStatus{
 						Ref: targetRef,
@@ -105,14 +112,26 @@ func NewCmdBackup() *cobra.Command {
 			}
 			// If output directory specified, then write the output in "output.json" file in the specified directory
 			if opt.outputDir != "" {
-				return backupOutput.WriteOutput(filepath.Join(opt.outputDir, restic.DefaultOutputFileName))
+				out := &pgBackupOutput{
+					BackupOutput: backupOutput,
+					Postgres:     &opt.backupStats,
+				}
+				return out.WriteOutput(filepath.Join(opt.outputDir, restic.DefaultOutputFileName))
 			}
 
 			return nil
 		},
 	}
 
-	cmd.Flags().StringVar(&opt.backupCMD, "backup-cmd", PgDumpallCMD, "Backup command to take a database dump (can only be pg_dumpall or pg_dump)")
+	cmd.Flags().StringVar(&opt.backupCMD, "backup-cmd", PgDumpallCMD, "Backup command to take a database dump (can only be pg_dumpall, pg_dump or pg_basebackup). pg_basebackup takes a physical base backup of the whole cluster")
+	cmd.Flags().StringVar(&opt.dumpFormat, "format", opt.dumpFormat, "Format of the database dump (can only be plain, custom or directory). The custom and directory formats are only supported by pg_dump")
+	cmd.Flags().IntVar(&opt.jobs, "jobs", opt.jobs, "Number of parallel jobs used to dump the database (only applicable for the directory format). The dump is written into the scratch directory before upload, so it must have enough space to hold it")
+	cmd.Flags().BoolVar(&opt.perDatabase, "per-database", opt.perDatabase, "Specify whether to back up each database of the cluster in its own snapshot (only applicable for pg_dumpall). The globals are backed up in a separate snapshot")
+	cmd.Flags().IntVar(&opt.maxConcurrency, "max-concurrency", opt.maxConcurrency, "Maximum number of databases to back up concurrently in per database backup")
+	cmd.Flags().BoolVar(&opt.incremental, "incremental", opt.incremental, "Specify whether to take an incremental base backup on top of the latest base backup (only applicable for pg_basebackup, requires PostgreSQL 17 or later). A retention policy must keep the tag "+BackupChainTag)
+	cmd.Flags().BoolVar(&opt.exportSnapshot, "export-snapshot", opt.exportSnapshot, "Specify whether to dump each database from a snapshot exported with pg_export_snapshot() (only applicable for pg_dump and per database backup). For pg_dump, the database must be given with --dbname in --pg-args")
+	cmd.Flags().BoolVar(&opt.tableStats, "table-stats", opt.tableStats, "Specify whether to count the rows of each table into the manifest of the backup, so that restore-pg --validate-tables can compare them with the restored tables. The rows are counted in the exported snapshots with --export-snapshot, otherwise the writes during the backup make them differ from the dump")
+	cmd.Flags().BoolVar(&opt.tableChecksums, "table-checksums", opt.tableChecksums, "Specify whether to compute an aggregate checksum of the primary key columns of each table into the manifest of the backup along with its rows (implies --table-stats)")
 	cmd.Flags().StringVar(&opt.pgArgs, "pg-args", opt.pgArgs, "Additional arguments")
 	cmd.Flags().StringVar(&opt.user, "user", DefaultPostgresUser, "Specifies database user (not applicable for basic authentication)")
 	cmd.Flags().Int32Var(&opt.waitTimeout, "wait-timeout", opt.waitTimeout, "Time limit to wait for the database to be ready")
@@ -123,18 +142,7 @@ func NewCmdBackup() *cobra.Command {
 	cmd.Flags().StringVar(&opt.backupSessionName, "backupsession", opt.backupSessionName, "Name of the Backup Session")
 	cmd.Flags().StringVar(&opt.appBindingName, "appbinding", opt.appBindingName, "Name of the app binding")
 	cmd.Flags().StringVar(&opt.appBindingNamespace, "appbinding-namespace", opt.appBindingNamespace, "Namespace of the app binding")
-	cmd.Flags().StringVar(&opt.storageSecret.Name, "storage-secret-name", opt.storageSecret.Name, "Name of the storage secret")
-	cmd.Flags().StringVar(&opt.storageSecret.Namespace, "storage-secret-namespace", opt.storageSecret.Namespace, "Namespace of the storage secret")
-
-	cmd.Flags().StringVar(&opt.setupOptions.Provider, "provider", opt.setupOptions.Provider, "Backend provider (i.e. gcs, s3, azure etc)")
-	cmd.Flags().StringVar(&opt.setupOptions.Bucket, "bucket", opt.setupOptions.Bucket, "Name of the cloud bucket/container (keep empty for local backend)")
-	cmd.Flags().StringVar(&opt.setupOptions.Endpoint, "endpoint", opt.setupOptions.Endpoint, "Endpoint for s3/s3 compatible backend or REST server URL")
-	cmd.Flags().BoolVar(&opt.setupOptions.InsecureTLS, "insecure-tls", opt.setupOptions.InsecureTLS, "InsecureTLS for TLS secure s3/s3 compatible backend")
-	cmd.Flags().StringVar(&opt.setupOptions.Region, "region", opt.setupOptions.Region, "Region for s3/s3 compatible backend")
-	cmd.Flags().StringVar(&opt.setupOptions.Path, "path", opt.setupOptions.Path, "Directory inside the bucket where backup will be stored")
-	cmd.Flags().StringVar(&opt.setupOptions.ScratchDir, "scratch-dir", opt.setupOptions.ScratchDir, "Temporary directory")
-	cmd.Flags().BoolVar(&opt.setupOptions.EnableCache, "enable-cache", opt.setupOptions.EnableCache, "Specify whether to enable caching for restic")
-	cmd.Flags().Int64Var(&opt.setupOptions.MaxConnections, "max-connections", opt.setupOptions.MaxConnections, "Specify maximum concurrent connections for GCS, Azure and B2 backend")
+	addStorageFlags(cmd, &opt)
 
 	cmd.Flags().StringVar(&opt.backupOptions.Host, "hostname", opt.backupOptions.Host, "Name of the host machine")
 
@@ -216,19 +224,83 @@ func (opt *postgresOptions) backupPostgreSQL(targetRef api_v1beta1.TargetRef) (*
 	// get pg backup cmd
 	// validate if given cmd is a valid dump cmd
 	pgBackupCMD := opt.backupCMD
-	if pgBackupCMD != PgDumpCMD && pgBackupCMD != PgDumpallCMD {
-		return nil, fmt.Errorf("invalid pg backup command: expected %s or %s, but instead got %s", PgDumpCMD, PgDumpallCMD, pgBackupCMD)
+	if pgBackupCMD != PgDumpCMD && pgBackupCMD != PgDumpallCMD && pgBackupCMD != PgBaseBackupCMD {
+		return nil, fmt.Errorf("invalid pg backup command: expected %s, %s or %s, but instead got %s", PgDumpCMD, PgDumpallCMD, PgBaseBackupCMD, pgBackupCMD)
+	}
+	if pgBackupCMD == PgBaseBackupCMD {
+		if opt.tableStats || opt.tableChecksums {
+			return nil, fmt.Errorf("table stats are only supported by dumps, a base backup is restored as a whole")
+		}
+		return opt.backupBaseBackup(session, targetRef)
+	}
+	if opt.incremental {
+		return nil, fmt.Errorf("incremental backup is only supported by %s", PgBaseBackupCMD)
+	}
+	// in per database mode, the databases are dumped individually with pg_dump
+	dumpCMD := pgBackupCMD
+	if opt.perDatabase {
+		if pgBackupCMD != PgDumpallCMD {
+			return nil, fmt.Errorf("per database backup is only supported when the whole cluster is backed up with %s", PgDumpallCMD)
+		}
+		if opt.dumpFormat == DumpFormatDir {
+			return nil, fmt.Errorf("%s format is not supported in per database backup", DumpFormatDir)
+		}
+		if opt.maxConcurrency < 1 {
+			return nil, fmt.Errorf("invalid max concurrency %d: it must be at least 1", opt.maxConcurrency)
+		}
+		dumpCMD = PgDumpCMD
+	}
+	// validate the requested dump format. pg_dumpall can only produce plain SQL scripts.
+	switch opt.dumpFormat {
+	case DumpFormatPlain:
+	case DumpFormatCustom, DumpFormatDir:
+		if dumpCMD != PgDumpCMD {
+			return nil, fmt.Errorf("%s format is only supported by %s", opt.dumpFormat, PgDumpCMD)
+		}
+	default:
+		return nil, fmt.Errorf("invalid dump format: expected %s, %s or %s, but instead got %s", DumpFormatPlain, DumpFormatCustom, DumpFormatDir, opt.dumpFormat)
 	}
+	if opt.jobs < 1 || (opt.jobs > 1 && opt.dumpFormat != DumpFormatDir) {
+		return nil, fmt.Errorf("invalid number of jobs %d: parallel jobs are only supported by the %s format", opt.jobs, DumpFormatDir)
+	}
+	// pg_dumpall can not import a snapshot, so the snapshot can only be exported for pg_dump
+	snapshotDB := ""
+	if opt.exportSnapshot && !opt.perDatabase {
+		if dumpCMD != PgDumpCMD {
+			return nil, fmt.Errorf("exported snapshot is only supported by %s and per database backup", PgDumpCMD)
+		}
+		if snapshotDB = databaseFromArgs(opt.pgArgs); snapshotDB == "" {
+			return nil, fmt.Errorf("database must be specified with --dbname in pg-args to export a snapshot")
+		}
+	}
+	opt.backupOptions.StdinFileName = dumpFileName(opt.dumpFormat)
+	opt.backupStats.Format = opt.dumpFormat
 
 	err = session.waitForDBReady(opt.waitTimeout)
 	if err != nil {
 		return nil, err
 	}
 
+	switch {
+	case opt.perDatabase:
+		// the dump commands for the individual databases are built later from the connection arguments
+	case opt.dumpFormat == DumpFormatCustom:
+		session.cmd.Args = append(session.cmd.Args, "--format=custom")
+	case opt.dumpFormat == DumpFormatDir:
+		session.cmd.Args = append(session.cmd.Args, "--format=directory", fmt.Sprintf("--jobs=%d", opt.jobs))
+		opt.backupStats.Jobs = opt.jobs
+	}
+	if snapshotDB != "" {
+		coordinator, err := session.exportSnapshot(snapshotDB)
+		if err != nil {
+			return nil, err
+		}
+		defer closeCoordinators([]*snapshotCoordinator{coordinator})
+		session.cmd.Args = append(session.cmd.Args, coordinator.dumpArg())
+		opt.backupStats.ExportedSnapshots = append(opt.backupStats.ExportedSnapshots, coordinator.exportedSnapshot)
+	}
 	session.setUserArgs(opt.pgArgs)
 
-	// add the dump command into  stdin pipe commands
-	opt.backupOptions.StdinPipeCommands = append(opt.backupOptions.StdinPipeCommands, *session.cmd)
 	resticWrapper, err := restic.NewResticWrapperFromShell(opt.setupOptions, session.sh)
 	if err != nil {
 		return nil, err
@@ -238,5 +310,186 @@ func (opt *postgresOptions) backupPostgreSQL(targetRef api_v1beta1.TargetRef) (*
 	if err != nil {
 		return nil, err
 	}
-	return resticWrapper.RunBackup(opt.backupOptions, targetRef)
+
+	manifest, err := opt.newBackupManifest(session, dumpCMD)
+	if err != nil {
+		return nil, err
+	}
+	// the rows of the databases dumped individually are counted once their snapshots have been exported
+	if !opt.perDatabase {
+		if err = opt.captureTableStats(session, manifest); err != nil {
+			return nil, err
+		}
+	}
+	var backupOutput *restic.BackupOutput
+	switch {
+	case opt.dumpFormat == DumpFormatDir:
+		backupOutput, err = opt.backupDirectoryDump(resticWrapper, session, targetRef)
+	case opt.perDatabase:
+		backupOutput, err = opt.backupPerDatabase(resticWrapper, session, manifest, targetRef)
+	default:
+		backupOutput, err = opt.backupDump(resticWrapper, session, dumpCMD, targetRef)
+	}
+	if err != nil {
+		return backupOutput, err
+	}
+	// the dumps are already in the repository, they can be restored without their manifest
+	if err = opt.backupManifest(resticWrapper, session, manifest, backupOutput); err != nil {
+		klog.Warningf("The dumps of the backup have been stored without their manifest: %v", err)
+	}
+	return backupOutput, nil
+}
+
+// backupDump streams the dump into the repository.
+func (opt *postgresOptions) backupDump(w *restic.ResticWrapper, session *sessionWrapper, dumpCMD string, targetRef api_v1beta1.TargetRef) (*restic.BackupOutput, error) {
+	// add the dump command into  stdin pipe commands
+	opt.backupOptions.StdinPipeCommands = append(opt.backupOptions.StdinPipeCommands, *session.cmd)
+	// a dump cut short still closes the pipe cleanly, so the dump is checked for its end on its way into the repository
+	if err := withDumpCheck(&opt.backupOptions, dumpCMD, opt.dumpFormat, opt.dumpCheckFile(0)); err != nil {
+		return nil, err
+	}
+	startTime := time.Now()
+	backupOutput, err := w.RunBackup(opt.backupOptions, targetRef)
+	if err = opt.removePartialSnapshots(w, []restic.BackupOptions{opt.backupOptions}, startTime, backupOutput, err); err != nil {
+		return backupOutput, err
+	}
+	return backupOutput, nil
+}
+
+// backupDirectoryDump dumps the database with parallel jobs into a directory inside the scratch directory.
+// pg_dump can not write the directory format into the stdout, so the dump directory is streamed into
+// the repository as a tar archive once the dump has completed.
+func (opt *postgresOptions) backupDirectoryDump(w *restic.ResticWrapper, session *sessionWrapper, targetRef api_v1beta1.TargetRef) (*restic.BackupOutput, error) {
+	dumpDir := filepath.Join(opt.setupOptions.ScratchDir, "dump")
+	// pg_dump refuses to write into an existing directory
+	if err := os.RemoveAll(dumpDir); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dumpDir)
+
+	session.cmd.Args = append(session.cmd.Args, fmt.Sprintf("--file=%s", dumpDir))
+	err := runPhase(&opt.backupStats.Phases, "dump", func() error {
+		return session.sh.Command(session.cmd.Name, session.cmd.Args...).Run()
+	})
+	if err != nil {
+		return nil, err
+	}
+	// pg_dump writes the table of contents of the directory once all the data has been dumped
+	if _, err := session.sh.Command(PgArchiveRestore, "--list", dumpDir).Output(); err != nil {
+		return nil, fmt.Errorf("the dump directory does not have a valid table of contents: %w", err)
+	}
+
+	// The upload should follow the following pipeline: tar -c -f - -C <dump dir> . | stash-postgres checksum <args> | restic backup --stdin .
+	checksumFile := filepath.Join(opt.setupOptions.ScratchDir, "dump-checksum.json")
+	checksum, err := checksumStage(checksumFile)
+	if err != nil {
+		return nil, err
+	}
+	opt.backupOptions.StdinPipeCommands = append(opt.backupOptions.StdinPipeCommands, restic.Command{
+		Name: TarCMD,
+		Args: []any{"-c", "-f", "-", "-C", dumpDir, "."},
+	}, checksum)
+	var backupOutput *restic.BackupOutput
+	err = runPhase(&opt.backupStats.Phases, "upload", func() error {
+		var err error
+		backupOutput, err = w.RunBackup(opt.backupOptions, targetRef)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	sum, err := readChecksum(checksumFile)
+	if err != nil {
+		return nil, err
+	}
+	opt.dumpChecksums[opt.backupOptions.Host] = *sum
+	return backupOutput, nil
+}
+
+// backupPerDatabase backs up the globals (i.e. roles and tablespaces) of the cluster once, then backs up each
+// database with pg_dump in its own snapshot. The snapshots of the individual databases are taken under the
+// "<host>/<database>" hostname, so that each database gets its own retention and can be restored independently.
+func (opt *postgresOptions) backupPerDatabase(w *restic.ResticWrapper, session *sessionWrapper, manifest *backupManifest, targetRef api_v1beta1.TargetRef) (*restic.BackupOutput, error) {
+	databases, err := session.executeQuery(DefaultPostgresDB, listDatabasesQuery)
+	if err != nil {
+		return nil, err
+	}
+	for _, database := range databases {
+		// the snapshots of such a database would be taken under the hostname of the archived WAL segments or the manifests
+		if hostname := databaseHostname(opt.backupOptions.Host, database); hostname == walHostname(opt.backupOptions.Host) || hostname == manifestHostname(opt.backupOptions.Host) {
+			return nil, fmt.Errorf("database %s can not be backed up in its own snapshot, its hostname %s is reserved", database, hostname)
+		}
+	}
+	opt.backupStats.Databases = databases
+
+	// The snapshots of all the databases are exported before any of them is dumped, so that the
+	// databases are dumped from points in time as close to each other as possible.
+	coordinators := make(map[string]*snapshotCoordinator)
+	if opt.exportSnapshot {
+		exported := make([]*snapshotCoordinator, 0, len(databases))
+		defer func() { closeCoordinators(exported) }()
+		for _, database := range databases {
+			coordinator, err := session.exportSnapshot(database)
+			if err != nil {
+				return nil, err
+			}
+			exported = append(exported, coordinator)
+			coordinators[database] = coordinator
+			opt.backupStats.ExportedSnapshots = append(opt.backupStats.ExportedSnapshots, coordinator.exportedSnapshot)
+		}
+	}
+	if err := opt.captureTableStats(session, manifest); err != nil {
+		return nil, err
+	}
+
+	backupOptions := []restic.BackupOptions{
+		{
+			Host:          opt.backupOptions.Host,
+			StdinFileName: PgGlobalsFile,
+			StdinPipeCommands: []restic.Command{
+				{
+					Name: PgDumpallCMD,
+					Args: append(session.newArgs(), "--globals-only"),
+				},
+			},
+			RetentionPolicy: opt.backupOptions.RetentionPolicy,
+		},
+	}
+	for _, database := range databases {
+		// The dump creates the database and connects to it, so that it can be restored independently.
+		args := append(session.newArgs(), "--create", fmt.Sprintf("--dbname=%s", database))
+		if opt.dumpFormat == DumpFormatCustom {
+			args = append(args, "--format=custom")
+		}
+		if coordinator, ok := coordinators[database]; ok {
+			args = append(args, coordinator.dumpArg())
+		}
+		args = appendUserArgs(args, opt.pgArgs)
+		backupOptions = append(backupOptions, restic.BackupOptions{
+			Host:          databaseHostname(opt.backupOptions.Host, database),
+			StdinFileName: databaseDumpFileName(database, opt.dumpFormat),
+			StdinPipeCommands: []restic.Command{
+				{
+					Name: PgDumpCMD,
+					Args: args,
+				},
+			},
+			RetentionPolicy: opt.backupOptions.RetentionPolicy,
+		})
+	}
+	for i := range backupOptions {
+		backupCMD, format := PgDumpCMD, opt.dumpFormat
+		if i == 0 {
+			backupCMD, format = PgDumpallCMD, DumpFormatPlain
+		}
+		if err := withDumpCheck(&backupOptions[i], backupCMD, format, opt.dumpCheckFile(i)); err != nil {
+			return nil, err
+		}
+	}
+	startTime := time.Now()
+	backupOutput, err := w.RunParallelBackup(backupOptions, targetRef, opt.maxConcurrency)
+	if err = opt.removePartialSnapshots(w, backupOptions, startTime, backupOutput, err); err != nil {
+		return backupOutput, err
+	}
+	return backupOutput, nil
 }
@@ -0,0 +1,233 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+const (
+	// pg_basebackup writes the main data directory and the WAL required to make it consistent in separate archives
+	baseBackupDataArchive = "base.tar"
+	baseBackupWALArchive  = "pg_wal.tar"
+
+	replicationPrivilegeQuery = "SELECT rolreplication OR rolsuper FROM pg_roles WHERE rolname = current_user"
+	maxWALSendersQuery        = "SHOW max_wal_senders"
+	userTablespacesQuery      = "SELECT count(*) FROM pg_tablespace WHERE spcname NOT IN ('pg_default', 'pg_global')"
+)
+
+// backupBaseBackup takes a physical base backup of the cluster with pg_basebackup. The WAL must be streamed
+// while the backup is being taken, which pg_basebackup can not do while writing the tar archive into the stdout.
+// So, the backup is written into the scratch directory first and the directory is backed up afterwards.
+func (opt *postgresOptions) backupBaseBackup(session *sessionWrapper, targetRef api_v1beta1.TargetRef) (*restic.BackupOutput, error) {
+	if opt.dumpFormat != DumpFormatPlain || opt.perDatabase || opt.jobs != 1 {
+		return nil, fmt.Errorf("dump format, per database backup and parallel jobs are not applicable for %s", PgBaseBackupCMD)
+	}
+	if opt.incremental {
+		if err := opt.ensureChainRetention(); err != nil {
+			return nil, err
+		}
+	}
+	opt.backupStats.Format = DumpFormatPhysical
+	err := session.waitForDBReady(opt.waitTimeout)
+	if err != nil {
+		return nil, err
+	}
+	err = session.ensureReplicationAllowed()
+	if err != nil {
+		return nil, err
+	}
+
+	backupDir := filepath.Join(opt.setupOptions.ScratchDir, PgBaseBackupDir)
+	// pg_basebackup refuses to write into an existing directory
+	if err := os.RemoveAll(backupDir); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(backupDir)
+
+	session.cmd.Args = append(session.cmd.Args,
+		fmt.Sprintf("--pgdata=%s", backupDir),
+		"--format=tar",
+		"--wal-method=stream",
+	)
+	session.setUserArgs(opt.pgArgs)
+
+	resticWrapper, err := restic.NewResticWrapperFromShell(opt.setupOptions, session.sh)
+	if err != nil {
+		return nil, err
+	}
+	err = resticWrapper.EnsureNoExclusiveLock(opt.kubeClient, opt.namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	opt.backupOptions.Args = []string{"--tag", fmt.Sprintf("%s=%s", backupTypeTag, BackupTypeFull), "--tag", BackupChainTag}
+	if opt.incremental {
+		err = opt.prepareIncrementalBackup(resticWrapper, session)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = runPhase(&opt.backupStats.Phases, "basebackup", func() error {
+		return session.sh.Command(session.cmd.Name, session.cmd.Args...).Run()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	opt.backupOptions.BackupPaths = []string{backupDir}
+	var backupOutput *restic.BackupOutput
+	err = runPhase(&opt.backupStats.Phases, "upload", func() error {
+		var err error
+		backupOutput, err = resticWrapper.RunBackup(opt.backupOptions, targetRef)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = opt.applyChainRetention(resticWrapper)
+	if err != nil {
+		return nil, err
+	}
+	return backupOutput, nil
+}
+
+// ensureReplicationAllowed checks the requirements of pg_basebackup, so that the backup does not
+// fail after it has started.
+func (session *sessionWrapper) ensureReplicationAllowed() error {
+	rows, err := session.executeQuery(DefaultPostgresDB, replicationPrivilegeQuery)
+	if err != nil {
+		return err
+	}
+	if len(rows) != 1 || rows[0] != "t" {
+		return fmt.Errorf("the database user must have the REPLICATION attribute or be a superuser to take a base backup")
+	}
+
+	rows, err = session.executeQuery(DefaultPostgresDB, maxWALSendersQuery)
+	if err != nil {
+		return err
+	}
+	if len(rows) != 1 || rows[0] == "0" {
+		return fmt.Errorf("max_wal_senders must be greater than 0 to take a base backup")
+	}
+
+	rows, err = session.executeQuery(DefaultPostgresDB, userTablespacesQuery)
+	if err != nil {
+		return err
+	}
+	if len(rows) != 1 || rows[0] != "0" {
+		return fmt.Errorf("base backup of clusters with user defined tablespaces is not supported")
+	}
+	return nil
+}
+
+// restoreBaseBackup lays down the data directory from a physical base backup. The database must not
+// be running on the data directory, the server is started on it once the restore has completed.
+// An incremental backup is combined with its parents into a full data directory.
+func (opt *postgresOptions) restoreBaseBackup(w *restic.ResticWrapper, snapshot *restic.Snapshot, targetRef api_v1beta1.TargetRef) (*restic.RestoreOutput, error) {
+	startTime := time.Now()
+
+	if opt.dataDir == "" {
+		return nil, fmt.Errorf("data directory must be specified to restore a physical base backup")
+	}
+	// never overwrite an existing cluster
+	entries, err := os.ReadDir(opt.dataDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(entries) != 0 {
+		return nil, fmt.Errorf("data directory %s is not empty", opt.dataDir)
+	}
+
+	chain, err := getBackupChain(w, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	var restoreOutput *restic.RestoreOutput
+	if len(chain) == 1 {
+		restoreOutput, err = opt.extractBaseBackup(w, snapshot, opt.dataDir, false, targetRef)
+	} else {
+		restoreOutput, err = opt.combineBackupChain(w, chain, targetRef)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// postgres refuses to start on a data directory accessible by other users
+	if err := os.Chmod(opt.dataDir, 0o700); err != nil {
+		return nil, err
+	}
+
+	for i := range restoreOutput.RestoreTargetStatus.Stats {
+		restoreOutput.RestoreTargetStatus.Stats[i].Duration = time.Since(startTime).String()
+	}
+	return restoreOutput, nil
+}
+
+// extractBaseBackup extracts the archives of a base backup into a directory. The manifest of the
+// backup is only required when the directory is going to be combined with other backups.
+func (opt *postgresOptions) extractBaseBackup(w *restic.ResticWrapper, snapshot *restic.Snapshot, dir string, withManifest bool, targetRef api_v1beta1.TargetRef) (*restic.RestoreOutput, error) {
+	type archive struct {
+		name     string
+		pipeline restic.Command
+	}
+	archives := []archive{
+		{
+			name:     baseBackupDataArchive,
+			pipeline: restic.Command{Name: TarCMD, Args: []any{"-x", "-f", "-", "-C", dir}},
+		},
+		{
+			name:     baseBackupWALArchive,
+			pipeline: restic.Command{Name: TarCMD, Args: []any{"-x", "-f", "-", "-C", filepath.Join(dir, "pg_wal")}},
+		},
+	}
+	if withManifest {
+		archives = append(archives, archive{
+			name:     baseBackupManifest,
+			pipeline: restic.Command{Name: "dd", Args: []any{fmt.Sprintf("of=%s", filepath.Join(dir, baseBackupManifest))}},
+		})
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "pg_wal"), 0o700); err != nil {
+		return nil, err
+	}
+
+	var restoreOutput *restic.RestoreOutput
+	for _, a := range archives {
+		// The restore process should follow the following pipeline: restic dump <archive> | tar -x -f - -C <destination> .
+		dumpOptions := opt.dumpOptions
+		dumpOptions.Snapshot = snapshot.ID
+		dumpOptions.FileName = path.Join(dumpFileOf(snapshot), a.name)
+		dumpOptions.StdoutPipeCommands = append(dumpOptions.StdoutPipeCommands, a.pipeline)
+		err := runPhase(&opt.restoreStats.Phases, fmt.Sprintf("%s/%s", shortID(snapshot.ID), a.name), func() error {
+			var err error
+			restoreOutput, err = w.Dump(dumpOptions, targetRef)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return restoreOutput, nil
+}
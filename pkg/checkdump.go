@@ -0,0 +1,294 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"github.com/spf13/cobra"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog/v2"
+)
+
+const (
+	CheckDumpCMD = "check-dump"
+
+	// customArchiveMagic starts every custom format archive written by pg_dump
+	customArchiveMagic = "PGDMP"
+	// dumpTailSize is the size of the end of a plain dump that is kept to find the completion trailer
+	dumpTailSize = 4096
+)
+
+// dumpCheck tells whether a dump streamed into the repository is complete.
+type dumpCheck struct {
+	Complete bool  `json:"complete"`
+	Bytes    int64 `json:"bytes"`
+	// SHA256 indicates the checksum of the dump
+	SHA256 string `json:"sha256,omitempty"`
+	// Reason explains why the dump is not complete
+	Reason string `json:"reason,omitempty"`
+}
+
+// dumpChecker checks a dump while it is being copied. The end of a plain dump is kept to find the completion
+// trailer of pg_dump or pg_dumpall. A custom format archive is restored into /dev/null by pg_restore, which reads
+// the whole archive and fails if its table of contents is not valid or if it ends before the data of every entry.
+type dumpChecker struct {
+	backupCMD string
+	format    string
+	bytes     int64
+	hash      hash.Hash
+	head      []byte
+	tail      []byte
+
+	restore      *exec.Cmd
+	restoreStdin io.WriteCloser
+	restoreErr   bytes.Buffer
+	// restoreClosed indicates whether pg_restore has stopped reading the archive
+	restoreClosed bool
+}
+
+func (c *dumpChecker) Write(data []byte) (int, error) {
+	c.bytes += int64(len(data))
+	c.hash.Write(data)
+	if n := len(customArchiveMagic) - len(c.head); n > 0 {
+		c.head = append(c.head, data[:min(n, len(data))]...)
+	}
+	switch c.format {
+	case DumpFormatPlain:
+		c.tail = append(c.tail, data...)
+		if len(c.tail) > dumpTailSize {
+			c.tail = append(c.tail[:0], c.tail[len(c.tail)-dumpTailSize:]...)
+		}
+	case DumpFormatCustom:
+		if c.restore == nil {
+			if err := c.startRestore(); err != nil {
+				return 0, err
+			}
+		}
+		// pg_restore only stops reading early when the archive is not valid, which its exit status reports
+		if !c.restoreClosed {
+			if _, err := c.restoreStdin.Write(data); err != nil {
+				c.restoreClosed = true
+			}
+		}
+	}
+	return len(data), nil
+}
+
+func (c *dumpChecker) startRestore() error {
+	c.restore = exec.Command(PgArchiveRestore, "--file=/dev/null")
+	c.restore.Stdout = io.Discard
+	c.restore.Stderr = &c.restoreErr
+	stdin, err := c.restore.StdinPipe()
+	if err != nil {
+		return err
+	}
+	c.restoreStdin = stdin
+	return c.restore.Start()
+}
+
+// result returns the verdict once the whole dump has been copied.
+func (c *dumpChecker) result() dumpCheck {
+	check := dumpCheck{Bytes: c.bytes, SHA256: hex.EncodeToString(c.hash.Sum(nil))}
+	if c.bytes == 0 {
+		check.Reason = "the dump is empty"
+		return check
+	}
+	switch c.format {
+	case DumpFormatPlain:
+		trailer := dumpCompleteTrailer
+		if c.backupCMD == PgDumpallCMD {
+			trailer = clusterDumpCompleteTrailer
+		}
+		if last := lastDumpLine(c.tail); last != trailer {
+			if len(last) > 80 {
+				last = last[:80] + "..."
+			}
+			check.Reason = fmt.Sprintf("the dump does not end with %q, the last line is %q", trailer, last)
+			return check
+		}
+	case DumpFormatCustom:
+		_ = c.restoreStdin.Close()
+		err := c.restore.Wait()
+		if string(c.head) != customArchiveMagic {
+			check.Reason = "the dump is not a custom format archive"
+			return check
+		}
+		if err != nil {
+			check.Reason = fmt.Sprintf("the archive can not be read to its end: %s", strings.TrimSpace(c.restoreErr.String()))
+			return check
+		}
+	}
+	check.Complete = true
+	return check
+}
+
+// lastDumpLine returns the last line of a plain dump, skipping the empty lines and the "--" lines around the trailer.
+// Since PostgreSQL 17.6, the trailer is followed by the \unrestrict meta-command, which is skipped as well.
+func lastDumpLine(tail []byte) string {
+	lines := strings.Split(string(tail), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if line != "" && line != "--" && !isUnrestrictMeta(line) {
+			return line
+		}
+	}
+	return ""
+}
+
+func isUnrestrictMeta(line string) bool {
+	return strings.HasPrefix(line, `\unrestrict `) || line == `\unrestrict`
+}
+
+func NewCmdCheckDump() *cobra.Command {
+	var (
+		backupCMD  = PgDumpCMD
+		format     = DumpFormatPlain
+		reportFile string
+	)
+
+	cmd := &cobra.Command{
+		Use:               CheckDumpCMD,
+		Short:             "Checks that a dump read from the stdin is complete",
+		Long:              `Copies a dump from the stdin into the stdout and writes whether it is complete into a JSON file. It is used by backup-pg as a stage of the backup pipeline.`,
+		Hidden:            true,
+		DisableAutoGenTag: true,
+		SilenceUsage:      true,
+		Args:              cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if format != DumpFormatPlain && format != DumpFormatCustom {
+				return fmt.Errorf("invalid dump format: expected %s or %s, but instead got %s", DumpFormatPlain, DumpFormatCustom, format)
+			}
+			checker := &dumpChecker{backupCMD: backupCMD, format: format, hash: sha256.New()}
+			out := bufio.NewWriterSize(os.Stdout, 1<<20)
+			if _, err := io.Copy(io.MultiWriter(out, checker), os.Stdin); err != nil {
+				return err
+			}
+			if err := out.Flush(); err != nil {
+				return err
+			}
+			// the verdict is only written into the report, restic must see the end of the stream either way
+			return writeOutput(reportFile, checker.result())
+		},
+	}
+
+	cmd.Flags().StringVar(&backupCMD, "backup-cmd", backupCMD, "Command the dump has been taken with (can only be pg_dump or pg_dumpall)")
+	cmd.Flags().StringVar(&format, "format", format, "Format of the dump (can only be plain or custom)")
+	cmd.Flags().StringVar(&reportFile, "report", reportFile, "Path of the file where the verdict will be written")
+	return cmd
+}
+
+// withDumpCheck adds the check-dump stage after the dump command of the backup, so that the pipeline becomes
+// <dump command> | stash-postgres check-dump <args> | restic backup --stdin .
+func withDumpCheck(backupOptions *restic.BackupOptions, backupCMD, format, reportFile string) error {
+	stage, err := reportStage(CheckDumpCMD, reportFile, fmt.Sprintf("--backup-cmd=%s", backupCMD), fmt.Sprintf("--format=%s", format))
+	if err != nil {
+		return err
+	}
+	backupOptions.StdinPipeCommands = append(backupOptions.StdinPipeCommands, stage)
+	return nil
+}
+
+// dumpCheckFile returns the file the verdict of the i-th dump of the backup is written into.
+func (opt *postgresOptions) dumpCheckFile(i int) string {
+	return filepath.Join(opt.setupOptions.ScratchDir, fmt.Sprintf("dump-check-%d.json", i))
+}
+
+func readDumpCheck(reportFile string) dumpCheck {
+	var check dumpCheck
+	if err := readReport(reportFile, &check); err != nil {
+		return dumpCheck{Reason: fmt.Sprintf("the dump has not been checked: %v", err)}
+	}
+	return check
+}
+
+// removePartialSnapshots checks the verdicts of the dumps once they have been backed up. restic takes a snapshot of
+// whatever it has read once the pipe is closed, so the snapshot of a dump that has been cut short is removed, and
+// the backup of its host is marked as failed. The snapshot is looked up in the repository if the backup has failed.
+func (opt *postgresOptions) removePartialSnapshots(w *restic.ResticWrapper, backupOptions []restic.BackupOptions, startTime time.Time, backupOutput *restic.BackupOutput, backupErr error) error {
+	var (
+		errs      []error
+		snapshots []restic.Snapshot
+		listed    bool
+	)
+	if backupErr != nil {
+		errs = append(errs, backupErr)
+	}
+	for i, options := range backupOptions {
+		check := readDumpCheck(opt.dumpCheckFile(i))
+		if check.Complete {
+			opt.dumpChecksums[options.Host] = streamChecksum{SHA256: check.SHA256, Bytes: check.Bytes}
+			continue
+		}
+		klog.Errorf("Dump of host %s is incomplete: %s", options.Host, check.Reason)
+
+		var partial []string
+		if backupOutput != nil {
+			for idx, hostStats := range backupOutput.BackupTargetStatus.Stats {
+				if hostStats.Hostname != options.Host {
+					continue
+				}
+				for _, s := range hostStats.Snapshots {
+					partial = append(partial, s.Name)
+				}
+				backupOutput.BackupTargetStatus.Stats[idx].Phase = api_v1beta1.HostBackupFailed
+				backupOutput.BackupTargetStatus.Stats[idx].Error = fmt.Sprintf("incomplete dump: %s", check.Reason)
+			}
+		}
+		if len(partial) == 0 {
+			if !listed {
+				var err error
+				if snapshots, err = w.ListSnapshots(nil); err != nil {
+					return err
+				}
+				listed = true
+			}
+			for _, s := range snapshots {
+				if s.Hostname == options.Host && slices.Contains(s.Paths, "/"+options.StdinFileName) && !s.Time.Before(startTime) {
+					partial = append(partial, s.ID)
+				}
+			}
+		}
+		if len(partial) > 0 {
+			klog.Infof("Removing snapshots of the incomplete dump: %s", strings.Join(partial, ", "))
+			if _, err := w.DeleteSnapshots(partial); err != nil {
+				return err
+			}
+			opt.backupStats.PartialSnapshots = append(opt.backupStats.PartialSnapshots, partial...)
+		}
+		errs = append(errs, fmt.Errorf("dump of host %s is incomplete: %s", options.Host, check.Reason))
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return utilerrors.NewAggregate(errs)
+}
@@ -0,0 +1,199 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeArchiveRestore stands in for pg_restore: like "pg_restore --file=/dev/null" reading an archive from the stdin,
+// it reads the whole stream and fails if the stream ends before the last entry of the archive.
+const fakeArchiveRestore = `#!/bin/sh
+[ "$1" = "--file=/dev/null" ] || { echo "pg_restore: error: unexpected arguments: $*" >&2; exit 2; }
+case "$(cat)" in
+*"-- end of archive") exit 0 ;;
+esac
+echo "pg_restore: error: could not read from input file: end of file" >&2
+exit 1
+`
+
+// failingArchiveRestore stands in for a pg_restore that stops reading at the beginning of the archive.
+const failingArchiveRestore = `#!/bin/sh
+echo "pg_restore: error: input file does not appear to be a valid archive" >&2
+exit 1
+`
+
+func withArchiveRestore(t *testing.T, script string) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, PgArchiveRestore), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func checkDump(t *testing.T, backupCMD, format string, dump []byte) dumpCheck {
+	checker := &dumpChecker{backupCMD: backupCMD, format: format, hash: sha256.New()}
+	// the dump is written in small chunks, as it is streamed by the backup pipeline
+	if _, err := io.CopyBuffer(io.MultiWriter(io.Discard, checker), bytes.NewReader(dump), make([]byte, 512)); err != nil {
+		t.Fatalf("failed to copy the dump: %v", err)
+	}
+	return checker.result()
+}
+
+func TestDumpCheckerPlain(t *testing.T) {
+	const body = "--\n-- PostgreSQL database dump\n--\n\nCREATE TABLE public.t (id integer);\n"
+	tests := []struct {
+		name      string
+		backupCMD string
+		dump      string
+		complete  bool
+		reason    string
+	}{
+		{
+			name:      "complete dump",
+			backupCMD: PgDumpCMD,
+			dump:      body + "\n--\n" + dumpCompleteTrailer + "\n--\n\n",
+			complete:  true,
+		},
+		{
+			name:      "complete dump followed by unrestrict",
+			backupCMD: PgDumpCMD,
+			dump:      body + "\n--\n" + dumpCompleteTrailer + "\n--\n\n\\unrestrict abc123\n\n",
+			complete:  true,
+		},
+		{
+			name:      "complete cluster dump",
+			backupCMD: PgDumpallCMD,
+			dump:      body + "\n--\n" + clusterDumpCompleteTrailer + "\n--\n\n",
+			complete:  true,
+		},
+		{
+			name:      "database trailer in a cluster dump",
+			backupCMD: PgDumpallCMD,
+			dump:      body + "\n--\n" + dumpCompleteTrailer + "\n--\n\n",
+			reason:    `does not end with "` + clusterDumpCompleteTrailer + `"`,
+		},
+		{
+			name:      "truncated dump",
+			backupCMD: PgDumpCMD,
+			dump:      body + "COPY public.t (id) FROM stdin;\n1\n2\n",
+			reason:    `the last line is "2"`,
+		},
+		{
+			name:      "truncated long line",
+			backupCMD: PgDumpCMD,
+			dump:      body + "COMMENT ON TABLE public.t IS '" + strings.Repeat("x", 200),
+			reason:    `xxx..."`,
+		},
+		{
+			name:      "empty dump",
+			backupCMD: PgDumpCMD,
+			reason:    "the dump is empty",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := checkDump(t, tt.backupCMD, DumpFormatPlain, []byte(tt.dump))
+			if check.Complete != tt.complete || !strings.Contains(check.Reason, tt.reason) {
+				t.Errorf("result() = complete %t, reason %q, want complete %t, reason containing %q", check.Complete, check.Reason, tt.complete, tt.reason)
+			}
+			if check.Bytes != int64(len(tt.dump)) {
+				t.Errorf("Bytes = %d, want %d", check.Bytes, len(tt.dump))
+			}
+			if sum := sha256.Sum256([]byte(tt.dump)); check.SHA256 != hex.EncodeToString(sum[:]) {
+				t.Errorf("SHA256 = %s, want %s", check.SHA256, hex.EncodeToString(sum[:]))
+			}
+		})
+	}
+}
+
+func TestDumpCheckerCustom(t *testing.T) {
+	// the archive is larger than a pipe buffer, so that a pg_restore that does not read it all is noticed
+	archive := customArchiveMagic + "\x01\x10\x00\x04\x08\x01" + strings.Repeat("table data ", 16<<10) + "-- end of archive"
+	tests := []struct {
+		name     string
+		restore  string
+		dump     string
+		complete bool
+		reason   string
+	}{
+		{
+			name:     "complete archive",
+			restore:  fakeArchiveRestore,
+			dump:     archive,
+			complete: true,
+		},
+		{
+			name:    "archive truncated after its table of contents",
+			restore: fakeArchiveRestore,
+			dump:    archive[:len(archive)/2],
+			reason:  "the archive can not be read to its end: pg_restore: error: could not read from input file: end of file",
+		},
+		{
+			name:    "archive pg_restore stops reading",
+			restore: failingArchiveRestore,
+			dump:    archive,
+			reason:  "the archive can not be read to its end: pg_restore: error: input file does not appear to be a valid archive",
+		},
+		{
+			name:    "plain dump",
+			restore: failingArchiveRestore,
+			dump:    "--\n-- PostgreSQL database dump\n--\n",
+			reason:  "the dump is not a custom format archive",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withArchiveRestore(t, tt.restore)
+			check := checkDump(t, PgDumpCMD, DumpFormatCustom, []byte(tt.dump))
+			if check.Complete != tt.complete || check.Reason != tt.reason {
+				t.Errorf("result() = complete %t, reason %q, want complete %t, reason %q", check.Complete, check.Reason, tt.complete, tt.reason)
+			}
+			if check.Bytes != int64(len(tt.dump)) {
+				t.Errorf("Bytes = %d, want %d", check.Bytes, len(tt.dump))
+			}
+		})
+	}
+}
+
+func TestLastDumpLine(t *testing.T) {
+	tests := []struct {
+		name string
+		tail string
+		want string
+	}{
+		{name: "trailer", tail: "--\n" + dumpCompleteTrailer + "\n--\n\n", want: dumpCompleteTrailer},
+		{name: "unrestrict", tail: dumpCompleteTrailer + "\n--\n\n\\unrestrict Zm9vYmFy\n\n", want: dumpCompleteTrailer},
+		{name: "bare unrestrict", tail: dumpCompleteTrailer + "\n\\unrestrict\n", want: dumpCompleteTrailer},
+		{name: "statement", tail: "SELECT 1;\n  \n", want: "SELECT 1;"},
+		{name: "no line", tail: "--\n\n--\n", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lastDumpLine([]byte(tt.tail)); got != tt.want {
+				t.Errorf("lastDumpLine() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
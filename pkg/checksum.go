@@ -0,0 +1,131 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"github.com/spf13/cobra"
+	"k8s.io/klog/v2"
+)
+
+const ChecksumCMD = "checksum"
+
+// streamChecksum is the SHA-256 of a dump, computed over the bytes as they are streamed through the pipeline.
+type streamChecksum struct {
+	SHA256 string `json:"sha256"`
+	Bytes  int64  `json:"bytes"`
+}
+
+func NewCmdChecksum() *cobra.Command {
+	var reportFile string
+
+	cmd := &cobra.Command{
+		Use:               ChecksumCMD,
+		Short:             "Copies the stdin into the stdout and writes its SHA-256 into a JSON file",
+		Long:              `Copies the stdin into the stdout and writes the SHA-256 of the copied bytes into a JSON file once the stdin has been read to its end. It is used by backup-pg and restore-pg as a stage of their pipelines.`,
+		Hidden:            true,
+		DisableAutoGenTag: true,
+		SilenceUsage:      true,
+		Args:              cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			hash := sha256.New()
+			out := bufio.NewWriterSize(os.Stdout, 1<<20)
+			n, err := io.Copy(io.MultiWriter(out, hash), os.Stdin)
+			if err != nil {
+				return err
+			}
+			if err := out.Flush(); err != nil {
+				return err
+			}
+			return writeOutput(reportFile, streamChecksum{SHA256: hex.EncodeToString(hash.Sum(nil)), Bytes: n})
+		},
+	}
+
+	cmd.Flags().StringVar(&reportFile, "report", reportFile, "Path of the file where the checksum will be written")
+	return cmd
+}
+
+// checksumStage returns the stage computing the checksum of the stream it is added to.
+func checksumStage(reportFile string) (restic.Command, error) {
+	return reportStage(ChecksumCMD, reportFile)
+}
+
+func readChecksum(reportFile string) (*streamChecksum, error) {
+	var checksum streamChecksum
+	if err := readReport(reportFile, &checksum); err != nil {
+		return nil, err
+	}
+	return &checksum, nil
+}
+
+// verifyChecksum compares the checksum of a dump read out of the repository with the checksum recorded at backup.
+func verifyChecksum(snapshotID, expected, reportFile string) error {
+	checksum, err := readChecksum(reportFile)
+	if err != nil {
+		return fmt.Errorf("the checksum of the dump of snapshot %s has not been computed: %v", shortID(snapshotID), err)
+	}
+	if checksum.SHA256 != expected {
+		return fmt.Errorf("checksum mismatch: the dump of snapshot %s read out of the repository has SHA-256 %s, but the dump taken at backup has SHA-256 %s", shortID(snapshotID), checksum.SHA256, expected)
+	}
+	klog.Infof("Checksum of the dump of snapshot %s matches the checksum taken at backup: %s", shortID(snapshotID), expected)
+	return nil
+}
+
+// dumpChecksums returns the checksums recorded at backup in the manifests of the snapshots, keyed by the IDs
+// of the snapshots. The snapshots taken before the manifests have been introduced do not have one. Every dump
+// listed in a manifest has been checksummed at backup, so a dump whose checksum is missing from its manifest
+// can not be verified and is not restored.
+func dumpChecksums(manifests map[string]*backupManifest, snapshots []restic.Snapshot) (map[string]string, error) {
+	checksums := make(map[string]string)
+	for i := range snapshots {
+		id := snapshots[i].ID
+		s := manifests[id].snapshot(id)
+		switch {
+		case s == nil:
+			klog.Warningf("No manifest has been stored along with the dump of snapshot %s, its checksum will not be verified", shortID(id))
+		case s.SHA256 == "":
+			return nil, fmt.Errorf("the manifest of snapshot %s does not hold the checksum of its dump, which can not be verified", shortID(id))
+		default:
+			checksums[id] = s.SHA256
+		}
+	}
+	return checksums, nil
+}
+
+// addChecksumStage adds the checksum stage to the pipeline reading a dump out of the repository, if a checksum has
+// been recorded for the dump at backup. It returns the function verifying the checksum once the dump has been read.
+func addChecksumStage(dumpOptions *restic.DumpOptions, expected, reportFile string) (verify func() error, err error) {
+	if expected == "" {
+		return func() error { return nil }, nil
+	}
+	stage, err := checksumStage(reportFile)
+	if err != nil {
+		return nil, err
+	}
+	dumpOptions.StdoutPipeCommands = append(dumpOptions.StdoutPipeCommands, stage)
+	return func() error {
+		return verifyChecksum(dumpOptions.Snapshot, expected, reportFile)
+	}, nil
+}
@@ -0,0 +1,131 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+func TestDumpChecksums(t *testing.T) {
+	manifest := &backupManifest{Snapshots: []manifestSnapshot{
+		{Snapshot: "app", SHA256: "aaaa"},
+		{Snapshot: "shop", SHA256: "bbbb"},
+		{Snapshot: "unchecked"},
+	}}
+	tests := []struct {
+		name      string
+		manifests map[string]*backupManifest
+		snapshots []string
+		want      map[string]string
+		// wantErr is a part of the expected error, empty if no error is expected
+		wantErr string
+	}{
+		{
+			name:      "checksums of a backup",
+			manifests: map[string]*backupManifest{"app": manifest, "shop": manifest},
+			snapshots: []string{"app", "shop"},
+			want:      map[string]string{"app": "aaaa", "shop": "bbbb"},
+		},
+		{
+			name:      "snapshot without manifest",
+			manifests: map[string]*backupManifest{"app": manifest},
+			snapshots: []string{"app", "old"},
+			want:      map[string]string{"app": "aaaa"},
+		},
+		{
+			name:      "checksum missing from the manifest",
+			manifests: map[string]*backupManifest{"app": manifest, "unchecked": manifest},
+			snapshots: []string{"app", "unchecked"},
+			wantErr:   "does not hold the checksum",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var snapshots []restic.Snapshot
+			for _, id := range tt.snapshots {
+				snapshots = append(snapshots, restic.Snapshot{ID: id})
+			}
+			got, err := dumpChecksums(tt.manifests, snapshots)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("dumpChecksums() error = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dumpChecksums() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	tests := []struct {
+		name string
+		// report is the content of the report file, which is not written if it is empty
+		report  string
+		wantErr string
+	}{
+		{
+			name:   "matching checksum",
+			report: `{"sha256": "aaaa", "bytes": 4}`,
+		},
+		{
+			name:    "mismatch",
+			report:  `{"sha256": "bbbb", "bytes": 4}`,
+			wantErr: "checksum mismatch",
+		},
+		{
+			name:    "dump not read to its end",
+			wantErr: "has not been written",
+		},
+		{
+			name:    "corrupt report",
+			report:  `{"sha256": `,
+			wantErr: "failed to parse the report",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reportFile := filepath.Join(t.TempDir(), "checksum.json")
+			if tt.report != "" {
+				if err := os.WriteFile(reportFile, []byte(tt.report), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := verifyChecksum("0123456789abcdef", "aaaa", reportFile)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("verifyChecksum() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("verifyChecksum() error = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"strings"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// CleanRecreate drops the databases and creates them again
+	CleanRecreate = "recreate"
+	// CleanObjects drops the objects of the databases, keeping the databases themselves
+	CleanObjects = "objects"
+	// CleanRequireEmpty refuses to restore into a database holding any object
+	CleanRequireEmpty = "require-empty"
+
+	userSchemasQuery = `SELECT nspname FROM pg_namespace WHERE nspname NOT IN ('pg_catalog', 'information_schema') AND nspname NOT LIKE 'pg\_toast%' AND nspname NOT LIKE 'pg\_temp\_%' ORDER BY nspname`
+	userObjectsQuery = `SELECT (SELECT count(*) FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace WHERE n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg\_toast%') + (SELECT count(*) FROM pg_proc p JOIN pg_namespace n ON n.oid = p.pronamespace WHERE n.nspname NOT IN ('pg_catalog', 'information_schema'))`
+)
+
+// cleanDatabases prepares the databases the dump will be restored into according to the clean mode. The destructive
+// modes only touch the databases that have been confirmed by the user with --confirm-destroy.
+func (opt *postgresOptions) cleanDatabases(session *sessionWrapper, snapshot *restic.Snapshot, dumpFormat, restoreDB string) error {
+	switch opt.clean {
+	case CleanRecreate, CleanObjects, CleanRequireEmpty:
+	default:
+		return fmt.Errorf("invalid clean mode: expected %s, %s or %s, but instead got %s", CleanRecreate, CleanObjects, CleanRequireEmpty, opt.clean)
+	}
+
+	databases, createdByDump, err := opt.restoredDatabases(snapshot, dumpFormat, restoreDB)
+	if err != nil {
+		return err
+	}
+	stats := &cleanStats{Mode: opt.clean}
+	opt.restoreStats.Clean = stats
+
+	for _, database := range databases {
+		exists, err := session.databaseExists(database)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if opt.clean == CleanRequireEmpty {
+			if err := session.ensureEmpty(database); err != nil {
+				return err
+			}
+		} else {
+			if !opt.destroyConfirmed(database) {
+				return fmt.Errorf("refusing to clean database %s: confirm it with --confirm-destroy=%s", database, database)
+			}
+			dropped, err := session.cleanDatabase(database, opt.clean)
+			if err != nil {
+				return err
+			}
+			stats.Databases = append(stats.Databases, *dropped)
+			if dropped.Dropped && !createdByDump {
+				if err := session.ensureDatabase(database); err != nil {
+					return err
+				}
+			}
+		}
+		if opt.clean != CleanRecreate && createdByDump {
+			// the database is kept, so the CREATE DATABASE statement of the dump must not be run
+			opt.filter.existingDatabases = append(opt.filter.existingDatabases, database)
+		}
+	}
+	return nil
+}
+
+// restoredDatabases returns the databases the dump will be restored into, and whether the dump creates them itself.
+func (opt *postgresOptions) restoredDatabases(snapshot *restic.Snapshot, dumpFormat, restoreDB string) ([]string, bool, error) {
+	if dumpFormat != DumpFormatPlain {
+		return []string{restoreDB}, false, nil
+	}
+	opt.selectPerDatabaseDump(snapshot)
+	switch {
+	case opt.filter.targetDatabase != "":
+		return []string{opt.filter.targetDatabase}, true, nil
+	case len(opt.filter.databases) > 0:
+		return opt.filter.databases, true, nil
+	}
+	// a plain dump of pg_dump is restored into the database psql connects to
+	if database := databaseFromArgs(opt.pgArgs); database != "" {
+		return []string{database}, false, nil
+	}
+	return nil, false, fmt.Errorf("the databases to clean are not known: select them with --database, or give the database with --dbname in pg-args")
+}
+
+func (opt *postgresOptions) destroyConfirmed(database string) bool {
+	for _, confirmed := range opt.confirmDestroy {
+		if confirmed == database {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureEmpty returns an error if the database holds any relation or function outside of the system schemas.
+func (session *sessionWrapper) ensureEmpty(database string) error {
+	rows, err := session.executeQuery(database, userObjectsQuery)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 1 && rows[0] != "0" {
+		return fmt.Errorf("database %s is not empty: it holds %s objects", database, rows[0])
+	}
+	return nil
+}
+
+// cleanDatabase terminates the connections to the database, then either drops it or drops its schemas.
+// The public schema is created again, as the dumps of recent versions expect it to exist.
+func (session *sessionWrapper) cleanDatabase(database, mode string) (*droppedDatabase, error) {
+	if mode == CleanRecreate {
+		klog.Infof("Dropping database %s", database)
+		terminated, err := session.dropDatabase(database)
+		if err != nil {
+			return nil, err
+		}
+		return &droppedDatabase{Name: database, TerminatedConnections: terminated, Dropped: true}, nil
+	}
+
+	terminated, err := session.terminateConnections(database)
+	if err != nil {
+		return nil, err
+	}
+	dropped := &droppedDatabase{
+		Name:                  database,
+		TerminatedConnections: terminated,
+	}
+
+	schemas, err := session.executeQuery(database, userSchemasQuery)
+	if err != nil {
+		return nil, err
+	}
+	if len(schemas) == 0 {
+		return dropped, nil
+	}
+	names := make([]string, 0, len(schemas))
+	for _, schema := range schemas {
+		names = append(names, quoteIdentifier(schema))
+		dropped.Schemas = append(dropped.Schemas, schema)
+	}
+	query := fmt.Sprintf("DROP SCHEMA %s CASCADE;", strings.Join(names, ", "))
+	for _, schema := range schemas {
+		if schema == "public" {
+			query += " CREATE SCHEMA public;"
+		}
+	}
+	klog.Infof("Dropping schemas %s of database %s", strings.Join(schemas, ", "), database)
+	if _, err := session.executeQuery(database, query); err != nil {
+		return nil, err
+	}
+	return dropped, nil
+}
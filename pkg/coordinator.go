@@ -0,0 +1,151 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	shell "gomodules.xyz/go-sh"
+	"k8s.io/klog/v2"
+)
+
+// exportSnapshotQuery exports the snapshot of the current transaction along with the WAL location it has been taken at.
+const exportSnapshotQuery = "SELECT pg_export_snapshot(), CASE WHEN pg_is_in_recovery() THEN pg_last_wal_replay_lsn() ELSE pg_current_wal_lsn() END;"
+
+// snapshotCoordinator keeps a transaction open on a database and exports its snapshot. Every pg_dump launched
+// with the exported snapshot sees the database at the same point in time. The snapshot stays valid only as
+// long as the transaction is open, so the coordinator must be closed once all the dumps have completed.
+// PostgreSQL can not import a snapshot into another database, so a coordinator is required for each database.
+type snapshotCoordinator struct {
+	exportedSnapshot
+	sh    *shell.Session
+	stdin io.WriteCloser
+}
+
+// exportSnapshot opens a psql session on the database, starts a repeatable read transaction and exports its snapshot.
+// psql keeps running while the dumps use the snapshot, so it is started in a shell session of its own, which holds
+// the environment of the session the queries run in.
+func (session *sessionWrapper) exportSnapshot(database string) (*snapshotCoordinator, error) {
+	args := append(session.newArgs(),
+		"--no-psqlrc",
+		"--tuples-only",
+		"--no-align",
+		"--quiet",
+		fmt.Sprintf("--dbname=%s", database),
+	)
+	sh := shell.NewSession()
+	for k, v := range session.sh.Env {
+		sh.SetEnv(k, v)
+	}
+	// the pipes are handed to psql as they are, so that writing fails instead of blocking once psql has exited
+	stdinReader, stdin, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		_ = stdinReader.Close()
+		_ = stdin.Close()
+		return nil, err
+	}
+	sh.Stdin, sh.Stdout, sh.Stderr = stdinReader, stdoutWriter, os.Stderr
+	err = sh.Command(PgRestoreCMD, args...).Start()
+	// psql holds its own ends of the pipes
+	_ = stdinReader.Close()
+	_ = stdoutWriter.Close()
+	if err != nil {
+		_ = stdin.Close()
+		_ = stdout.Close()
+		return nil, err
+	}
+
+	c := &snapshotCoordinator{
+		exportedSnapshot: exportedSnapshot{Database: database},
+		sh:               sh,
+		stdin:            stdin,
+	}
+	if _, err := fmt.Fprintf(stdin, "BEGIN ISOLATION LEVEL REPEATABLE READ READ ONLY;\n%s\n", exportSnapshotQuery); err != nil {
+		_ = c.close()
+		return nil, err
+	}
+	out := bufio.NewReader(stdout)
+	line, err := out.ReadString('\n')
+	// the rest of the output is not needed, but psql must be able to write it until it exits
+	go func() {
+		_, _ = io.Copy(io.Discard, out)
+		_ = stdout.Close()
+	}()
+	if err != nil {
+		_ = c.close()
+		return nil, fmt.Errorf("failed to export snapshot of database %s: %v", database, err)
+	}
+	parts := strings.Split(strings.TrimSpace(line), "|")
+	if len(parts) != 2 {
+		_ = c.close()
+		return nil, fmt.Errorf("failed to export snapshot of database %s: unexpected output %q", database, line)
+	}
+	c.SnapshotID, c.LSN = parts[0], parts[1]
+	klog.Infof("Exported snapshot %s of database %s at %s", c.SnapshotID, database, c.LSN)
+	return c, nil
+}
+
+// dumpArg returns the argument that makes pg_dump use the exported snapshot.
+func (c *snapshotCoordinator) dumpArg() string {
+	return fmt.Sprintf("--snapshot=%s", c.SnapshotID)
+}
+
+// close ends the transaction, which releases the exported snapshot.
+func (c *snapshotCoordinator) close() error {
+	_, _ = io.WriteString(c.stdin, "COMMIT;\n")
+	_ = c.stdin.Close()
+	return c.sh.Wait()
+}
+
+// closeCoordinators closes the coordinators once the dumps using their snapshots have completed.
+func closeCoordinators(coordinators []*snapshotCoordinator) {
+	for _, c := range coordinators {
+		if err := c.close(); err != nil {
+			klog.Warningf("failed to close the session holding snapshot %s of database %s: %v", c.SnapshotID, c.Database, err)
+		}
+	}
+}
+
+// createFromArgs tells whether the user has asked pg_dump to create the database in the dump through --pg-args.
+func createFromArgs(args string) bool {
+	return slices.ContainsFunc(strings.Fields(args), func(arg string) bool { return arg == "--create" || arg == "-C" })
+}
+
+// databaseFromArgs returns the database the user has asked pg_dump to connect to through --pg-args.
+func databaseFromArgs(args string) string {
+	fields := strings.Fields(args)
+	for i, arg := range fields {
+		switch {
+		case strings.HasPrefix(arg, "--dbname="):
+			return strings.TrimPrefix(arg, "--dbname=")
+		case (arg == "--dbname" || arg == "-d") && i+1 < len(fields):
+			return fields[i+1]
+		case strings.HasPrefix(arg, "-d") && len(arg) > 2 && !strings.HasPrefix(arg, "--"):
+			return strings.TrimPrefix(arg, "-d")
+		}
+	}
+	return ""
+}
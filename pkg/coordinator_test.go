@@ -0,0 +1,75 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	shell "gomodules.xyz/go-sh"
+)
+
+// fakeSnapshotPsql stands in for psql: it answers the export of the snapshot with the password it has been given
+// as the snapshot, and records the statements it has read.
+const fakeSnapshotPsql = `#!/bin/sh
+log="$(dirname "$0")/statements"
+while read -r line; do
+	echo "$line" >> "$log"
+	case "$line" in
+	SELECT*) echo "$PGPASSWORD|0/3000060" ;;
+	COMMIT*) exit 0 ;;
+	esac
+done
+`
+
+func TestExportSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, PgRestoreCMD), []byte(fakeSnapshotPsql), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	session := &sessionWrapper{sh: shell.NewSession()}
+	session.sh.SetEnv(EnvPgPassword, "00000003-00000002-1")
+	c, err := session.exportSnapshot("shop")
+	if err != nil {
+		t.Fatalf("exportSnapshot() error = %v", err)
+	}
+	if c.Database != "shop" || c.SnapshotID != "00000003-00000002-1" || c.LSN != "0/3000060" {
+		t.Errorf("exportSnapshot() = %+v, want snapshot 00000003-00000002-1 of database shop at 0/3000060", c.exportedSnapshot)
+	}
+	if err := c.close(); err != nil {
+		t.Fatalf("close() error = %v", err)
+	}
+	statements, err := os.ReadFile(filepath.Join(dir, "statements"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "BEGIN ISOLATION LEVEL REPEATABLE READ READ ONLY;\n" + exportSnapshotQuery + "\nCOMMIT;\n"; string(statements) != want {
+		t.Errorf("statements = %q, want %q", statements, want)
+	}
+
+	t.Run("psql exiting", func(t *testing.T) {
+		if err := os.WriteFile(filepath.Join(dir, PgRestoreCMD), []byte("#!/bin/sh\nexit 2\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := session.exportSnapshot("shop"); err == nil {
+			t.Errorf("exportSnapshot() succeeded, want an error")
+		}
+	})
+}
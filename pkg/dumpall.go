@@ -0,0 +1,187 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// pg_dumpall writes the dump of each database after the globals, starting with a comment naming the database.
+var databaseDumpMarkerRegex = regexp.MustCompile(`^-- Database "(.*)" dump\s*$`)
+
+// enterSection records that the dump of a database has started and returns its section.
+func (f *sqlFilter) enterSection(database string) string {
+	if f.databases[database] {
+		f.found[database] = true
+	}
+	return database
+}
+
+// keepSection checks whether a section of a pg_dumpall dump has been selected to restore.
+func (f *sqlFilter) keepSection(section string) bool {
+	if f.databases == nil {
+		return true
+	}
+	if section == "" {
+		return f.includeGlobals
+	}
+	return f.databases[section]
+}
+
+// checkDatabases ensures that all the selected databases have been found in the dump.
+func (f *sqlFilter) checkDatabases() error {
+	var missing []string
+	for database := range f.databases {
+		if !f.found[database] {
+			missing = append(missing, database)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("database %s not found in the dump", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// databaseDumpMarker returns the database whose dump starts with the given comment line.
+func databaseDumpMarker(line []byte) (string, bool) {
+	m := databaseDumpMarkerRegex.FindSubmatch(line)
+	if m == nil {
+		return "", false
+	}
+	return string(m[1]), true
+}
+
+// createDatabaseTarget returns the database created by a CREATE DATABASE statement.
+func createDatabaseTarget(tokens []sqlToken) string {
+	if len(tokens) >= 3 && tokens[0].is("create") && tokens[1].is("database") {
+		return tokens[2].identifier()
+	}
+	return ""
+}
+
+// connectTarget returns the database a \connect meta-command connects to. pg_dump writes the database either
+// as a plain argument or as a connection string, i.e. \connect -reuse-previous=on "dbname='my db'".
+func connectTarget(line []byte) (string, bool) {
+	args := splitMetaArgs(strings.TrimSpace(string(line)))
+	if len(args) == 0 || (args[0] != `\connect` && args[0] != `\c`) {
+		return "", false
+	}
+	args = args[1:]
+	if len(args) > 0 && strings.HasPrefix(args[0], "-reuse-previous") {
+		args = args[1:]
+	}
+	if len(args) == 0 || args[0] == "-" {
+		return "", false
+	}
+	if strings.Contains(args[0], "=") {
+		database, ok := conninfoValue(args[0], "dbname")
+		return database, ok
+	}
+	return args[0], true
+}
+
+// connectMeta returns the \connect meta-command connecting to the database, in the form pg_dump writes it for any name.
+func connectMeta(database string) []byte {
+	conninfo := "dbname='" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(database) + "'"
+	return []byte(`\connect -reuse-previous=on "` + strings.ReplaceAll(conninfo, `"`, `""`) + "\"\n")
+}
+
+// splitMetaArgs splits the arguments of a psql meta-command, removing the single and double quotes.
+func splitMetaArgs(line string) []string {
+	var (
+		args    []string
+		current strings.Builder
+		inArg   bool
+		quote   byte
+	)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			switch {
+			case c == quote && i+1 < len(line) && line[i+1] == quote:
+				current.WriteByte(c)
+				i++
+			case c == quote:
+				quote = 0
+			case c == '\\' && quote == '\'' && i+1 < len(line):
+				current.WriteByte(line[i+1])
+				i++
+			default:
+				current.WriteByte(c)
+			}
+		case c == '"' || c == '\'':
+			quote, inArg = c, true
+		case isSpace(c):
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+// conninfoValue returns the value of a keyword in a libpq connection string (i.e. "dbname='my db' host=x").
+func conninfoValue(conninfo, keyword string) (string, bool) {
+	for i := 0; i < len(conninfo); {
+		for i < len(conninfo) && isSpace(conninfo[i]) {
+			i++
+		}
+		eq := strings.IndexByte(conninfo[i:], '=')
+		if eq < 0 {
+			return "", false
+		}
+		key := strings.TrimSpace(conninfo[i : i+eq])
+		i += eq + 1
+		for i < len(conninfo) && isSpace(conninfo[i]) {
+			i++
+		}
+		var value strings.Builder
+		if i < len(conninfo) && conninfo[i] == '\'' {
+			for i++; i < len(conninfo) && conninfo[i] != '\''; i++ {
+				if conninfo[i] == '\\' && i+1 < len(conninfo) {
+					i++
+				}
+				value.WriteByte(conninfo[i])
+			}
+			i++
+		} else {
+			for ; i < len(conninfo) && !isSpace(conninfo[i]); i++ {
+				if conninfo[i] == '\\' && i+1 < len(conninfo) {
+					i++
+				}
+				value.WriteByte(conninfo[i])
+			}
+		}
+		if key == keyword {
+			return value.String(), true
+		}
+	}
+	return "", false
+}
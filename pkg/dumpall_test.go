@@ -0,0 +1,199 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// clusterDump is a pg_dumpall dump of the globals and of the databases app and "my db".
+const clusterDump = `--
+-- PostgreSQL database cluster dump
+--
+
+CREATE ROLE app;
+ALTER ROLE app WITH LOGIN PASSWORD 'a';
+
+--
+-- Databases
+--
+
+--
+-- Database "app" dump
+--
+
+CREATE DATABASE app WITH TEMPLATE = template0 ENCODING = 'UTF8';
+ALTER DATABASE app OWNER TO app;
+\connect app
+CREATE TABLE public.orders (id int);
+
+--
+-- Database "my db" dump
+--
+
+CREATE DATABASE "my db" WITH TEMPLATE = template0;
+\connect -reuse-previous=on "dbname='my db'"
+CREATE TABLE public.users (id int);
+`
+
+func TestSplitMetaArgs(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{in: `\connect app`, want: []string{`\connect`, "app"}},
+		{in: `\connect "my ""db"""`, want: []string{`\connect`, `my "db"`}},
+		{in: `\connect -reuse-previous=on "dbname='my db'"`, want: []string{`\connect`, "-reuse-previous=on", "dbname='my db'"}},
+		{in: `\c 'it\'s'  x`, want: []string{`\c`, "it's", "x"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := splitMetaArgs(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectTarget(t *testing.T) {
+	tests := []struct {
+		in     string
+		want   string
+		wantOK bool
+	}{
+		{in: "\\connect app\n", want: "app", wantOK: true},
+		{in: "\\c app\n", want: "app", wantOK: true},
+		{in: `\connect -reuse-previous=on "dbname='my db'"`, want: "my db", wantOK: true},
+		{in: `\connect -reuse-previous=on "dbname='it\'s' host=x"`, want: "it's", wantOK: true},
+		{in: `\connect -`},
+		{in: `\restrict abc`},
+		{in: `\connect "host=x"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, ok := connectTarget([]byte(tt.in))
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("got (%q, %v), want (%q, %v)", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestConnectMetaRoundTrip(t *testing.T) {
+	for _, database := range []string{"app", "my db", `it's "quoted"`, `back\slash`} {
+		t.Run(database, func(t *testing.T) {
+			if got, ok := connectTarget(connectMeta(database)); !ok || got != database {
+				t.Errorf("got (%q, %v), want %q", got, ok, database)
+			}
+		})
+	}
+}
+
+func TestDatabaseDumpMarker(t *testing.T) {
+	tests := []struct {
+		in     string
+		want   string
+		wantOK bool
+	}{
+		{in: "-- Database \"app\" dump\n", want: "app", wantOK: true},
+		{in: "-- Database \"my db\" dump", want: "my db", wantOK: true},
+		{in: "-- PostgreSQL database dump\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, ok := databaseDumpMarker([]byte(tt.in))
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("got (%q, %v), want (%q, %v)", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestFilterDatabases(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  sqlFilterOptions
+		// kept and dropped are the statements expected to be kept in the output, or dropped out of it
+		kept    []string
+		dropped []string
+		wantErr string
+	}{
+		{
+			name: "whole dump",
+			kept: []string{"CREATE ROLE app;", "CREATE TABLE public.orders", "CREATE TABLE public.users"},
+		},
+		{
+			name:    "selected database",
+			opt:     sqlFilterOptions{databases: []string{"my db"}},
+			kept:    []string{`CREATE DATABASE "my db"`, "CREATE TABLE public.users"},
+			dropped: []string{"CREATE ROLE app;", "CREATE DATABASE app", "CREATE TABLE public.orders"},
+		},
+		{
+			name:    "selected database with the globals",
+			opt:     sqlFilterOptions{databases: []string{"app"}, includeGlobals: true},
+			kept:    []string{"CREATE ROLE app;", "CREATE DATABASE app", `\connect app`, "CREATE TABLE public.orders"},
+			dropped: []string{"CREATE TABLE public.users"},
+		},
+		{
+			name: "renamed database",
+			opt:  sqlFilterOptions{databases: []string{"my db"}, targetDatabase: "copy"},
+			kept: []string{`CREATE DATABASE "copy" WITH`, `\connect -reuse-previous=on "dbname='copy'"`},
+		},
+		{
+			name:    "existing database",
+			opt:     sqlFilterOptions{existingDatabases: []string{"app"}},
+			kept:    []string{"ALTER DATABASE app OWNER TO app;", "CREATE TABLE public.orders"},
+			dropped: []string{"CREATE DATABASE app"},
+		},
+		{
+			name:    "missing database",
+			opt:     sqlFilterOptions{databases: []string{"app", "other"}},
+			wantErr: "database other not found in the dump",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := tt.opt.newSQLFilter().filter(strings.NewReader(clusterDump), &out)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to filter the dump: %v", err)
+			}
+			if got, want := strings.Count(out.String(), "\n"), strings.Count(clusterDump, "\n"); got != want {
+				t.Errorf("got %d lines, want the %d lines of the dump", got, want)
+			}
+			for _, s := range tt.kept {
+				if !strings.Contains(out.String(), s) {
+					t.Errorf("%q has been dropped out of the dump", s)
+				}
+			}
+			for _, s := range tt.dropped {
+				if strings.Contains(out.String(), s) {
+					t.Errorf("%q has been kept in the dump", s)
+				}
+			}
+		})
+	}
+}
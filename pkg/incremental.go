@@ -0,0 +1,324 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	api_v1alpha1 "stash.appscode.dev/apimachinery/apis/stash/v1alpha1"
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	shell "gomodules.xyz/go-sh"
+	"k8s.io/klog/v2"
+)
+
+const (
+	PgCombineBackupCMD = "pg_combinebackup"
+
+	// the snapshots of base backups are tagged with their type and incremental backups also with their parent
+	backupTypeTag       = "backup-type"
+	backupParentTag     = "parent"
+	BackupTypeFull      = "full"
+	BackupTypeIncrement = "incremental"
+	// BackupChainTag is the tag of every base backup. The retention policy of the repository is applied by host,
+	// which would remove a backup incremental backups depend on, so incremental backups require the policy to keep
+	// this tag. The chains are then removed as a whole by applyChainRetention.
+	BackupChainTag = "backup-chain"
+
+	serverVersionQuery = "SHOW server_version_num"
+	summarizeWALQuery  = "SHOW summarize_wal"
+	// incremental backups have been introduced in PostgreSQL 17
+	incrementalMinServerVersion = 170000
+)
+
+// snapshotTag returns the value of a "<key>=<value>" tag of a snapshot.
+func snapshotTag(snapshot *restic.Snapshot, key string) string {
+	for _, tag := range snapshot.Tags {
+		if value, ok := strings.CutPrefix(tag, key+"="); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// prepareIncrementalBackup makes the base backup an incremental one on top of the latest base backup of
+// the host. The manifest of the parent backup is fetched into the scratch directory for pg_basebackup.
+// If there is no base backup yet, a full backup is taken instead.
+func (opt *postgresOptions) prepareIncrementalBackup(w *restic.ResticWrapper, session *sessionWrapper) error {
+	parent, err := opt.latestBaseBackup(w)
+	if err != nil {
+		return err
+	}
+	if parent == nil {
+		klog.Infoln("No base backup found to take an incremental backup on top of. Taking a full backup.")
+		return nil
+	}
+
+	rows, err := session.executeQuery(DefaultPostgresDB, serverVersionQuery)
+	if err != nil {
+		return err
+	}
+	if len(rows) != 1 {
+		return fmt.Errorf("failed to read server version")
+	}
+	version, err := strconv.Atoi(rows[0])
+	if err != nil {
+		return err
+	}
+	if version < incrementalMinServerVersion {
+		return fmt.Errorf("incremental backup requires PostgreSQL 17 or later, but the server version is %d", version)
+	}
+	rows, err = session.executeQuery(DefaultPostgresDB, summarizeWALQuery)
+	if err != nil {
+		return err
+	}
+	if len(rows) != 1 || rows[0] != "on" {
+		return fmt.Errorf("summarize_wal must be enabled to take an incremental backup")
+	}
+
+	// The manifest should be fetched by the following pipeline: restic dump <parent manifest> | dd of=<manifest path> .
+	manifestPath := filepath.Join(opt.setupOptions.ScratchDir, "parent_"+baseBackupManifest)
+	_, err = w.DumpOnce(restic.DumpOptions{
+		Snapshot: parent.ID,
+		FileName: path.Join(dumpFileOf(parent), baseBackupManifest),
+		StdoutPipeCommands: []restic.Command{
+			{Name: "dd", Args: []any{fmt.Sprintf("of=%s", manifestPath)}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	session.cmd.Args = append(session.cmd.Args, fmt.Sprintf("--incremental=%s", manifestPath))
+	opt.backupOptions.Args = []string{
+		"--tag", fmt.Sprintf("%s=%s", backupTypeTag, BackupTypeIncrement),
+		"--tag", fmt.Sprintf("%s=%s", backupParentTag, parent.ID),
+		"--tag", BackupChainTag,
+	}
+	opt.backupStats.Parent = parent.ID
+	return nil
+}
+
+// latestBaseBackup returns the latest base backup of the host, nil if there is none.
+func (opt *postgresOptions) latestBaseBackup(w *restic.ResticWrapper) (*restic.Snapshot, error) {
+	snapshots, err := w.ListSnapshots(nil)
+	if err != nil {
+		return nil, err
+	}
+	var latest *restic.Snapshot
+	for i := range snapshots {
+		if snapshots[i].Hostname != opt.backupOptions.Host || dumpFormatOf(&snapshots[i]) != DumpFormatPhysical {
+			continue
+		}
+		if latest == nil || snapshots[i].Time.After(latest.Time) {
+			latest = &snapshots[i]
+		}
+	}
+	return latest, nil
+}
+
+// getBackupChain returns the chain of base backups required to restore a snapshot, starting with the full backup.
+func getBackupChain(w *restic.ResticWrapper, snapshot *restic.Snapshot) ([]*restic.Snapshot, error) {
+	if snapshotTag(snapshot, backupParentTag) == "" {
+		return []*restic.Snapshot{snapshot}, nil
+	}
+
+	snapshots, err := w.ListSnapshots(nil)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*restic.Snapshot, len(snapshots))
+	for i := range snapshots {
+		byID[snapshots[i].ID] = &snapshots[i]
+	}
+
+	chain := []*restic.Snapshot{snapshot}
+	for parentID := snapshotTag(snapshot, backupParentTag); parentID != ""; {
+		parent, ok := byID[parentID]
+		if !ok {
+			return nil, fmt.Errorf("parent backup %s of snapshot %s not found", shortID(parentID), shortID(chain[0].ID))
+		}
+		chain = append([]*restic.Snapshot{parent}, chain...)
+		parentID = snapshotTag(parent, backupParentTag)
+	}
+	return chain, nil
+}
+
+// combineBackupChain extracts every backup of the chain into the scratch directory and combines them
+// into the data directory with pg_combinebackup.
+func (opt *postgresOptions) combineBackupChain(w *restic.ResticWrapper, chain []*restic.Snapshot, targetRef api_v1beta1.TargetRef) (*restic.RestoreOutput, error) {
+	chainDir := filepath.Join(opt.setupOptions.ScratchDir, "chain")
+	if err := os.RemoveAll(chainDir); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(chainDir)
+
+	var (
+		restoreOutput *restic.RestoreOutput
+		args          []any
+		err           error
+	)
+	for i, snapshot := range chain {
+		dir := filepath.Join(chainDir, strconv.Itoa(i))
+		restoreOutput, err = opt.extractBaseBackup(w, snapshot, dir, true, targetRef)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, dir)
+	}
+
+	// pg_combinebackup creates the output directory itself
+	if err := os.RemoveAll(opt.dataDir); err != nil {
+		return nil, err
+	}
+	args = append(args, fmt.Sprintf("--output=%s", opt.dataDir))
+	err = runPhase(&opt.restoreStats.Phases, "combine", func() error {
+		return shell.NewSession().Command(PgCombineBackupCMD, args...).Run()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return restoreOutput, nil
+}
+
+// hasRetentionPolicy tells whether the retention policy removes any snapshot, the base backups kept by the
+// chain tag aside.
+func hasRetentionPolicy(policy api_v1alpha1.RetentionPolicy) bool {
+	return policy.KeepLast != 0 || policy.KeepHourly != 0 || policy.KeepDaily != 0 || policy.KeepWeekly != 0 ||
+		policy.KeepMonthly != 0 || policy.KeepYearly != 0 || slices.ContainsFunc(policy.KeepTags, func(tag string) bool {
+		return tag != BackupChainTag
+	})
+}
+
+// ensureChainRetention refuses to take an incremental backup while the retention policy of the repository
+// may remove the backups it depends on.
+func (opt *postgresOptions) ensureChainRetention() error {
+	policy := opt.backupOptions.RetentionPolicy
+	if hasRetentionPolicy(policy) && !slices.Contains(policy.KeepTags, BackupChainTag) {
+		return fmt.Errorf("incremental backup requires the retention policy to keep the tag %s (--retention-keep-tags=%s), so that the backups it depends on are only removed along with their chain", BackupChainTag, BackupChainTag)
+	}
+	return nil
+}
+
+// applyChainRetention applies the retention policy to the base backups of the host. An incremental backup
+// is useless without its parents, so the policy keeps or removes whole chains. A chain is kept if any of
+// its backups is kept by the policy. The chain tag, which every base backup has, does not keep a chain.
+func (opt *postgresOptions) applyChainRetention(w *restic.ResticWrapper) error {
+	policy := opt.backupOptions.RetentionPolicy
+	if !hasRetentionPolicy(policy) {
+		return nil
+	}
+
+	snapshots, err := w.ListSnapshots(nil)
+	if err != nil {
+		return err
+	}
+	byID := map[string]*restic.Snapshot{}
+	var backups []*restic.Snapshot
+	for i := range snapshots {
+		if snapshots[i].Hostname != opt.backupOptions.Host || dumpFormatOf(&snapshots[i]) != DumpFormatPhysical {
+			continue
+		}
+		byID[snapshots[i].ID] = &snapshots[i]
+		backups = append(backups, &snapshots[i])
+	}
+	// newest first, the same order restic applies the policy in
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Time.After(backups[j].Time)
+	})
+
+	// find out the full backup each backup depends on
+	rootOf := func(s *restic.Snapshot) string {
+		for {
+			parent, ok := byID[snapshotTag(s, backupParentTag)]
+			if !ok {
+				return s.ID
+			}
+			s = parent
+		}
+	}
+
+	buckets := []struct {
+		count int64
+		key   func(t time.Time, idx int) string
+		last  string
+	}{
+		{count: policy.KeepLast, key: func(_ time.Time, idx int) string { return strconv.Itoa(idx) }},
+		{count: policy.KeepHourly, key: func(t time.Time, _ int) string { return t.Format("2006-01-02 15") }},
+		{count: policy.KeepDaily, key: func(t time.Time, _ int) string { return t.Format("2006-01-02") }},
+		{count: policy.KeepWeekly, key: func(t time.Time, _ int) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{count: policy.KeepMonthly, key: func(t time.Time, _ int) string { return t.Format("2006-01") }},
+		{count: policy.KeepYearly, key: func(t time.Time, _ int) string { return t.Format("2006") }},
+	}
+	keptChains := map[string]bool{}
+	for idx, s := range backups {
+		keep := false
+		for _, tag := range policy.KeepTags {
+			if tag != BackupChainTag && slices.Contains(s.Tags, tag) {
+				keep = true
+			}
+		}
+		for i := range buckets {
+			if buckets[i].count == 0 {
+				continue
+			}
+			if key := buckets[i].key(s.Time.Local(), idx); key != buckets[i].last {
+				buckets[i].last = key
+				buckets[i].count--
+				keep = true
+			}
+		}
+		if keep {
+			keptChains[rootOf(s)] = true
+		}
+	}
+
+	var removed []string
+	for _, s := range backups {
+		if !keptChains[rootOf(s)] {
+			removed = append(removed, s.ID)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	if policy.DryRun {
+		klog.Infof("Retention policy would remove base backups: %s", strings.Join(removed, ", "))
+		return nil
+	}
+	klog.Infof("Removing base backups according to the retention policy: %s", strings.Join(removed, ", "))
+	if !policy.Prune {
+		klog.Infoln("The data of the removed base backups is pruned along with them")
+	}
+	if _, err := w.DeleteSnapshots(removed); err != nil {
+		return err
+	}
+	opt.backupStats.RemovedSnapshots = removed
+	return nil
+}
@@ -0,0 +1,69 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"testing"
+
+	api_v1alpha1 "stash.appscode.dev/apimachinery/apis/stash/v1alpha1"
+)
+
+func TestEnsureChainRetention(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  api_v1alpha1.RetentionPolicy
+		applied bool
+		wantErr bool
+	}{
+		{
+			name: "no policy",
+		},
+		{
+			name:    "policy removing base backups",
+			policy:  api_v1alpha1.RetentionPolicy{KeepDaily: 7},
+			applied: true,
+			wantErr: true,
+		},
+		{
+			name:    "policy keeping other tags",
+			policy:  api_v1alpha1.RetentionPolicy{KeepTags: []string{"monthly"}},
+			applied: true,
+			wantErr: true,
+		},
+		{
+			name:    "policy keeping the chains",
+			policy:  api_v1alpha1.RetentionPolicy{KeepLast: 3, KeepTags: []string{BackupChainTag}},
+			applied: true,
+		},
+		{
+			name:   "policy only keeping the chains",
+			policy: api_v1alpha1.RetentionPolicy{KeepTags: []string{BackupChainTag}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := &postgresOptions{}
+			opt.backupOptions.RetentionPolicy = tt.policy
+			if got := hasRetentionPolicy(tt.policy); got != tt.applied {
+				t.Errorf("hasRetentionPolicy() = %t, want %t", got, tt.applied)
+			}
+			if err := opt.ensureChainRetention(); (err != nil) != tt.wantErr {
+				t.Errorf("ensureChainRetention() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
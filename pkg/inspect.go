@@ -0,0 +1,457 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	InspectDumpCMD = "inspect-dump"
+
+	// pg_dump and pg_dumpall end a dump with these comments, a dump missing them has been cut short
+	dumpCompleteTrailer        = "-- PostgreSQL database dump complete"
+	clusterDumpCompleteTrailer = "-- PostgreSQL database cluster dump complete"
+	clusterDumpHeader          = "-- PostgreSQL database cluster dump"
+)
+
+// dumpContents describes what a dump holds, as found by a dry run of the restore.
+type dumpContents struct {
+	// Snapshot indicates the snapshot the dump has been read from
+	Snapshot string `json:"snapshot,omitempty"`
+	// Size indicates the size of the dump recorded at backup, or the size of its snapshot if it has not been recorded,
+	// which is known before the dump is read
+	Size uint64 `json:"size,omitempty"`
+	// Bytes indicates the number of bytes that have been read out of the snapshot
+	Bytes int64 `json:"bytes"`
+	// Complete indicates whether a plain dump ends with the completion trailer of pg_dump or pg_dumpall.
+	// The archives do not have a trailer, so it is not set for them.
+	Complete *bool `json:"complete,omitempty"`
+	// Roles shows the roles created by the dump
+	Roles []string `json:"roles,omitempty"`
+	// Databases shows the objects of each database of the dump. The name of the database is
+	// empty if the dump has been taken without --create.
+	Databases []databaseContents `json:"databases,omitempty"`
+}
+
+type databaseContents struct {
+	Name       string   `json:"name,omitempty"`
+	Schemas    []string `json:"schemas,omitempty"`
+	Tables     []string `json:"tables,omitempty"`
+	Extensions []string `json:"extensions,omitempty"`
+	// Rows shows the number of rows in the data of each table of a plain dump
+	Rows map[string]int64 `json:"rows,omitempty"`
+}
+
+// dumpInspector collects the contents of a dump out of its statements or out of the entries of its archive.
+type dumpInspector struct {
+	contents dumpContents
+	roles    map[string]bool
+	// databases are indexed by name, current is the database the current part of the dump belongs to
+	databases map[string]*databaseObjects
+	order     []string
+	current   *databaseObjects
+}
+
+type databaseObjects struct {
+	schemas, tables, extensions map[string]bool
+	rows                        map[string]int64
+}
+
+func newDumpInspector() *dumpInspector {
+	return &dumpInspector{
+		roles:     make(map[string]bool),
+		databases: make(map[string]*databaseObjects),
+	}
+}
+
+// enterDatabase makes the given database the one the following objects belong to.
+func (in *dumpInspector) enterDatabase(name string) {
+	db, ok := in.databases[name]
+	if !ok {
+		db = &databaseObjects{
+			schemas:    make(map[string]bool),
+			tables:     make(map[string]bool),
+			extensions: make(map[string]bool),
+			rows:       make(map[string]int64),
+		}
+		in.databases[name] = db
+		in.order = append(in.order, name)
+	}
+	in.current = db
+}
+
+// addEntry records the object described by an entry of the dump.
+func (in *dumpInspector) addEntry(e tocEntry) {
+	switch e.desc {
+	case "DATABASE":
+		// the entry of an archive holding its CREATE DATABASE, its schema is "-"
+		if in.current == nil || (len(in.order) == 1 && in.order[0] == "") {
+			in.renameUnnamed(e.name)
+		}
+		return
+	case "SCHEMA", "TABLE", "FOREIGN TABLE", "EXTENSION":
+	default:
+		return
+	}
+	if in.current == nil {
+		in.enterDatabase("")
+	}
+	switch e.desc {
+	case "SCHEMA":
+		in.current.schemas[e.name] = true
+	case "TABLE", "FOREIGN TABLE":
+		in.current.schemas[e.schema] = true
+		in.current.tables[e.schema+"."+e.name] = true
+	case "EXTENSION":
+		in.current.extensions[e.name] = true
+	}
+}
+
+// renameUnnamed names the database whose name has not been known yet.
+func (in *dumpInspector) renameUnnamed(name string) {
+	if db, ok := in.databases[""]; ok {
+		delete(in.databases, "")
+		in.databases[name] = db
+		in.order[0] = name
+		return
+	}
+	in.enterDatabase(name)
+}
+
+// inspectSQL collects the contents of a plain dump.
+func (in *dumpInspector) inspectSQL(r io.Reader) error {
+	s := newSQLScanner(r)
+	var (
+		expectedTrailer = dumpCompleteTrailer
+		complete        bool
+		// copyTable is the table the following COPY data belongs to
+		copyTable string
+		// copyLineEnd indicates whether the next chunk is the end of the line of the COPY statement, which is not a row
+		copyLineEnd bool
+	)
+	for {
+		chunk, err := s.next()
+		if err == io.EOF {
+			in.contents.Complete = &complete
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch chunk.kind {
+		case sqlChunkOther:
+			line := string(bytes.TrimSpace(chunk.text))
+			if line == "" {
+				continue
+			}
+			if line == clusterDumpHeader {
+				expectedTrailer = clusterDumpCompleteTrailer
+			}
+			if line == expectedTrailer {
+				complete = true
+				continue
+			}
+			if database, ok := databaseDumpMarker(chunk.text); ok {
+				in.enterDatabase(database)
+			}
+			if e, ok := parseEntryMarker(chunk.text); ok {
+				in.addEntry(e)
+			}
+			continue
+		case sqlChunkMeta:
+			if database, ok := connectTarget(chunk.text); ok {
+				in.enterDatabase(database)
+			}
+			if isUnrestrictMeta(string(bytes.TrimSpace(chunk.text))) {
+				// pg_dump ends the restricted mode of psql after the trailer
+				continue
+			}
+		case sqlChunkStatement:
+			tokens := tokenizeSQL(chunk.text)
+			if database := createDatabaseTarget(tokens); database != "" {
+				if len(in.order) == 1 && in.order[0] == "" {
+					// pg_dump --create writes CREATE DATABASE after the settings of the session
+					in.renameUnnamed(database)
+				} else {
+					in.enterDatabase(database)
+				}
+			}
+			if len(tokens) >= 3 && tokens[0].is("create") && (tokens[1].is("role") || tokens[1].is("user")) {
+				in.roles[tokens[2].identifier()] = true
+			}
+			if copyTable = ""; isCopyFromStdin(chunk.text) {
+				copyTable = copyTarget(tokens)
+				copyLineEnd = true
+			}
+		case sqlChunkCopyData:
+			if copyLineEnd {
+				copyLineEnd = false
+				continue
+			}
+			if copyTable != "" && string(bytes.TrimRight(chunk.text, "\r\n")) != `\.` {
+				if in.current == nil {
+					in.enterDatabase("")
+				}
+				in.current.rows[copyTable]++
+			}
+		}
+		// anything following the trailer means that the trailer is not the end of the dump
+		complete = false
+	}
+}
+
+// copyTarget returns the table ("<schema>.<table>") a COPY statement is about.
+func copyTarget(tokens []sqlToken) string {
+	if len(tokens) >= 4 && tokens[2].is(".") {
+		return tokens[1].identifier() + "." + tokens[3].identifier()
+	}
+	if len(tokens) >= 2 {
+		return "public." + tokens[1].identifier()
+	}
+	return ""
+}
+
+// inspectTOC collects the contents of an archive out of the list of its entries written by "pg_restore --list".
+func (in *dumpInspector) inspectTOC(toc string) {
+	for _, line := range strings.Split(toc, "\n") {
+		// the header of the list shows the name of the dumped database, i.e. ";     dbname: shop"
+		if name, ok := strings.CutPrefix(strings.TrimSpace(strings.TrimPrefix(line, ";")), "dbname: "); ok && strings.HasPrefix(line, ";") {
+			in.enterDatabase(strings.TrimSpace(name))
+			continue
+		}
+		if e, ok := parseTOCLine(line); ok {
+			in.addEntry(e)
+		}
+	}
+}
+
+// result returns the contents sorted by name, the databases are kept in the order of the dump.
+func (in *dumpInspector) result() dumpContents {
+	contents := in.contents
+	contents.Roles = sortedKeys(in.roles)
+	contents.Databases = nil
+	for _, name := range in.order {
+		db := in.databases[name]
+		contents.Databases = append(contents.Databases, databaseContents{
+			Name:       name,
+			Schemas:    sortedKeys(db.schemas),
+			Tables:     sortedKeys(db.tables),
+			Extensions: sortedKeys(db.extensions),
+		})
+		if len(db.rows) > 0 {
+			contents.Databases[len(contents.Databases)-1].Rows = db.rows
+		}
+	}
+	return contents
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	if len(m) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func NewCmdInspectDump() *cobra.Command {
+	var (
+		format      = DumpFormatPlain
+		reportFile  string
+		passthrough bool
+	)
+
+	cmd := &cobra.Command{
+		Use:               InspectDumpCMD,
+		Short:             "Inspects a dump read from the stdin",
+		Long:              `Inspects a dump read from the stdin and writes what it contains into a JSON file. It is used by restore-pg --dry-run as the last stage of the dump pipeline.`,
+		Hidden:            true,
+		DisableAutoGenTag: true,
+		SilenceUsage:      true,
+		Args:              cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			in := newDumpInspector()
+			counter := &countingReader{r: os.Stdin}
+			var (
+				r   io.Reader = counter
+				out           = bufio.NewWriterSize(os.Stdout, 1<<20)
+				err error
+			)
+			if passthrough {
+				// the dump is passed on to the next stage of the pipeline as it is read
+				r = io.TeeReader(counter, out)
+			}
+			switch format {
+			case DumpFormatPlain:
+				err = in.inspectSQL(r)
+			case DumpFormatCustom:
+				err = in.inspectCustomArchive(r)
+			case DumpFormatDir:
+				err = in.inspectDirArchive(r)
+			default:
+				err = fmt.Errorf("invalid dump format: expected %s, %s or %s, but instead got %s", DumpFormatPlain, DumpFormatCustom, DumpFormatDir, format)
+			}
+			if err != nil {
+				return err
+			}
+			if passthrough {
+				// the inspection may stop before the end of the dump, the next stage needs the whole dump
+				if _, err := io.Copy(io.Discard, r); err != nil {
+					return err
+				}
+				if err := out.Flush(); err != nil {
+					return err
+				}
+			}
+			in.contents.Bytes = counter.n
+			return writeOutput(reportFile, in.result())
+		},
+	}
+
+	cmd.Flags().StringVar(&format, "format", format, "Format of the dump (can only be plain, custom or directory)")
+	cmd.Flags().StringVar(&reportFile, "report", reportFile, "Path of the file where the contents of the dump will be written")
+	cmd.Flags().BoolVar(&passthrough, "passthrough", passthrough, "Specify whether to write the dump into the stdout, so that it can be restored while it is inspected")
+	return cmd
+}
+
+// inspectCustomArchive lists the entries of a custom format archive. The list is at the beginning of the archive,
+// so pg_restore reads it out of the stdin and exits. The rest of the archive is read to tell its size.
+func (in *dumpInspector) inspectCustomArchive(r io.Reader) error {
+	var toc, stderr bytes.Buffer
+	c := exec.Command(PgArchiveRestore, "--list")
+	c.Stdout, c.Stderr = &toc, io.MultiWriter(os.Stderr, &stderr)
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := c.Start(); err != nil {
+		return err
+	}
+	// the copy fails once pg_restore has read the list and closed its stdin
+	_, _ = io.Copy(stdin, r)
+	_ = stdin.Close()
+	if err := c.Wait(); err != nil {
+		return fmt.Errorf("failed to list the entries of the archive: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+	in.inspectTOC(toc.String())
+	return nil
+}
+
+// inspectDirArchive lists the entries of a directory format archive, which is stored as a tar archive.
+// pg_restore only needs the toc.dat file of the directory to list them.
+func (in *dumpInspector) inspectDirArchive(r io.Reader) error {
+	dir, err := os.MkdirTemp("", "inspect-dump-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	found := false
+	tr := tar.NewReader(bufio.NewReader(r))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if filepath.Clean(hdr.Name) != "toc.dat" {
+			continue
+		}
+		f, err := os.Create(filepath.Join(dir, "toc.dat"))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("the archive does not hold a toc.dat file")
+	}
+	toc, err := exec.Command(PgArchiveRestore, "--list", dir).Output()
+	if err != nil {
+		return fmt.Errorf("failed to list the entries of the archive: %w", err)
+	}
+	in.inspectTOC(string(toc))
+	return nil
+}
+
+// inspectDump streams the dump of the snapshot through the inspect-dump command, without connecting to the database.
+// The pipeline is: restic dump | stash-postgres inspect-dump --format=<format> --report=<file> .
+func (opt *postgresOptions) inspectDump(w *restic.ResticWrapper, snapshot *restic.Snapshot, dumpFormat string, size uint64) (*dumpContents, error) {
+	reportFile := filepath.Join(opt.setupOptions.ScratchDir, "dump-contents.json")
+	stage, err := reportStage(InspectDumpCMD, reportFile, fmt.Sprintf("--format=%s", dumpFormat))
+	if err != nil {
+		return nil, err
+	}
+	opt.dumpOptions.StdoutPipeCommands = append(opt.dumpOptions.StdoutPipeCommands, stage)
+	err = runPhase(&opt.restoreStats.Phases, "inspect", func() error {
+		_, err := w.DumpOnce(opt.dumpOptions)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var contents dumpContents
+	if err := readReport(reportFile, &contents); err != nil {
+		return nil, err
+	}
+	contents.Snapshot = snapshot.ID
+	contents.Size = size
+	return &contents, nil
+}
@@ -0,0 +1,250 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// databaseDump is a plain pg_dump dump of the database shop, taken without --create.
+const databaseDump = `--
+-- PostgreSQL database dump
+--
+
+\restrict Zm9vYmFy
+
+SET statement_timeout = 0;
+SELECT pg_catalog.set_config('search_path', '', false);
+
+--
+-- Name: sales; Type: SCHEMA; Schema: -; Owner: postgres
+--
+
+CREATE SCHEMA sales;
+
+--
+-- Name: pgcrypto; Type: EXTENSION; Schema: -; Owner: -
+--
+
+CREATE EXTENSION IF NOT EXISTS pgcrypto WITH SCHEMA public;
+
+--
+-- Name: orders; Type: TABLE; Schema: sales; Owner: postgres
+--
+
+CREATE TABLE sales.orders (
+    id integer NOT NULL,
+    note text DEFAULT 'COPY x FROM stdin;'
+);
+
+--
+-- Name: users; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.users (
+    id integer NOT NULL
+);
+
+--
+-- Data for Name: orders; Type: TABLE DATA; Schema: sales; Owner: postgres
+--
+
+COPY sales.orders (id, note) FROM stdin;
+1	first
+2	second
+3	\N
+\.
+
+
+--
+-- Data for Name: users; Type: TABLE DATA; Schema: public; Owner: postgres
+--
+
+COPY public.users (id) FROM stdin;
+\.
+
+
+--
+-- PostgreSQL database dump complete
+--
+
+\unrestrict Zm9vYmFy
+
+`
+
+// shopContents is what databaseDump holds.
+var shopContents = databaseContents{
+	Schemas:    []string{"public", "sales"},
+	Tables:     []string{"public.users", "sales.orders"},
+	Extensions: []string{"pgcrypto"},
+	Rows:       map[string]int64{"sales.orders": 3},
+}
+
+func TestDumpInspectorSQL(t *testing.T) {
+	named := shopContents
+	named.Name = "shop"
+
+	tests := []struct {
+		name      string
+		dump      string
+		complete  bool
+		roles     []string
+		databases []databaseContents
+	}{
+		{
+			name:      "database dump",
+			dump:      databaseDump,
+			complete:  true,
+			databases: []databaseContents{shopContents},
+		},
+		{
+			name: "database dump taken with --create",
+			dump: strings.Replace(databaseDump, "--\n-- Name: sales;",
+				"--\n-- Name: shop; Type: DATABASE; Schema: -; Owner: postgres\n--\n\nCREATE DATABASE shop WITH TEMPLATE = template0;\n\n\\connect shop\n\n--\n-- Name: sales;", 1),
+			complete:  true,
+			databases: []databaseContents{named},
+		},
+		{
+			name:      "truncated database dump",
+			dump:      databaseDump[:strings.Index(databaseDump, "3\t\\N")],
+			databases: []databaseContents{{Schemas: shopContents.Schemas, Tables: shopContents.Tables, Extensions: shopContents.Extensions, Rows: map[string]int64{"sales.orders": 2}}},
+		},
+		{
+			name:      "statement after the trailer",
+			dump:      databaseDump + "DROP TABLE public.users;\n",
+			databases: []databaseContents{shopContents},
+		},
+		{
+			name:     "cluster dump",
+			dump:     clusterDump + "\n--\n-- PostgreSQL database cluster dump complete\n--\n\n",
+			complete: true,
+			roles:    []string{"app"},
+			databases: []databaseContents{
+				{Name: "app"},
+				{Name: "my db"},
+			},
+		},
+		{
+			name:      "cluster dump with the trailer of a database dump",
+			dump:      clusterDump + "\n--\n-- PostgreSQL database dump complete\n--\n\n",
+			roles:     []string{"app"},
+			databases: []databaseContents{{Name: "app"}, {Name: "my db"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := newDumpInspector()
+			if err := in.inspectSQL(strings.NewReader(tt.dump)); err != nil {
+				t.Fatalf("inspectSQL() error = %v", err)
+			}
+			got := in.result()
+			if got.Complete == nil || *got.Complete != tt.complete {
+				t.Errorf("Complete = %v, want %t", got.Complete, tt.complete)
+			}
+			if !reflect.DeepEqual(got.Roles, tt.roles) {
+				t.Errorf("Roles = %q, want %q", got.Roles, tt.roles)
+			}
+			if !reflect.DeepEqual(got.Databases, tt.databases) {
+				t.Errorf("Databases = %+v, want %+v", got.Databases, tt.databases)
+			}
+		})
+	}
+}
+
+// archiveTOC is the list of the entries of a custom format archive of the database shop, as written by "pg_restore --list".
+const archiveTOC = `;
+; Archive created at 2026-10-01 02:00:00 UTC
+;     dbname: shop
+;     TOC Entries: 9
+;     Compression: gzip
+;     Dump Version: 1.16-0
+;     Format: CUSTOM
+;
+;
+; Selected TOC Entries:
+;
+3386; 1262 16384 DATABASE - shop postgres
+6; 2615 16390 SCHEMA - sales postgres
+2; 3079 16391 EXTENSION - pgcrypto 
+3387; 0 0 COMMENT - EXTENSION pgcrypto 
+216; 1259 16429 TABLE sales orders postgres
+217; 1259 16440 TABLE public order items postgres
+218; 1259 16450 FOREIGN TABLE public remote_users postgres
+3380; 0 16429 TABLE DATA sales orders postgres
+3381; 0 16440 TABLE DATA public order items postgres
+`
+
+func TestDumpInspectorTOC(t *testing.T) {
+	tests := []struct {
+		name string
+		toc  string
+		want []databaseContents
+	}{
+		{
+			name: "archive",
+			toc:  archiveTOC,
+			want: []databaseContents{{
+				Name:       "shop",
+				Schemas:    []string{"public", "sales"},
+				Tables:     []string{"public.order items", "public.remote_users", "sales.orders"},
+				Extensions: []string{"pgcrypto"},
+			}},
+		},
+		{
+			name: "archive without a database name",
+			toc:  "216; 1259 16429 TABLE sales orders postgres\n",
+			want: []databaseContents{{Schemas: []string{"sales"}, Tables: []string{"sales.orders"}}},
+		},
+		{
+			name: "empty archive",
+			toc:  ";\n; Selected TOC Entries:\n;\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := newDumpInspector()
+			in.inspectTOC(tt.toc)
+			got := in.result()
+			if got.Complete != nil {
+				t.Errorf("Complete = %t, want none for an archive", *got.Complete)
+			}
+			if !reflect.DeepEqual(got.Databases, tt.want) {
+				t.Errorf("Databases = %+v, want %+v", got.Databases, tt.want)
+			}
+		})
+	}
+}
+
+func TestDumpInspectorCustomArchive(t *testing.T) {
+	// the stand-in of pg_restore reads the beginning of the archive, lists its entries and exits
+	withArchiveRestore(t, "#!/bin/sh\n[ \"$1\" = \"--list\" ] || exit 2\nhead -c 5 >/dev/null\ncat <<'TOC'\n"+archiveTOC+"TOC\n")
+	archive := customArchiveMagic + strings.Repeat("table data ", 16<<10)
+	counter := &countingReader{r: strings.NewReader(archive)}
+
+	in := newDumpInspector()
+	if err := in.inspectCustomArchive(counter); err != nil {
+		t.Fatalf("inspectCustomArchive() error = %v", err)
+	}
+	if counter.n != int64(len(archive)) {
+		t.Errorf("read %d bytes of the archive, want %d", counter.n, len(archive))
+	}
+	if got := in.result().Databases; len(got) != 1 || got[0].Name != "shop" || len(got[0].Tables) != 3 {
+		t.Errorf("Databases = %+v, want the database shop with 3 tables", got)
+	}
+}
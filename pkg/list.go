@@ -0,0 +1,197 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"github.com/spf13/cobra"
+	license "go.bytebuilders.dev/license-verifier/kubernetes"
+	"gomodules.xyz/flags"
+	shell "gomodules.xyz/go-sh"
+)
+
+const (
+	OutputTable = "table"
+	OutputJSON  = "json"
+)
+
+// snapshotListing describes a snapshot of the repository along with the metadata of the backup it has been taken by.
+type snapshotListing struct {
+	ID       string `json:"id"`
+	Time     string `json:"time"`
+	Hostname string `json:"hostname"`
+	// BackupCMD indicates the command the dump has been taken with, it is unknown for the dumps taken without a manifest
+	BackupCMD string `json:"backupCMD,omitempty"`
+	Format    string `json:"format"`
+	// Databases shows the databases held by the dump
+	Databases []string `json:"databases,omitempty"`
+	// Size indicates the size of the dump in bytes recorded in the manifest. The snapshots taken without a manifest
+	// and the base backups show the size of the snapshot as reported by restic instead.
+	Size          uint64 `json:"size"`
+	ServerVersion string `json:"serverVersion,omitempty"`
+}
+
+func NewCmdListSnapshots() *cobra.Command {
+	var (
+		masterURL      string
+		kubeconfigPath string
+		hostname       string
+		output         = OutputTable
+		opt            = postgresOptions{
+			setupOptions: restic.SetupOptions{
+				ScratchDir:  restic.DefaultScratchDir,
+				EnableCache: false,
+			},
+		}
+	)
+
+	cmd := &cobra.Command{
+		Use:               "list-snapshots",
+		Short:             "Lists the snapshots of the Postgres DB Backups in the repository",
+		Long:              `Lists the snapshots of the dumps and the base backups in the repository, along with the databases they hold and the version of the server they have been taken from. The archived WAL segments and the manifests of the backups are not listed.`,
+		DisableAutoGenTag: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags.EnsureRequiredFlags(cmd, "provider", "storage-secret-name", "storage-secret-namespace")
+			if output != OutputTable && output != OutputJSON {
+				return fmt.Errorf("invalid output: expected %s or %s, but instead got %s", OutputTable, OutputJSON, output)
+			}
+
+			err := opt.prepareClients(masterURL, kubeconfigPath)
+			if err != nil {
+				return err
+			}
+			listings, err := opt.listSnapshots(hostname)
+			if err != nil {
+				return err
+			}
+			if output == OutputJSON {
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				return enc.Encode(listings)
+			}
+			return writeSnapshotTable(cmd.OutOrStdout(), listings)
+		},
+	}
+
+	cmd.Flags().StringVar(&hostname, "hostname", hostname, "Name of the host to list the snapshots of, along with the snapshots of its per database backup (keep empty to list the snapshots of all the hosts)")
+	cmd.Flags().StringVar(&output, "output", output, "Output format (can only be table or json)")
+
+	cmd.Flags().StringVar(&masterURL, "master", masterURL, "The address of the Kubernetes API server (overrides any value in kubeconfig)")
+	cmd.Flags().StringVar(&kubeconfigPath, "kubeconfig", kubeconfigPath, "Path to kubeconfig file with authorization information (the master location is set by the master flag).")
+	addStorageFlags(cmd, &opt)
+	return cmd
+}
+
+// listSnapshots describes the snapshots of the host, or of all the hosts if no host is given.
+func (opt *postgresOptions) listSnapshots(hostname string) ([]snapshotListing, error) {
+	err := license.CheckLicenseEndpoint(opt.config, licenseApiService, SupportedProducts)
+	if err != nil {
+		return nil, err
+	}
+	sh := shell.NewSession()
+	w, err := opt.newResticWrapper(sh)
+	if err != nil {
+		return nil, err
+	}
+	all, err := w.ListSnapshots(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []restic.Snapshot
+	for _, s := range all {
+		if hostname != "" && s.Hostname != hostname && !strings.HasPrefix(s.Hostname, hostname+"/") {
+			continue
+		}
+		// the archived WAL segments and the manifests are stored under their own hosts
+		if strings.HasSuffix(s.Hostname, walHostname("")) || strings.HasSuffix(s.Hostname, manifestHostname("")) {
+			continue
+		}
+		snapshots = append(snapshots, s)
+	}
+	manifests, err := readManifestsFrom(w, all, snapshots)
+	if err != nil {
+		return nil, err
+	}
+
+	listings := make([]snapshotListing, 0, len(snapshots))
+	for i := range snapshots {
+		s := &snapshots[i]
+		manifest := manifests[s.ID]
+		listing := snapshotListing{
+			ID:       s.ID,
+			Time:     s.Time.Format(time.RFC3339),
+			Hostname: s.Hostname,
+			Format:   dumpFormatOf(s),
+			Size:     manifest.dumpBytes(s.ID),
+		}
+		if listing.Size == 0 {
+			if listing.Size, err = w.GetSnapshotSize(s.ID); err != nil {
+				return nil, err
+			}
+		}
+		database := perDatabaseDumpOf(s)
+		switch {
+		case listing.Format == DumpFormatPhysical:
+			listing.BackupCMD = PgBaseBackupCMD
+		case path.Base(dumpFileOf(s)) == PgGlobalsFile:
+			// the globals of a per database backup do not hold any database
+			listing.BackupCMD = PgDumpallCMD
+		case database != "":
+			listing.BackupCMD = PgDumpCMD
+			listing.Databases = []string{database}
+		case manifest != nil:
+			listing.BackupCMD = manifest.BackupCMD
+			for _, db := range manifest.Databases {
+				listing.Databases = append(listing.Databases, db.Name)
+			}
+		}
+		if manifest != nil {
+			listing.ServerVersion = manifest.ServerVersion
+		}
+		listings = append(listings, listing)
+	}
+	return listings, nil
+}
+
+func writeSnapshotTable(out io.Writer, listings []snapshotListing) error {
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "ID\tTIME\tHOSTNAME\tTYPE\tFORMAT\tDATABASES\tSIZE\tSERVER VERSION")
+	for _, l := range listings {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			shortID(l.ID), l.Time, l.Hostname, orUnknown(l.BackupCMD), l.Format,
+			orUnknown(strings.Join(l.Databases, ",")), formatBytes(float64(l.Size)), orUnknown(l.ServerVersion))
+	}
+	return tw.Flush()
+}
+
+// orUnknown shows the values that are not known for the snapshots taken without a manifest.
+func orUnknown(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
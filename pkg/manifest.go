@@ -0,0 +1,503 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ManifestFileName is the name of the file the manifest of a backup is stored as in the repository
+	ManifestFileName = "manifest.json"
+
+	currentLSNQuery      = "SELECT CASE WHEN pg_is_in_recovery() THEN pg_last_wal_replay_lsn() ELSE pg_current_wal_lsn() END"
+	databaseDetailsQuery = "SELECT datname, pg_database_size(datname), pg_encoding_to_char(encoding), datcollate, datctype FROM pg_database WHERE datallowconn AND NOT datistemplate ORDER BY datname"
+	extensionsQuery      = "SELECT extname, extversion FROM pg_extension ORDER BY extname"
+	// the primary key columns of the tables, in the order of the key
+	keyColumnsQuery = `SELECT json_build_object('table', n.nspname || '.' || c.relname, 'columns', json_agg(a.attname ORDER BY array_position(i.indkey::int2[], a.attnum))) FROM pg_index i JOIN pg_class c ON c.oid = i.indrelid JOIN pg_namespace n ON n.oid = c.relnamespace JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey) WHERE i.indisprimary GROUP BY n.nspname, c.relname`
+	// tableStatsBatchSize is the number of tables counted by a single query, which is passed to psql as an argument
+	tableStatsBatchSize = 100
+	// reltuples is -1 for a table that has never been vacuumed or analyzed
+	tableRowEstimatesQuery = `SELECT n.nspname || '.' || c.relname, c.reltuples::bigint FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace WHERE c.relkind IN ('r', 'p') AND n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg\_toast%' ORDER BY 1`
+)
+
+// backupManifest describes the server and the databases a backup has been taken from. It is stored in its own
+// snapshot next to the snapshots of the dumps, so that a dump can be reasoned about without replaying it.
+type backupManifest struct {
+	// BackupSession indicates the BackupSession the backup has been taken for
+	BackupSession string `json:"backupSession,omitempty"`
+	// Hostname indicates the host the backup has been taken for
+	Hostname string `json:"hostname"`
+	// Snapshots shows the snapshots of the dumps taken by the backup
+	Snapshots []manifestSnapshot `json:"snapshots,omitempty"`
+	// BackupCMD and Format indicate the command the dumps have been taken with and their format
+	BackupCMD string `json:"backupCMD"`
+	Format    string `json:"format"`
+	// CreateDatabase indicates whether the dumps create the databases they hold. A dump of pg_dump only creates
+	// its database if it has been taken with --create.
+	CreateDatabase bool `json:"createDatabase"`
+	// ServerVersion and DumpVersion indicate the versions of the server and of the dump command
+	ServerVersion string `json:"serverVersion"`
+	DumpVersion   string `json:"dumpVersion"`
+	// StartLSN and EndLSN indicate the WAL locations of the server before and after the dumps have been taken
+	StartLSN string `json:"startLSN"`
+	EndLSN   string `json:"endLSN,omitempty"`
+	// StartTime and EndTime indicate when the dumps have been started and completed
+	StartTime string             `json:"startTime"`
+	EndTime   string             `json:"endTime,omitempty"`
+	Databases []manifestDatabase `json:"databases,omitempty"`
+}
+
+type manifestSnapshot struct {
+	Hostname string `json:"hostname"`
+	Snapshot string `json:"snapshot"`
+	// SHA256 and Bytes indicate the checksum and the size of the dump, computed as it has been streamed into the repository
+	SHA256 string `json:"sha256,omitempty"`
+	Bytes  int64  `json:"bytes,omitempty"`
+}
+
+type manifestDatabase struct {
+	Name string `json:"name"`
+	// Size indicates the size of the database in bytes
+	Size       int64               `json:"size"`
+	Encoding   string              `json:"encoding"`
+	Collation  string              `json:"collation"`
+	CType      string              `json:"ctype"`
+	Extensions []manifestExtension `json:"extensions,omitempty"`
+	// Tables shows the tables of the database with their estimated number of rows, -1 if it is unknown
+	Tables []manifestTable `json:"tables,omitempty"`
+}
+
+type manifestExtension struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type manifestTable struct {
+	Name         string `json:"name"`
+	RowsEstimate int64  `json:"rowsEstimate"`
+	// Rows indicates the number of rows counted at backup, it is only counted with --table-stats
+	Rows *int64 `json:"rows,omitempty"`
+	// KeyColumns and Checksum indicate the primary key columns of the table and their aggregate checksum,
+	// which are only computed with --table-checksums
+	KeyColumns []string `json:"keyColumns,omitempty"`
+	Checksum   string   `json:"checksum,omitempty"`
+}
+
+// tableCount holds the number of rows of a table and the aggregate checksum of its key columns.
+type tableCount struct {
+	Table    string  `json:"table"`
+	Rows     int64   `json:"rows"`
+	Checksum *string `json:"checksum"`
+}
+
+// snapshot returns the description of the snapshot of a dump taken by the backup, nil if it is not one of them.
+func (m *backupManifest) snapshot(snapshotID string) *manifestSnapshot {
+	if m == nil {
+		return nil
+	}
+	for i := range m.Snapshots {
+		if m.Snapshots[i].Snapshot == snapshotID {
+			return &m.Snapshots[i]
+		}
+	}
+	return nil
+}
+
+// dumpBytes returns the size of the dump of a snapshot recorded at backup, 0 if it is unknown.
+func (m *backupManifest) dumpBytes(snapshotID string) uint64 {
+	if s := m.snapshot(snapshotID); s != nil && s.Bytes > 0 {
+		return uint64(s.Bytes)
+	}
+	return 0
+}
+
+// manifestHostname returns the hostname the manifests of the backups of a host are taken under.
+func manifestHostname(host string) string {
+	return host + "/pg_manifest"
+}
+
+// newBackupManifest describes the server and the databases that are going to be dumped. pg_dump dumps the database
+// given with --dbname, or the database named after the user, while pg_dumpall dumps all the databases.
+func (opt *postgresOptions) newBackupManifest(session *sessionWrapper, dumpCMD string) (*backupManifest, error) {
+	manifest := &backupManifest{
+		BackupSession: opt.backupSessionName,
+		Hostname:      opt.backupOptions.Host,
+		BackupCMD:     opt.backupCMD,
+		Format:        opt.dumpFormat,
+		StartTime:     time.Now().Format(time.RFC3339),
+	}
+	out, err := session.sh.Command(dumpCMD, "--version").Output()
+	if err != nil {
+		return nil, err
+	}
+	manifest.DumpVersion = strings.TrimSpace(string(out))
+	if manifest.ServerVersion, err = session.queryValue(DefaultPostgresDB, "SHOW server_version"); err != nil {
+		return nil, err
+	}
+	if manifest.StartLSN, err = session.queryValue(DefaultPostgresDB, currentLSNQuery); err != nil {
+		return nil, err
+	}
+
+	var dumped string
+	manifest.CreateDatabase = true
+	if dumpCMD == PgDumpCMD && !opt.perDatabase {
+		if dumped = databaseFromArgs(opt.pgArgs); dumped == "" {
+			dumped = session.user
+		}
+		manifest.CreateDatabase = createFromArgs(opt.pgArgs)
+	}
+	rows, err := session.executeQuery(DefaultPostgresDB, databaseDetailsQuery)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		fields := strings.Split(row, "|")
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("unexpected row %q of the database details", row)
+		}
+		if dumped != "" && fields[0] != dumped {
+			continue
+		}
+		database := manifestDatabase{Name: fields[0], Encoding: fields[2], Collation: fields[3], CType: fields[4]}
+		if database.Size, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return nil, err
+		}
+		if err := session.describeDatabase(&database); err != nil {
+			return nil, err
+		}
+		manifest.Databases = append(manifest.Databases, database)
+	}
+	return manifest, nil
+}
+
+// describeDatabase adds the extensions and the tables of the database to its description.
+func (session *sessionWrapper) describeDatabase(database *manifestDatabase) error {
+	rows, err := session.executeQuery(database.Name, extensionsQuery)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		name, version, _ := strings.Cut(row, "|")
+		database.Extensions = append(database.Extensions, manifestExtension{Name: name, Version: version})
+	}
+	rows, err = session.executeQuery(database.Name, tableRowEstimatesQuery)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		i := strings.LastIndex(row, "|")
+		if i < 0 {
+			return fmt.Errorf("unexpected row %q of the table estimates", row)
+		}
+		estimate, err := strconv.ParseInt(row[i+1:], 10, 64)
+		if err != nil {
+			return err
+		}
+		database.Tables = append(database.Tables, manifestTable{Name: row[:i], RowsEstimate: estimate})
+	}
+	return nil
+}
+
+// captureTableStats counts the rows of the tables of the manifest, along with the checksums of their key columns
+// if requested. The rows of a database are counted in its exported snapshot, if it has one, so that they are
+// counted as they have been dumped. Otherwise, the writes during the backup make the counts differ from the dump.
+func (opt *postgresOptions) captureTableStats(session *sessionWrapper, manifest *backupManifest) error {
+	if !opt.tableStats && !opt.tableChecksums {
+		return nil
+	}
+	for i := range manifest.Databases {
+		database := &manifest.Databases[i]
+		snapshotID := ""
+		for _, s := range opt.backupStats.ExportedSnapshots {
+			if s.Database == database.Name {
+				snapshotID = s.SnapshotID
+			}
+		}
+		if opt.tableChecksums {
+			rows, err := session.executeQuery(database.Name, keyColumnsQuery)
+			if err != nil {
+				return err
+			}
+			keyColumns := make(map[string][]string)
+			for _, row := range rows {
+				var key struct {
+					Table   string   `json:"table"`
+					Columns []string `json:"columns"`
+				}
+				if err := json.Unmarshal([]byte(row), &key); err != nil {
+					return fmt.Errorf("unexpected row %q of the key columns: %v", row, err)
+				}
+				keyColumns[key.Table] = key.Columns
+			}
+			for j := range database.Tables {
+				database.Tables[j].KeyColumns = keyColumns[database.Tables[j].Name]
+			}
+		}
+		stats, err := session.tableStats(database.Name, snapshotID, database.Tables)
+		if err != nil {
+			return err
+		}
+		for j := range database.Tables {
+			table := &database.Tables[j]
+			if s, ok := stats[table.Name]; ok {
+				table.Rows = &s.Rows
+				if s.Checksum != nil {
+					table.Checksum = *s.Checksum
+				}
+			}
+		}
+		klog.Infof("Counted the rows of %d tables of database %s", len(stats), database.Name)
+	}
+	return nil
+}
+
+// tableStats counts the rows of the tables, and computes the aggregate checksums of their key columns. The checksum
+// is the sum of the first 60 bits of the MD5 of the key of each row, so it does not depend on the order of the rows.
+func (session *sessionWrapper) tableStats(database, snapshotID string, tables []manifestTable) (map[string]tableCount, error) {
+	stats := make(map[string]tableCount, len(tables))
+	for _, query := range tableStatsQueries(tables) {
+		rows, err := session.executeQueryInSnapshot(database, snapshotID, query)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			var s tableCount
+			if err := json.Unmarshal([]byte(row), &s); err != nil {
+				return nil, fmt.Errorf("unexpected row %q of the table stats: %v", row, err)
+			}
+			stats[s.Table] = s
+		}
+	}
+	return stats, nil
+}
+
+// tableStatsQueries returns the queries counting the rows of the tables, each one counting a batch of tables.
+func tableStatsQueries(tables []manifestTable) []string {
+	var batches []string
+	for start := 0; start < len(tables); start += tableStatsBatchSize {
+		var queries []string
+		for _, table := range tables[start:min(start+tableStatsBatchSize, len(tables))] {
+			schema, name, _ := strings.Cut(table.Name, ".")
+			checksum := "NULL::text"
+			if len(table.KeyColumns) > 0 {
+				columns := make([]string, 0, len(table.KeyColumns))
+				for _, column := range table.KeyColumns {
+					columns = append(columns, quoteIdentifier(column))
+				}
+				checksum = fmt.Sprintf("coalesce(sum(('x' || substr(md5(ROW(%s)::text), 1, 15))::bit(60)::bigint), 0)::text", strings.Join(columns, ", "))
+			}
+			queries = append(queries, fmt.Sprintf("SELECT json_build_object('table', %s, 'rows', count(*), 'checksum', %s) FROM %s.%s",
+				quoteLiteral(table.Name), checksum, quoteIdentifier(schema), quoteIdentifier(name)))
+		}
+		batches = append(batches, strings.Join(queries, " UNION ALL "))
+	}
+	return batches
+}
+
+// executeQueryInSnapshot runs the query in a transaction that imports an exported snapshot, so that it sees the
+// database at the same point in time as the dumps. The query is run as it is if there is no snapshot.
+func (session *sessionWrapper) executeQueryInSnapshot(database, snapshotID, query string) ([]string, error) {
+	if snapshotID == "" {
+		return session.executeQuery(database, query)
+	}
+	args := append(session.newArgs(),
+		"--no-psqlrc",
+		"--tuples-only",
+		"--no-align",
+		"--quiet",
+		"--set=ON_ERROR_STOP=1",
+		fmt.Sprintf("--dbname=%s", database),
+		"--command=BEGIN ISOLATION LEVEL REPEATABLE READ READ ONLY",
+		fmt.Sprintf("--command=SET TRANSACTION SNAPSHOT %s", quoteLiteral(snapshotID)),
+		fmt.Sprintf("--command=%s", query),
+		"--command=COMMIT",
+	)
+	out, err := session.sh.Command(PgRestoreCMD, args...).Output()
+	if err != nil {
+		return nil, err
+	}
+	return queryRows(out), nil
+}
+
+// queryValue runs a query returning a single value.
+func (session *sessionWrapper) queryValue(database, query string) (string, error) {
+	rows, err := session.executeQuery(database, query)
+	if err != nil {
+		return "", err
+	}
+	if len(rows) != 1 {
+		return "", fmt.Errorf("query %q returned %d rows instead of one", query, len(rows))
+	}
+	return rows[0], nil
+}
+
+// backupManifest completes the manifest with the snapshots that have been taken, then stores it.
+func (opt *postgresOptions) backupManifest(w *restic.ResticWrapper, session *sessionWrapper, manifest *backupManifest, backupOutput *restic.BackupOutput) error {
+	var err error
+	manifest.EndTime = time.Now().Format(time.RFC3339)
+	if manifest.EndLSN, err = session.queryValue(DefaultPostgresDB, currentLSNQuery); err != nil {
+		return err
+	}
+	for _, hostStats := range backupOutput.BackupTargetStatus.Stats {
+		for _, s := range hostStats.Snapshots {
+			manifest.Snapshots = append(manifest.Snapshots, manifestSnapshot{
+				Hostname: hostStats.Hostname,
+				Snapshot: s.Name,
+				SHA256:   opt.dumpChecksums[hostStats.Hostname].SHA256,
+				Bytes:    opt.dumpChecksums[hostStats.Hostname].Bytes,
+			})
+		}
+	}
+	return opt.storeManifest(w, manifest)
+}
+
+// storeManifest stores the manifest in its own snapshot of the manifest host, once the dumps it lists have been
+// taken. The manifest is found from the snapshots of the dumps by its host, its time and the snapshots it lists.
+func (opt *postgresOptions) storeManifest(w *restic.ResticWrapper, manifest *backupManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	manifestPath := filepath.Join(opt.setupOptions.ScratchDir, ManifestFileName)
+	if err := os.WriteFile(manifestPath, data, 0o644); err != nil {
+		return err
+	}
+	defer os.Remove(manifestPath)
+
+	// The manifest should be stored by the following pipeline: cat <manifest path> | restic backup --stdin .
+	out, err := w.RunBackup(restic.BackupOptions{
+		Host:          manifestHostname(opt.backupOptions.Host),
+		StdinFileName: ManifestFileName,
+		StdinPipeCommands: []restic.Command{
+			{Name: "cat", Args: []any{manifestPath}},
+		},
+		RetentionPolicy: opt.backupOptions.RetentionPolicy,
+	}, api_v1beta1.TargetRef{})
+	if err != nil {
+		return fmt.Errorf("failed to store the manifest of the backup: %w", err)
+	}
+	for _, hostStats := range out.BackupTargetStatus.Stats {
+		for _, s := range hostStats.Snapshots {
+			opt.backupStats.Manifest = s.Name
+		}
+	}
+	klog.Infof("Stored the manifest of the backup in snapshot %s", opt.backupStats.Manifest)
+	return nil
+}
+
+// readBackupManifest returns the manifest of the backup a snapshot has been taken by, nil if there is none
+// (i.e. the snapshot has been taken before the manifests have been introduced).
+func readBackupManifest(w *restic.ResticWrapper, snapshot *restic.Snapshot) (*backupManifest, error) {
+	manifests, err := readBackupManifests(w, []restic.Snapshot{*snapshot})
+	if err != nil {
+		return nil, err
+	}
+	return manifests[snapshot.ID], nil
+}
+
+// readBackupManifests returns the manifests of the backups the snapshots have been taken by, keyed by the IDs of
+// the snapshots. The snapshots of a per database backup share a manifest, which is read once.
+func readBackupManifests(w *restic.ResticWrapper, snapshots []restic.Snapshot) (map[string]*backupManifest, error) {
+	all, err := w.ListSnapshots(nil)
+	if err != nil {
+		return nil, err
+	}
+	return readManifestsFrom(w, all, snapshots)
+}
+
+// readManifestsFrom works like readBackupManifests, looking for the manifests among the snapshots already listed.
+func readManifestsFrom(w *restic.ResticWrapper, all, snapshots []restic.Snapshot) (map[string]*backupManifest, error) {
+	return findManifests(all, snapshots, manifestReader(w))
+}
+
+// manifestReader returns the function reading the manifest stored in a snapshot of a manifest host.
+func manifestReader(w *restic.ResticWrapper) func(stored *restic.Snapshot) (*backupManifest, error) {
+	return func(stored *restic.Snapshot) (*backupManifest, error) {
+		out, err := w.DumpOnce(restic.DumpOptions{
+			Snapshot: stored.ID,
+			FileName: ManifestFileName,
+		})
+		if err != nil {
+			return nil, err
+		}
+		var manifest backupManifest
+		if err := json.Unmarshal(out, &manifest); err != nil {
+			return nil, fmt.Errorf("failed to parse the manifest stored in snapshot %s: %v", shortID(stored.ID), err)
+		}
+		return &manifest, nil
+	}
+}
+
+// findManifests matches the snapshots with the manifests of the backups they have been taken by. A backup stores its
+// manifest once its dumps have been taken, so the manifest of a dump is the first one stored after it, under the
+// manifest host of its own host or of the host of its per database backup. The manifest must list the snapshot of
+// the dump, otherwise the backup has not stored one. Each manifest is read once.
+func findManifests(all, snapshots []restic.Snapshot, readStored func(stored *restic.Snapshot) (*backupManifest, error)) (map[string]*backupManifest, error) {
+	var stored []*restic.Snapshot
+	for i := range all {
+		if strings.HasSuffix(all[i].Hostname, manifestHostname("")) {
+			stored = append(stored, &all[i])
+		}
+	}
+	sort.SliceStable(stored, func(i, j int) bool { return stored[i].Time.Before(stored[j].Time) })
+
+	var (
+		read      = make(map[string]*backupManifest)
+		manifests = make(map[string]*backupManifest)
+	)
+	for _, s := range snapshots {
+		hosts := []string{s.Hostname}
+		if i := strings.LastIndex(s.Hostname, "/"); i > 0 {
+			hosts = append(hosts, s.Hostname[:i])
+		}
+		for _, host := range hosts {
+			i := slices.IndexFunc(stored, func(m *restic.Snapshot) bool {
+				return m.Hostname == manifestHostname(host) && !m.Time.Before(s.Time)
+			})
+			if i < 0 {
+				continue
+			}
+			manifest, ok := read[stored[i].ID]
+			if !ok {
+				var err error
+				if manifest, err = readStored(stored[i]); err != nil {
+					return nil, err
+				}
+				read[stored[i].ID] = manifest
+			}
+			if manifest.snapshot(s.ID) != nil {
+				manifests[s.ID] = manifest
+				break
+			}
+		}
+	}
+	return manifests, nil
+}
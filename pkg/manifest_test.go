@@ -0,0 +1,211 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	core "k8s.io/api/core/v1"
+	storage "kmodules.xyz/objectstore-api/api/v1"
+)
+
+// newTestRepository initializes a local repository for the tests that run restic, which are skipped without it.
+func newTestRepository(t *testing.T, host string) (*postgresOptions, *restic.ResticWrapper) {
+	t.Helper()
+	if _, err := os.Stat(restic.ResticCMD); err != nil {
+		t.Skipf("restic is not installed at %s", restic.ResticCMD)
+	}
+	dir := t.TempDir()
+	opt := &postgresOptions{
+		setupOptions: restic.SetupOptions{
+			Provider:      storage.ProviderLocal,
+			Bucket:        filepath.Join(dir, "repository"),
+			ScratchDir:    filepath.Join(dir, "scratch"),
+			StorageSecret: &core.Secret{Data: map[string][]byte{restic.RESTIC_PASSWORD: []byte("password")}},
+		},
+		backupOptions: restic.BackupOptions{Host: host},
+		dumpChecksums: make(map[string]streamChecksum),
+	}
+	if err := os.MkdirAll(opt.setupOptions.ScratchDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	w, err := restic.NewResticWrapper(opt.setupOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.InitializeRepository(); err != nil {
+		t.Fatalf("failed to initialize the repository: %v", err)
+	}
+	return opt, w
+}
+
+// backupTestDump stores the content as the dump of the host, the same way as a dump is streamed into the repository.
+func backupTestDump(t *testing.T, w *restic.ResticWrapper, host, fileName, content string) restic.Snapshot {
+	t.Helper()
+	out, err := w.RunBackup(restic.BackupOptions{
+		Host:              host,
+		StdinFileName:     fileName,
+		StdinPipeCommands: []restic.Command{{Name: "echo", Args: []any{content}}},
+	}, api_v1beta1.TargetRef{})
+	if err != nil {
+		t.Fatalf("failed to back up the dump of host %s: %v", host, err)
+	}
+	snapshots, err := w.ListSnapshots([]string{out.BackupTargetStatus.Stats[0].Snapshots[0].Name})
+	if err != nil || len(snapshots) != 1 {
+		t.Fatalf("failed to list the snapshot of the dump of host %s: %v", host, err)
+	}
+	return snapshots[0]
+}
+
+func TestStoredManifestReadBack(t *testing.T) {
+	opt, w := newTestRepository(t, "pg")
+	globals := backupTestDump(t, w, "pg", PgGlobalsFile, "CREATE ROLE app;")
+	app := backupTestDump(t, w, databaseHostname("pg", "app"), PgDumpFile, "CREATE TABLE t ();")
+	stored := &backupManifest{
+		Hostname:  "pg",
+		BackupCMD: PgDumpCMD,
+		Format:    DumpFormatPlain,
+		Snapshots: []manifestSnapshot{
+			{Hostname: "pg", Snapshot: globals.ID, SHA256: "1234", Bytes: 17},
+			{Hostname: databaseHostname("pg", "app"), Snapshot: app.ID, SHA256: "5678", Bytes: 18},
+		},
+		Databases: []manifestDatabase{{Name: "app"}},
+	}
+	if err := opt.storeManifest(w, stored); err != nil {
+		t.Fatalf("failed to store the manifest: %v", err)
+	}
+	// the backup after has failed to store its manifest
+	orphan := backupTestDump(t, w, "pg", PgGlobalsFile, "CREATE ROLE shop;")
+
+	manifests, err := readBackupManifests(w, []restic.Snapshot{globals, app, orphan})
+	if err != nil {
+		t.Fatalf("failed to read the manifests: %v", err)
+	}
+	for _, s := range []restic.Snapshot{globals, app} {
+		if !reflect.DeepEqual(manifests[s.ID], stored) {
+			t.Errorf("manifest of snapshot %s = %+v, want %+v", shortID(s.ID), manifests[s.ID], stored)
+		}
+	}
+	if m, ok := manifests[orphan.ID]; ok {
+		t.Errorf("snapshot %s of a backup without manifest has been matched with %+v", shortID(orphan.ID), m)
+	}
+	if got := manifests[app.ID].dumpBytes(app.ID); got != 18 {
+		t.Errorf("dumpBytes() = %d, want 18", got)
+	}
+}
+
+func TestFindManifests(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	snapshot := func(id, host string, minute int) restic.Snapshot {
+		return restic.Snapshot{ID: id, Hostname: host, Time: start.Add(time.Duration(minute) * time.Minute)}
+	}
+	manifest := func(ids ...string) *backupManifest {
+		m := &backupManifest{}
+		for _, id := range ids {
+			m.Snapshots = append(m.Snapshots, manifestSnapshot{Snapshot: id})
+		}
+		return m
+	}
+	all := []restic.Snapshot{
+		snapshot("cluster-1", "cluster", 0),
+		snapshot("cluster-m1", manifestHostname("cluster"), 1),
+		// the second backup of the cluster has failed to store its manifest
+		snapshot("cluster-2", "cluster", 10),
+		snapshot("cluster-3", "cluster", 20),
+		snapshot("cluster-m3", manifestHostname("cluster"), 21),
+		snapshot("globals", "pg", 0),
+		snapshot("app", databaseHostname("pg", "app"), 0),
+		snapshot("shop", databaseHostname("pg", "shop"), 1),
+		snapshot("pg-m", manifestHostname("pg"), 2),
+		snapshot("other-m", manifestHostname("other"), 1),
+	}
+	stored := map[string]*backupManifest{
+		"cluster-m1": manifest("cluster-1"),
+		"cluster-m3": manifest("cluster-3"),
+		"pg-m":       manifest("globals", "app", "shop"),
+		"other-m":    manifest("cluster-2"),
+	}
+
+	tests := []struct {
+		name      string
+		snapshots []string
+		// want maps the snapshots to the snapshots of their manifests
+		want map[string]string
+		// reads are the manifests expected to be read, each one once
+		reads []string
+	}{
+		{
+			name:      "whole cluster dumps",
+			snapshots: []string{"cluster-1", "cluster-3"},
+			want:      map[string]string{"cluster-1": "cluster-m1", "cluster-3": "cluster-m3"},
+			reads:     []string{"cluster-m1", "cluster-m3"},
+		},
+		{
+			name:      "backup without manifest",
+			snapshots: []string{"cluster-2"},
+			want:      map[string]string{},
+			reads:     []string{"cluster-m3"},
+		},
+		{
+			name:      "per database backup",
+			snapshots: []string{"globals", "app", "shop"},
+			want:      map[string]string{"globals": "pg-m", "app": "pg-m", "shop": "pg-m"},
+			reads:     []string{"pg-m"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var snapshots []restic.Snapshot
+			for _, id := range tt.snapshots {
+				for _, s := range all {
+					if s.ID == id {
+						snapshots = append(snapshots, s)
+					}
+				}
+			}
+			var reads []string
+			manifests, err := findManifests(all, snapshots, func(s *restic.Snapshot) (*backupManifest, error) {
+				reads = append(reads, s.ID)
+				return stored[s.ID], nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]string)
+			for id, m := range manifests {
+				for storedID, s := range stored {
+					if m == s {
+						got[id] = storedID
+					}
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("findManifests() = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(reads, tt.reads) {
+				t.Errorf("read manifests %v, want %v", reads, tt.reads)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog/v2"
+)
+
+type snapshotRestoreStats struct {
+	// Snapshot indicates the restored snapshot
+	Snapshot string `json:"snapshot"`
+	// Hostname indicates the host the snapshot has been taken for
+	Hostname string `json:"hostname,omitempty"`
+	// Database indicates the database a snapshot of a per database backup holds
+	Database string `json:"database,omitempty"`
+	// Errors indicates the number of statements of the snapshot that have failed to restore
+	Errors int `json:"errors,omitempty"`
+	// FailedStatement describes the first statement of the snapshot that has failed to restore
+	FailedStatement *statementError `json:"failedStatement,omitempty"`
+	// Checksum indicates the SHA-256 of the restored dump, verified against the checksum taken at backup
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// multipleSnapshots indicates whether more than one snapshot has been requested to restore.
+func (opt *postgresOptions) multipleSnapshots() bool {
+	return len(opt.snapshots) > 1 || opt.snapshotsFrom != ""
+}
+
+// selectSnapshots returns the snapshots given with --snapshot, or the snapshots selected by --snapshots-from, taken
+// at or before the --as-of time if it has been given. The selector "host=<hostname>" selects the snapshots of the
+// latest backup of the host along with the snapshots of its per database backup.
+func (opt *postgresOptions) selectSnapshots(w *restic.ResticWrapper) ([]restic.Snapshot, error) {
+	if opt.snapshotsFrom == "" {
+		if opt.asOf != "" {
+			return nil, fmt.Errorf("--as-of can not be used along with --snapshot")
+		}
+		snapshots, err := w.ListSnapshots(opt.snapshots)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range opt.snapshots {
+			if !slices.ContainsFunc(snapshots, func(s restic.Snapshot) bool { return strings.HasPrefix(s.ID, id) }) {
+				return nil, fmt.Errorf("snapshot %s not found", id)
+			}
+		}
+		return snapshots, checkDistinctHosts(snapshots)
+	}
+
+	hostname, ok := strings.CutPrefix(opt.snapshotsFrom, "host=")
+	if !ok || hostname == "" {
+		return nil, fmt.Errorf("invalid snapshot selector %q: expected host=<hostname>", opt.snapshotsFrom)
+	}
+	asOf, err := opt.asOfTime()
+	if err != nil {
+		return nil, err
+	}
+	all, err := w.ListSnapshots(nil)
+	if err != nil {
+		return nil, err
+	}
+	return latestBackupRun(all, hostname, asOf, manifestReader(w))
+}
+
+// latestBackupRun returns the snapshots of the dumps taken by the latest backup of the host, so that the globals and
+// the databases of a per database backup are restored from the same run. The runs are told apart by the manifests
+// stored along with the dumps, which list their snapshots. A run whose dumps have been forgotten since is skipped.
+func latestBackupRun(all []restic.Snapshot, hostname string, asOf time.Time, readStored func(stored *restic.Snapshot) (*backupManifest, error)) ([]restic.Snapshot, error) {
+	byID := make(map[string]restic.Snapshot, len(all))
+	var stored []*restic.Snapshot
+	for i := range all {
+		byID[all[i].ID] = all[i]
+		if all[i].Hostname == manifestHostname(hostname) && (asOf.IsZero() || !all[i].Time.After(asOf)) {
+			stored = append(stored, &all[i])
+		}
+	}
+	// the newest run is looked at first
+	sort.SliceStable(stored, func(i, j int) bool { return stored[i].Time.After(stored[j].Time) })
+	for _, s := range stored {
+		manifest, err := readStored(s)
+		if err != nil {
+			return nil, err
+		}
+		var run []restic.Snapshot
+		for _, m := range manifest.Snapshots {
+			if dump, found := byID[m.Snapshot]; found {
+				run = append(run, dump)
+			}
+		}
+		if len(run) > 0 && len(run) == len(manifest.Snapshots) {
+			klog.Infof("Selected the backup of host %s stored along with manifest snapshot %s", hostname, shortID(s.ID))
+			return run, nil
+		}
+	}
+	return nil, fmt.Errorf("no backup of host %s with a manifest found, the snapshots to restore must be given with --snapshot", hostname)
+}
+
+// checkDistinctHosts makes sure that a single snapshot of each host is restored. The hosts tell the snapshots apart
+// in the output, and two snapshots of the same host would restore the same databases.
+func checkDistinctHosts(snapshots []restic.Snapshot) error {
+	hosts := make(map[string]string)
+	for _, s := range snapshots {
+		if other, ok := hosts[s.Hostname]; ok {
+			return fmt.Errorf("snapshots %s and %s have both been taken for host %s, only one snapshot of a host can be restored", shortID(other), shortID(s.ID), s.Hostname)
+		}
+		hosts[s.Hostname] = s.ID
+	}
+	return nil
+}
+
+// restoreSnapshots restores several snapshots in one run. The snapshots of a per database backup are restored
+// concurrently, each into its own database. The other snapshots (i.e. the globals or a whole cluster dump) may
+// depend on each other, so they are restored one by one in the order they have been taken, before the databases.
+func (opt *postgresOptions) restoreSnapshots(w *restic.ResticWrapper, session *sessionWrapper, targetRef api_v1beta1.TargetRef) (*restic.RestoreOutput, error) {
+	switch {
+	case opt.dryRun, opt.swap, opt.clean != "", opt.filter.targetDatabase != "", len(opt.filter.databases) > 0,
+		len(opt.filter.tables) > 0, len(opt.filter.schemas) > 0, opt.tableValidation:
+		return nil, fmt.Errorf("--dry-run, --swap, --clean, --target-database, --database, --table, --schema and --validate-tables can only be used to restore a single snapshot")
+	case opt.maxConcurrency < 1:
+		return nil, fmt.Errorf("invalid max concurrency %d: it must be at least 1", opt.maxConcurrency)
+	case opt.jobs != 1:
+		return nil, fmt.Errorf("parallel jobs are not supported when several snapshots are restored")
+	}
+
+	snapshots, err := opt.selectSnapshots(w)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool { return snapshots[i].Time.Before(snapshots[j].Time) })
+	opt.restoreStats.AsOf = opt.asOf
+	for i := range snapshots {
+		klog.Infof("Selected snapshot %s of host %s taken at %s", snapshots[i].ID, snapshots[i].Hostname, snapshots[i].Time.Format(time.RFC3339))
+		format := dumpFormatOf(&snapshots[i])
+		if format != DumpFormatPlain && format != DumpFormatCustom {
+			return nil, fmt.Errorf("snapshot %s holds a %s dump, only %s and %s dumps can be restored along with other snapshots", shortID(snapshots[i].ID), format, DumpFormatPlain, DumpFormatCustom)
+		}
+		if err := opt.validateErrorMode(&snapshots[i], format); err != nil {
+			return nil, err
+		}
+	}
+	opt.restoreStats.OnError = opt.onError
+	manifests, err := readBackupManifests(w, snapshots)
+	if err != nil {
+		return nil, err
+	}
+	checksums, err := dumpChecksums(manifests, snapshots)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := session.waitForDBReady(opt.waitTimeout); err != nil {
+		return nil, err
+	}
+
+	var (
+		ordered, concurrent []restic.DumpOptions
+		reportFiles         = make(map[string]string)
+		verifyChecksums     = make(map[string]func() error)
+	)
+	for i := range snapshots {
+		snapshot := &snapshots[i]
+		format := dumpFormatOf(snapshot)
+		database := perDatabaseDumpOf(snapshot)
+		stats := snapshotRestoreStats{Snapshot: snapshot.ID, Hostname: snapshot.Hostname, Database: database}
+		opt.restoreStats.Snapshots = append(opt.restoreStats.Snapshots, stats)
+
+		// pg_restore restores an archive into an existing database, a plain dump of a per database backup creates its database
+		restoreDB := DefaultPostgresDB
+		if format == DumpFormatCustom && database != "" {
+			if err := session.ensureDatabase(database); err != nil {
+				return nil, err
+			}
+			restoreDB = database
+		}
+		reportFile := filepath.Join(opt.setupOptions.ScratchDir, fmt.Sprintf("restore-errors-%d.json", i))
+		stages, err := opt.restoreStages(session, format, restoreDB, reportFile)
+		if err != nil {
+			return nil, err
+		}
+		reportFiles[snapshot.Hostname] = reportFile
+
+		dumpOptions := restic.DumpOptions{
+			Host:       snapshot.Hostname,
+			SourceHost: snapshot.Hostname,
+			Snapshot:   snapshot.ID,
+			FileName:   dumpFileOf(snapshot),
+		}
+		checksumFile := filepath.Join(opt.setupOptions.ScratchDir, fmt.Sprintf("restore-checksum-%d.json", i))
+		if verifyChecksums[snapshot.Hostname], err = addChecksumStage(&dumpOptions, checksums[snapshot.ID], checksumFile); err != nil {
+			return nil, err
+		}
+		dumpOptions.StdoutPipeCommands = append(dumpOptions.StdoutPipeCommands, stages...)
+		if database != "" {
+			concurrent = append(concurrent, dumpOptions)
+		} else {
+			ordered = append(ordered, dumpOptions)
+		}
+	}
+
+	restoreOutput := &restic.RestoreOutput{
+		RestoreTargetStatus: api_v1beta1.RestoreMemberStatus{
+			Ref: targetRef,
+		},
+	}
+	var restoreErr error
+	// a single dump restored at a time keeps the order of the snapshots
+	for _, group := range []struct {
+		dumpOptions    []restic.DumpOptions
+		maxConcurrency int
+	}{{ordered, 1}, {concurrent, opt.maxConcurrency}} {
+		if len(group.dumpOptions) == 0 {
+			continue
+		}
+		klog.Infof("Restoring %d snapshots with max concurrency %d", len(group.dumpOptions), group.maxConcurrency)
+		out, err := w.ParallelDump(group.dumpOptions, targetRef, group.maxConcurrency)
+		if out != nil {
+			restoreOutput.RestoreTargetStatus.Stats = append(restoreOutput.RestoreTargetStatus.Stats, out.RestoreTargetStatus.Stats...)
+		}
+		if err != nil {
+			// the databases may depend on the globals, so they are not restored after a failure
+			restoreErr = err
+			break
+		}
+	}
+
+	opt.restoreStats.Errors = 0
+	var first *statementError
+	for i := range opt.restoreStats.Snapshots {
+		stats := &opt.restoreStats.Snapshots[i]
+		report, err := readErrorReport(reportFiles[stats.Hostname])
+		if err != nil && restoreErr == nil {
+			return nil, err
+		}
+		stats.Errors, stats.FailedStatement = report.Errors, report.First
+		opt.restoreStats.Errors += report.Errors
+		// the failed statements of a restore that has kept going are described in the error of the restored host
+		for j := range restoreOutput.RestoreTargetStatus.Stats {
+			if hostStats := &restoreOutput.RestoreTargetStatus.Stats[j]; hostStats.Hostname == stats.Hostname && hostStats.Error == "" {
+				hostStats.Error = report.summary()
+			}
+		}
+		if first == nil {
+			first = report.First
+		}
+	}
+	opt.restoreStats.FailedStatement = first
+	if restoreErr != nil {
+		return nil, restoreErr
+	}
+	var errs []error
+	for i := range opt.restoreStats.Snapshots {
+		stats := &opt.restoreStats.Snapshots[i]
+		if err := verifyChecksums[stats.Hostname](); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		stats.Checksum = checksums[stats.Snapshot]
+	}
+	if len(errs) > 0 {
+		return nil, utilerrors.NewAggregate(errs)
+	}
+	return restoreOutput, nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+func TestLatestBackupRun(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minute int) time.Time { return start.Add(time.Duration(minute) * time.Minute) }
+	snapshot := func(id, host string, minute int) restic.Snapshot {
+		return restic.Snapshot{ID: id, Hostname: host, Time: at(minute)}
+	}
+	// the first run is complete, the dump of shop taken by the second run has been forgotten since
+	dumps := []restic.Snapshot{
+		snapshot("globals-1", "pg", 0),
+		snapshot("app-1", databaseHostname("pg", "app"), 0),
+		snapshot("shop-1", databaseHostname("pg", "shop"), 0),
+		snapshot("globals-2", "pg", 10),
+		snapshot("app-2", databaseHostname("pg", "app"), 10),
+		snapshot("globals-3", "pg", 20),
+		snapshot("app-3", databaseHostname("pg", "app"), 20),
+		snapshot("shop-3", databaseHostname("pg", "shop"), 20),
+	}
+	manifests := []restic.Snapshot{
+		snapshot("manifest-1", manifestHostname("pg"), 1),
+		snapshot("manifest-2", manifestHostname("pg"), 11),
+		snapshot("manifest-3", manifestHostname("pg"), 21),
+		snapshot("manifest-other", manifestHostname("other"), 30),
+	}
+	stored := map[string][]string{
+		"manifest-1":     {"globals-1", "app-1", "shop-1"},
+		"manifest-2":     {"globals-2", "app-2", "shop-2"},
+		"manifest-3":     {"globals-3", "app-3", "shop-3"},
+		"manifest-other": {"globals-1"},
+	}
+	read := func(s *restic.Snapshot) (*backupManifest, error) {
+		m := &backupManifest{}
+		for _, id := range stored[s.ID] {
+			m.Snapshots = append(m.Snapshots, manifestSnapshot{Snapshot: id})
+		}
+		return m, nil
+	}
+
+	tests := []struct {
+		name     string
+		hostname string
+		asOf     time.Time
+		want     []string
+		wantErr  string
+	}{
+		{
+			name:     "latest run",
+			hostname: "pg",
+			want:     []string{"globals-3", "app-3", "shop-3"},
+		},
+		{
+			name:     "run with a forgotten dump",
+			hostname: "pg",
+			asOf:     at(15),
+			want:     []string{"globals-1", "app-1", "shop-1"},
+		},
+		{
+			name:     "run completed after the as of time",
+			hostname: "pg",
+			asOf:     at(20),
+			want:     []string{"globals-1", "app-1", "shop-1"},
+		},
+		{
+			name:     "no run before the as of time",
+			hostname: "pg",
+			asOf:     at(0),
+			wantErr:  "no backup of host pg with a manifest found",
+		},
+		{
+			name:     "host without manifest",
+			hostname: "cluster",
+			wantErr:  "no backup of host cluster with a manifest found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run, err := latestBackupRun(append(append([]restic.Snapshot{}, dumps...), manifests...), tt.hostname, tt.asOf, read)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("latestBackupRun() error = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, s := range run {
+				got = append(got, s.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("latestBackupRun() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,317 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"github.com/spf13/cobra"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// OnErrorContinue reports the errors, but keeps restoring the rest of the dump
+	OnErrorContinue = "continue"
+	// OnErrorStop stops the restore at the first error
+	OnErrorStop = "stop"
+	// OnErrorSingleTransaction restores the dump in a single transaction, which is rolled back at the first error
+	OnErrorSingleTransaction = "single-transaction"
+
+	RunRestoreCMD = "run-restore"
+
+	// maxStatementLength limits the length of the failed statement kept in the report
+	maxStatementLength = 1024
+)
+
+var (
+	// i.e. "psql:<stdin>:42: ERROR:  42P07: relation "orders" already exists" with VERBOSITY=verbose
+	psqlErrorRegex     = regexp.MustCompile(`^psql:.*:(\d+): (?:ERROR|FATAL|PANIC):\s+(?:([0-9A-Z]{5}): )?(.*)$`)
+	psqlStatementRegex = regexp.MustCompile(`^psql:.*:\d+: STATEMENT:\s+(.*)$`)
+	// i.e. "pg_restore: from TOC entry 215; 1259 16386 TABLE orders postgres"
+	pgRestoreEntryRegex = regexp.MustCompile(`^pg_restore: from TOC entry (.*)$`)
+	// i.e. "pg_restore: error: COPY failed for table "orders": ERROR:  duplicate key value violates unique constraint"
+	pgRestoreErrorRegex     = regexp.MustCompile(`^pg_restore: error: (?:could not execute query|COPY failed for table ".*"): (?:ERROR|FATAL):\s+(?:([0-9A-Z]{5}): )?(.*)$`)
+	pgRestoreStatementRegex = regexp.MustCompile(`^Command was: (.*)$`)
+	// i.e. "pg_restore: warning: errors ignored on restore: 3", written when pg_restore exits with 1 after the restore
+	pgRestoreIgnoredRegex = regexp.MustCompile(`^pg_restore: warning: errors ignored on restore: \d+$`)
+	// the lines following an error that do not belong to the failed statement
+	errorDetailPrefixes = []string{"psql:", "pg_restore:", "LINE ", "DETAIL:", "HINT:", "LOCATION:", "CONTEXT:", "QUERY:", "WARNING:", "NOTICE:"}
+)
+
+// statementError describes a statement of the dump that has failed to restore.
+type statementError struct {
+	// Line indicates the line of the dump the statement ends at
+	Line int `json:"line,omitempty"`
+	// Entry indicates the archive entry the statement belongs to
+	Entry string `json:"entry,omitempty"`
+	// SQLState indicates the error code reported by the database
+	SQLState string `json:"sqlState,omitempty"`
+	// Message indicates the error message reported by the database
+	Message string `json:"message,omitempty"`
+	// Statement shows the failed statement
+	Statement string `json:"statement,omitempty"`
+}
+
+func (e *statementError) Error() string {
+	var b strings.Builder
+	b.WriteString("failed to restore statement")
+	if e.Line > 0 {
+		fmt.Fprintf(&b, " at line %d of the dump", e.Line)
+	}
+	if e.Entry != "" {
+		fmt.Fprintf(&b, " of archive entry %q", e.Entry)
+	}
+	if e.SQLState != "" {
+		fmt.Fprintf(&b, " (SQLSTATE %s)", e.SQLState)
+	}
+	fmt.Fprintf(&b, ": %s", e.Message)
+	if e.Statement != "" {
+		fmt.Fprintf(&b, ": %s", e.Statement)
+	}
+	return b.String()
+}
+
+// restoreErrorReport summarizes the errors reported by psql or pg_restore.
+type restoreErrorReport struct {
+	// Errors indicates the number of statements that have failed
+	Errors int `json:"errors"`
+	// First describes the first failed statement
+	First *statementError `json:"first,omitempty"`
+}
+
+// summary describes the failed statements of a restore that has kept going after them.
+func (r restoreErrorReport) summary() string {
+	if r.First == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d statements have failed, the first one: %s", r.Errors, r.First.Error())
+}
+
+// restoreErrorParser parses the errors written by psql or pg_restore into the stderr.
+type restoreErrorParser struct {
+	report restoreErrorReport
+	line   []byte
+	// entry is the archive entry pg_restore has been processing
+	entry string
+	// inStatement indicates whether the following lines continue the failed statement
+	inStatement bool
+	// ignored indicates whether pg_restore has kept going after the failed statements
+	ignored bool
+}
+
+func (p *restoreErrorParser) Write(data []byte) (int, error) {
+	for _, c := range data {
+		if c != '\n' {
+			p.line = append(p.line, c)
+			continue
+		}
+		p.parseLine(string(p.line))
+		p.line = p.line[:0]
+	}
+	return len(data), nil
+}
+
+// flush parses the last line, if it does not end with a newline.
+func (p *restoreErrorParser) flush() {
+	if len(p.line) > 0 {
+		p.parseLine(string(p.line))
+		p.line = nil
+	}
+}
+
+func (p *restoreErrorParser) parseLine(line string) {
+	first := p.report.First
+	if m := psqlErrorRegex.FindStringSubmatch(line); m != nil {
+		lineNo, _ := strconv.Atoi(m[1])
+		p.addError(&statementError{Line: lineNo, SQLState: m[2], Message: m[3]})
+		return
+	}
+	if m := pgRestoreEntryRegex.FindStringSubmatch(line); m != nil {
+		p.entry, p.inStatement = m[1], false
+		return
+	}
+	if m := pgRestoreErrorRegex.FindStringSubmatch(line); m != nil {
+		p.addError(&statementError{Entry: p.entry, SQLState: m[1], Message: m[2]})
+		return
+	}
+	if pgRestoreIgnoredRegex.MatchString(line) {
+		p.ignored, p.inStatement = true, false
+		return
+	}
+	m := psqlStatementRegex.FindStringSubmatch(line)
+	if m == nil {
+		m = pgRestoreStatementRegex.FindStringSubmatch(line)
+	}
+	if m != nil {
+		// only the statement of the first error is kept
+		p.inStatement = p.report.Errors == 1 && first != nil && first.Statement == ""
+		if p.inStatement {
+			first.Statement = m[1]
+		}
+		return
+	}
+	for _, prefix := range errorDetailPrefixes {
+		if strings.HasPrefix(line, prefix) {
+			p.inStatement = false
+			return
+		}
+	}
+	if p.inStatement && len(first.Statement) < maxStatementLength {
+		first.Statement += "\n" + line
+	}
+}
+
+func (p *restoreErrorParser) addError(e *statementError) {
+	p.report.Errors++
+	p.inStatement = false
+	if p.report.First == nil {
+		p.report.First = e
+	}
+}
+
+// outcome returns the error of the restore command. psql exits with 0 after the statements that have failed without
+// stopping the restore, while pg_restore exits with 1, so the exit of pg_restore is ignored as well. The failed
+// statements are reported by both of them the same way.
+func (p *restoreErrorParser) outcome(err error) error {
+	p.flush()
+	var exitErr *exec.ExitError
+	if p.ignored && errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return nil
+	}
+	return err
+}
+
+func (p *restoreErrorParser) result() restoreErrorReport {
+	p.flush()
+	if first := p.report.First; first != nil {
+		// pg_restore writes the empty lines following the statement in the dump
+		first.Statement = strings.TrimRight(first.Statement, "\n")
+		if len(first.Statement) > maxStatementLength {
+			first.Statement = first.Statement[:maxStatementLength] + "..."
+		}
+	}
+	return p.report
+}
+
+func NewCmdRunRestore() *cobra.Command {
+	var reportFile string
+
+	cmd := &cobra.Command{
+		Use:               RunRestoreCMD + " -- <command> [args...]",
+		Short:             "Runs psql or pg_restore and reports the statements that have failed",
+		Long:              `Runs psql or pg_restore and reports the statements that have failed into a JSON file. It is used by restore-pg as the last stage of the restore pipeline.`,
+		Hidden:            true,
+		DisableAutoGenTag: true,
+		SilenceUsage:      true,
+		Args:              cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			parser := &restoreErrorParser{}
+			c := exec.Command(args[0], args[1:]...)
+			c.Stdin, c.Stdout = os.Stdin, os.Stdout
+			c.Stderr = io.MultiWriter(os.Stderr, parser)
+			runErr := parser.outcome(c.Run())
+			if err := writeOutput(reportFile, parser.result()); err != nil {
+				return err
+			}
+			return runErr
+		},
+	}
+
+	cmd.Flags().StringVar(&reportFile, "report", reportFile, "Path of the file where the report will be written")
+	return cmd
+}
+
+// validateErrorMode checks the error mode before anything is changed in the database. CREATE DATABASE can not run
+// inside a transaction, so a dump creating databases can not be restored in a single transaction. A restore that
+// has kept going after failed statements leaves a partial staging database, so a swap always stops at the first error.
+func (opt *postgresOptions) validateErrorMode(snapshot *restic.Snapshot, dumpFormat string) error {
+	if _, err := opt.errorModeArgs(PgRestoreCMD); err != nil {
+		return err
+	}
+	if opt.swap && opt.onError == OnErrorContinue {
+		klog.Infof("The staging database of a swap is restored with error mode %s", OnErrorStop)
+		opt.onError = OnErrorStop
+	}
+	if opt.onError != OnErrorSingleTransaction {
+		return nil
+	}
+	if dumpFormat == DumpFormatPlain && (len(opt.filter.databases) > 0 || perDatabaseDumpOf(snapshot) != "" || opt.filter.targetDatabase != "" || opt.swap) {
+		return fmt.Errorf("a dump creating databases can not be restored in a single transaction")
+	}
+	if opt.jobs > 1 {
+		return fmt.Errorf("parallel jobs can not restore in a single transaction")
+	}
+	return nil
+}
+
+// errorModeArgs returns the arguments of psql or pg_restore that implement the error mode.
+func (opt *postgresOptions) errorModeArgs(cmd string) ([]any, error) {
+	switch opt.onError {
+	case OnErrorContinue:
+		return nil, nil
+	case OnErrorStop:
+		if cmd == PgArchiveRestore {
+			return []any{"--exit-on-error"}, nil
+		}
+		return []any{"--set=ON_ERROR_STOP=1"}, nil
+	case OnErrorSingleTransaction:
+		if cmd == PgArchiveRestore {
+			return []any{"--single-transaction"}, nil
+		}
+		// without ON_ERROR_STOP, psql commits the statements that have succeeded
+		return []any{"--set=ON_ERROR_STOP=1", "--single-transaction"}, nil
+	}
+	return nil, fmt.Errorf("invalid error mode: expected %s, %s or %s, but instead got %s", OnErrorContinue, OnErrorStop, OnErrorSingleTransaction, opt.onError)
+}
+
+// withErrorReport wraps the restore command, so that the errors it reports are written into the report file.
+func withErrorReport(cmd restic.Command, reportFile string) (restic.Command, error) {
+	return reportStage(RunRestoreCMD, reportFile, append([]any{"--", cmd.Name}, cmd.Args...)...)
+}
+
+// applyErrorReport records the errors of the restore and replaces the error of the pipeline, which only holds the
+// last lines of the stderr, with the description of the first failed statement. A restore that has kept going after
+// the failed statements succeeds, but they are described in the error of the restored host.
+func (opt *postgresOptions) applyErrorReport(restoreOutput *restic.RestoreOutput, report restoreErrorReport, err error) error {
+	opt.restoreStats.Errors = report.Errors
+	opt.restoreStats.FailedStatement = report.First
+	if err != nil && report.First != nil {
+		return report.First
+	}
+	if err == nil && restoreOutput != nil && report.First != nil {
+		for i := range restoreOutput.RestoreTargetStatus.Stats {
+			restoreOutput.RestoreTargetStatus.Stats[i].Error = report.summary()
+		}
+	}
+	return err
+}
+
+// readErrorReport reads the report written by the run-restore command.
+func readErrorReport(reportFile string) (restoreErrorReport, error) {
+	var report restoreErrorReport
+	err := readReport(reportFile, &report)
+	return report, err
+}
@@ -0,0 +1,217 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRestoreErrorParser(t *testing.T) {
+	tests := []struct {
+		name   string
+		stderr string
+		want   restoreErrorReport
+	}{
+		{
+			name:   "no error",
+			stderr: "psql:<stdin>:12: NOTICE:  extension \"pgcrypto\" already exists, skipping\n",
+		},
+		{
+			// psql --echo-errors with VERBOSITY=verbose
+			name: "psql",
+			stderr: `psql:<stdin>:42: ERROR:  42P07: relation "orders" already exists
+LOCATION:  heap_create_with_catalog, heap.c:1146
+psql:<stdin>:42: STATEMENT:  CREATE TABLE public.orders (
+    id integer NOT NULL,
+    note text
+);
+psql:<stdin>:57: ERROR:  42P01: relation "public.users" does not exist
+LOCATION:  RangeVarGetRelidExtended, namespace.c:434
+psql:<stdin>:57: STATEMENT:  ALTER TABLE ONLY public.users OWNER TO app;
+`,
+			want: restoreErrorReport{Errors: 2, First: &statementError{
+				Line:      42,
+				SQLState:  "42P07",
+				Message:   `relation "orders" already exists`,
+				Statement: "CREATE TABLE public.orders (\n    id integer NOT NULL,\n    note text\n);",
+			}},
+		},
+		{
+			name: "psql with a syntax error",
+			stderr: `psql:<stdin>:7: ERROR:  42601: syntax error at or near "TABEL"
+LINE 1: CREATE TABEL t (id int);
+               ^
+LOCATION:  scanner_yyerror, scan.l:1241
+psql:<stdin>:7: STATEMENT:  CREATE TABEL t (id int);
+`,
+			want: restoreErrorReport{Errors: 1, First: &statementError{
+				Line:      7,
+				SQLState:  "42601",
+				Message:   `syntax error at or near "TABEL"`,
+				Statement: "CREATE TABEL t (id int);",
+			}},
+		},
+		{
+			name: "psql failing to copy",
+			stderr: `psql:<stdin>:88: ERROR:  23505: duplicate key value violates unique constraint "orders_pkey"
+DETAIL:  Key (id)=(1) already exists.
+CONTEXT:  COPY orders, line 1
+LOCATION:  _bt_check_unique, nbtinsert.c:666
+psql:<stdin>:88: STATEMENT:  COPY public.orders (id, note) FROM stdin;
+`,
+			want: restoreErrorReport{Errors: 1, First: &statementError{
+				Line:      88,
+				SQLState:  "23505",
+				Message:   `duplicate key value violates unique constraint "orders_pkey"`,
+				Statement: "COPY public.orders (id, note) FROM stdin;",
+			}},
+		},
+		{
+			name: "psql without the failed statement",
+			stderr: `psql:/tmp/dump.sql:3: FATAL:  terminating connection due to administrator command
+psql:/tmp/dump.sql:3: error: connection to server was lost
+`,
+			want: restoreErrorReport{Errors: 1, First: &statementError{
+				Line:    3,
+				Message: "terminating connection due to administrator command",
+			}},
+		},
+		{
+			name: "pg_restore",
+			stderr: `pg_restore: while PROCESSING TOC:
+pg_restore: from TOC entry 216; 1259 16429 TABLE orders postgres
+pg_restore: error: could not execute query: ERROR:  relation "orders" already exists
+Command was: CREATE TABLE public.orders (
+    id integer NOT NULL
+);
+
+
+pg_restore: from TOC entry 3380; 0 16429 TABLE DATA orders postgres
+pg_restore: error: COPY failed for table "orders": ERROR:  duplicate key value violates unique constraint "orders_pkey"
+DETAIL:  Key (id)=(1) already exists.
+CONTEXT:  COPY orders, line 1
+pg_restore: warning: errors ignored on restore: 2
+`,
+			want: restoreErrorReport{Errors: 2, First: &statementError{
+				Entry:     "216; 1259 16429 TABLE orders postgres",
+				Message:   `relation "orders" already exists`,
+				Statement: "CREATE TABLE public.orders (\n    id integer NOT NULL\n);",
+			}},
+		},
+		{
+			name: "pg_restore failing to copy",
+			stderr: `pg_restore: while PROCESSING TOC:
+pg_restore: from TOC entry 3380; 0 16429 TABLE DATA orders postgres
+pg_restore: error: COPY failed for table "orders": ERROR:  duplicate key value violates unique constraint "orders_pkey"
+DETAIL:  Key (id)=(1) already exists.
+CONTEXT:  COPY orders, line 1
+`,
+			want: restoreErrorReport{Errors: 1, First: &statementError{
+				Entry:   "3380; 0 16429 TABLE DATA orders postgres",
+				Message: `duplicate key value violates unique constraint "orders_pkey"`,
+			}},
+		},
+		{
+			name:   "last line without a newline",
+			stderr: `psql:<stdin>:5: ERROR:  42P01: relation "t" does not exist`,
+			want: restoreErrorReport{Errors: 1, First: &statementError{
+				Line:     5,
+				SQLState: "42P01",
+				Message:  `relation "t" does not exist`,
+			}},
+		},
+		{
+			name: "long statement",
+			stderr: "psql:<stdin>:9: ERROR:  22001: value too long for type character varying(3)\n" +
+				"psql:<stdin>:9: STATEMENT:  INSERT INTO t VALUES ('" + strings.Repeat("x", 2*maxStatementLength) + "');\n",
+			want: restoreErrorReport{Errors: 1, First: &statementError{
+				Line:      9,
+				SQLState:  "22001",
+				Message:   "value too long for type character varying(3)",
+				Statement: ("INSERT INTO t VALUES ('" + strings.Repeat("x", 2*maxStatementLength))[:maxStatementLength] + "...",
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &restoreErrorParser{}
+			// the stderr is written in small chunks, which split the lines
+			for data := []byte(tt.stderr); len(data) > 0; data = data[min(7, len(data)):] {
+				if _, err := p.Write(data[:min(7, len(data))]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := p.result(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("result() = %+v (first %+v), want %+v (first %+v)", got, got.First, tt.want, tt.want.First)
+			}
+		})
+	}
+}
+
+func TestRestoreErrorParserOutcome(t *testing.T) {
+	exitErr := func(code int) error {
+		return exec.Command("sh", "-c", "exit "+strconv.Itoa(code)).Run()
+	}
+	tests := []struct {
+		name    string
+		stderr  string
+		err     error
+		wantErr bool
+	}{
+		{
+			name: "success",
+		},
+		{
+			name:   "pg_restore keeping going after the errors",
+			stderr: "pg_restore: error: could not execute query: ERROR:  relation \"orders\" already exists\npg_restore: warning: errors ignored on restore: 1\n",
+			err:    exitErr(1),
+		},
+		{
+			name:    "pg_restore stopping at the first error",
+			stderr:  "pg_restore: error: could not execute query: ERROR:  relation \"orders\" already exists\n",
+			err:     exitErr(1),
+			wantErr: true,
+		},
+		{
+			name:    "psql stopping at the first error",
+			stderr:  "psql:<stdin>:42: ERROR:  relation \"orders\" already exists\n",
+			err:     exitErr(3),
+			wantErr: true,
+		},
+		{
+			name:    "pg_restore failing after the errors",
+			stderr:  "pg_restore: warning: errors ignored on restore: 1\n",
+			err:     exitErr(2),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &restoreErrorParser{}
+			if _, err := p.Write([]byte(tt.stderr)); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.outcome(tt.err); (err != nil) != tt.wantErr {
+				t.Errorf("outcome() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+// pgBackupOutput extends the output of a backup session with PostgreSQL specific information.
+// The extra information is written under the "postgres" key, so the file can still be read by restic.ReadBackupOutput.
+type pgBackupOutput struct {
+	*restic.BackupOutput
+	Postgres *backupStats `json:"postgres,omitempty"`
+}
+
+// pgRestoreOutput extends the output of a restore session with PostgreSQL specific information.
+// The extra information is written under the "postgres" key, so the file can still be read by restic.ReadRestoreOutput.
+type pgRestoreOutput struct {
+	*restic.RestoreOutput
+	Postgres *restoreStats `json:"postgres,omitempty"`
+}
+
+type backupStats struct {
+	// Format indicates the format of the database dump
+	Format string `json:"format,omitempty"`
+	// Jobs indicates the number of parallel jobs used to dump the database
+	Jobs int `json:"jobs,omitempty"`
+	// Databases shows the databases that have been backed up individually
+	Databases []string `json:"databases,omitempty"`
+	// Parent indicates the snapshot an incremental base backup has been taken on top of
+	Parent string `json:"parent,omitempty"`
+	// RemovedSnapshots shows the base backups removed by the chain aware retention policy
+	RemovedSnapshots []string `json:"removedSnapshots,omitempty"`
+	// PartialSnapshots shows the snapshots of the dumps that have been cut short, which have been removed
+	PartialSnapshots []string `json:"partialSnapshots,omitempty"`
+	// Manifest indicates the snapshot the manifest of the backup has been stored in
+	Manifest string `json:"manifest,omitempty"`
+	// ExportedSnapshots shows the snapshots the databases have been dumped from
+	ExportedSnapshots []exportedSnapshot `json:"exportedSnapshots,omitempty"`
+	// Phases shows the time taken by the individual phases of the backup
+	Phases []phaseStats `json:"phases,omitempty"`
+}
+
+type restoreStats struct {
+	// Snapshot and SnapshotTime indicate the restored snapshot and the time it has been taken at
+	Snapshot     string `json:"snapshot,omitempty"`
+	SnapshotTime string `json:"snapshotTime,omitempty"`
+	// AsOf indicates the time the snapshot has been selected for
+	AsOf string `json:"asOf,omitempty"`
+	// Format indicates the format of the restored dump
+	Format string `json:"format,omitempty"`
+	// Checksum indicates the SHA-256 of the restored dump, verified against the checksum taken at backup
+	Checksum string `json:"checksum,omitempty"`
+	// Jobs indicates the number of parallel jobs used to restore the database
+	Jobs int `json:"jobs,omitempty"`
+	// Snapshots shows the snapshots that have been restored in a single run
+	Snapshots []snapshotRestoreStats `json:"snapshots,omitempty"`
+	// Databases shows the databases that have been restored out of a pg_dumpall dump
+	Databases []string `json:"databases,omitempty"`
+	// TargetDatabase indicates the name the database has been restored as
+	TargetDatabase string `json:"targetDatabase,omitempty"`
+	// Tables and Schemas show the patterns of the objects that have been selected to restore
+	Tables  []string `json:"tables,omitempty"`
+	Schemas []string `json:"schemas,omitempty"`
+	// Clean shows what has been dropped before the restore
+	Clean *cleanStats `json:"clean,omitempty"`
+	// Swap shows the outcome of a restore into a staging database
+	Swap *swapStats `json:"swap,omitempty"`
+	// OnError indicates how the errors of the restore have been handled
+	OnError string `json:"onError,omitempty"`
+	// Errors indicates the number of statements that have failed to restore
+	Errors int `json:"errors,omitempty"`
+	// FailedStatement describes the first statement that has failed to restore
+	FailedStatement *statementError `json:"failedStatement,omitempty"`
+	// Validation shows the comparison of the restored tables with the values taken at backup
+	Validation *verificationStats `json:"validation,omitempty"`
+	// Verification shows the checks run on the databases restored by verify-pg
+	Verification *verificationStats `json:"verification,omitempty"`
+	// DryRun shows the contents of the dump found by a dry run, nothing has been restored
+	DryRun *dumpContents `json:"dryRun,omitempty"`
+	// Phases shows the time taken by the individual phases of the restore
+	Phases []phaseStats `json:"phases,omitempty"`
+	// Recovery shows the outcome of a point in time recovery
+	Recovery *recoveryStats `json:"recovery,omitempty"`
+}
+
+type swapStats struct {
+	// Database indicates the live database that has been replaced
+	Database string `json:"database,omitempty"`
+	// Staging indicates the staging database the dump has been restored into
+	Staging string `json:"staging,omitempty"`
+	// Previous indicates the name the replaced database has been renamed to
+	Previous string `json:"previous,omitempty"`
+	// KeepUntil indicates the time the replaced database will be kept until
+	KeepUntil string `json:"keepUntil,omitempty"`
+	// Tables and Rows show the number of tables and the estimated number of rows of the staging database
+	Tables int64 `json:"tables,omitempty"`
+	Rows   int64 `json:"rows,omitempty"`
+}
+
+type cleanStats struct {
+	// Mode indicates the clean mode used for the restore
+	Mode string `json:"mode,omitempty"`
+	// Databases shows the databases that have been cleaned
+	Databases []droppedDatabase `json:"databases,omitempty"`
+}
+
+type droppedDatabase struct {
+	// Name indicates the name of the database
+	Name string `json:"name,omitempty"`
+	// Dropped indicates whether the database itself has been dropped
+	Dropped bool `json:"dropped,omitempty"`
+	// Schemas shows the schemas that have been dropped along with their objects
+	Schemas []string `json:"schemas,omitempty"`
+	// TerminatedConnections indicates the number of connections to the database that have been terminated
+	TerminatedConnections int `json:"terminatedConnections,omitempty"`
+}
+
+type recoveryStats struct {
+	// BaseBackup indicates the snapshot of the base backup the recovery has started from
+	BaseBackup string `json:"baseBackup,omitempty"`
+	// Target indicates the recovery target
+	Target string `json:"target,omitempty"`
+	// State indicates whether the recovery has been configured, completed or failed
+	State string `json:"state,omitempty"`
+	// Timeline indicates the timeline the server has been promoted on
+	Timeline string `json:"timeline,omitempty"`
+	// LSN indicates the WAL location of the server after the recovery
+	LSN string `json:"lsn,omitempty"`
+	// Message explains why the recovery has failed
+	Message string `json:"message,omitempty"`
+}
+
+// exportedSnapshot identifies the point in time a database has been dumped at. All the tables of the
+// database have been read from the same snapshot, which has been taken at the given WAL location.
+type exportedSnapshot struct {
+	// Database indicates the database the snapshot has been exported from
+	Database string `json:"database,omitempty"`
+	// SnapshotID indicates the identifier returned by pg_export_snapshot()
+	SnapshotID string `json:"snapshotID,omitempty"`
+	// LSN indicates the WAL location at the time the snapshot has been exported
+	LSN string `json:"lsn,omitempty"`
+}
+
+type phaseStats struct {
+	Name     string `json:"name"`
+	Duration string `json:"duration"`
+}
+
+// runPhase runs fn and records the time it has taken under the given phase name.
+func runPhase(phases *[]phaseStats, name string, fn func() error) error {
+	startTime := time.Now()
+	err := fn()
+	*phases = append(*phases, phaseStats{
+		Name:     name,
+		Duration: time.Since(startTime).String(),
+	})
+	return err
+}
+
+func (out *pgBackupOutput) WriteOutput(fileName string) error {
+	return writeOutput(fileName, out)
+}
+
+func (out *pgRestoreOutput) WriteOutput(fileName string) error {
+	return writeOutput(fileName, out)
+}
+
+// writeOutput writes the output the same way as restic does, so that it remains writable for other users.
+func writeOutput(fileName string, out any) error {
+	jsonOutput, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fileName), restic.FileModeRWXAll); err != nil {
+		return err
+	}
+	newFile := false
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		newFile = true
+	}
+	if err := os.WriteFile(fileName, jsonOutput, restic.FileModeRWXAll); err != nil {
+		return err
+	}
+	if newFile {
+		return os.Chmod(fileName, restic.FileModeRWXAll)
+	}
+	return nil
+}
+
+// selfStage returns a pipe stage running a hidden command of this binary.
+func selfStage(command string, args ...any) (restic.Command, error) {
+	bin, err := os.Executable()
+	if err != nil {
+		return restic.Command{}, err
+	}
+	return restic.Command{Name: bin, Args: append([]any{command}, args...)}, nil
+}
+
+// reportStage returns a pipe stage running a hidden command of this binary, which writes its report into the report
+// file once it has read the stream to its end. The report of a previous run is removed, so that it is not mistaken
+// for the report of this one.
+func reportStage(command, reportFile string, args ...any) (restic.Command, error) {
+	if err := os.Remove(reportFile); err != nil && !os.IsNotExist(err) {
+		return restic.Command{}, err
+	}
+	return selfStage(command, append([]any{fmt.Sprintf("--report=%s", reportFile)}, args...)...)
+}
+
+// readReport reads the report written by a stage of the pipeline. The report is missing if the stage has stopped
+// before the end of the stream.
+func readReport(reportFile string, report any) error {
+	data, err := os.ReadFile(reportFile)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("the report %s has not been written, the pipeline has stopped before its end", reportFile)
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, report); err != nil {
+		return fmt.Errorf("failed to parse the report %s: %v", reportFile, err)
+	}
+	return nil
+}
@@ -0,0 +1,467 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"github.com/spf13/cobra"
+	license "go.bytebuilders.dev/license-verifier/kubernetes"
+	"gomodules.xyz/flags"
+	shell "gomodules.xyz/go-sh"
+	"k8s.io/klog/v2"
+	appcatalog "kmodules.xyz/custom-resources/apis/appcatalog/v1alpha1"
+)
+
+const (
+	baseBackupManifest = "backup_manifest"
+	recoverySignalFile = "recovery.signal"
+	autoConfFile       = "postgresql.auto.conf"
+
+	RecoveryConfigured = "Configured"
+	RecoveryCompleted  = "Completed"
+	RecoveryFailed     = "Failed"
+
+	recoveryStatusQuery = "SELECT pg_is_in_recovery()"
+	recoveryResultQuery = "SELECT timeline_id, pg_current_wal_lsn() FROM pg_control_checkpoint()"
+)
+
+type pitrOptions struct {
+	targetTime      string
+	targetLSN       string
+	targetXID       string
+	targetInclusive bool
+	targetAction    string
+	recover         bool
+	recoveryTimeout int32
+	masterURL       string
+	kubeconfigPath  string
+}
+
+func NewCmdRestorePITR() *cobra.Command {
+	opt := postgresOptions{
+		waitTimeout: 300,
+		setupOptions: restic.SetupOptions{
+			ScratchDir:  restic.DefaultScratchDir,
+			EnableCache: false,
+		},
+		dumpOptions: restic.DumpOptions{
+			Host: restic.DefaultHost,
+		},
+		pitr: pitrOptions{
+			targetInclusive: true,
+			targetAction:    "promote",
+			recoveryTimeout: 3600,
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:               "restore-pg-pitr",
+		Short:             "Restores Postgres DB to a point in time from a base backup and the archived WAL",
+		DisableAutoGenTag: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags.EnsureRequiredFlags(cmd, "data-dir", "provider", "storage-secret-name", "storage-secret-namespace")
+
+			err := opt.prepareClients(opt.pitr.masterURL, opt.pitr.kubeconfigPath)
+			if err != nil {
+				return err
+			}
+
+			targetRef := api_v1beta1.TargetRef{
+				APIVersion: appcatalog.SchemeGroupVersion.String(),
+				Kind:       appcatalog.ResourceKindApp,
+				Name:       opt.appBindingName,
+				Namespace:  opt.appBindingNamespace,
+			}
+			var restoreOutput *restic.RestoreOutput
+			restoreOutput, err = opt.restorePITR(targetRef)
+			if err != nil {
+				restoreOutput = &restic.RestoreOutput{
+					RestoreTargetStatus: api_v1beta1.RestoreMemberStatus{
+						Ref: targetRef,
+						Stats: []api_v1beta1.HostRestoreStats{
+							{
+								Hostname: opt.dumpOptions.Host,
+								Phase:    api_v1beta1.HostRestoreFailed,
+								Error:    err.Error(),
+							},
+						},
+					},
+				}
+			}
+			// If output directory specified, then write the output in "output.json" file in the specified directory
+			if opt.outputDir != "" {
+				out := &pgRestoreOutput{
+					RestoreOutput: restoreOutput,
+					Postgres:      &opt.restoreStats,
+				}
+				return out.WriteOutput(filepath.Join(opt.outputDir, restic.DefaultOutputFileName))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&opt.dataDir, "data-dir", opt.dataDir, "Path of the data directory where the base backup will be restored (i.e. the mount path of the PVC). It must be empty")
+	cmd.Flags().StringVar(&opt.pitr.targetTime, "target-time", opt.pitr.targetTime, "Time (RFC3339) up to which the database will be recovered")
+	cmd.Flags().StringVar(&opt.pitr.targetLSN, "target-lsn", opt.pitr.targetLSN, "WAL location up to which the database will be recovered")
+	cmd.Flags().StringVar(&opt.pitr.targetXID, "target-xid", opt.pitr.targetXID, "Transaction ID up to which the database will be recovered (the base backup must be given with --snapshot)")
+	cmd.Flags().BoolVar(&opt.pitr.targetInclusive, "target-inclusive", opt.pitr.targetInclusive, "Specify whether to stop just after the recovery target (true) or just before it (false)")
+	cmd.Flags().StringVar(&opt.pitr.targetAction, "target-action", opt.pitr.targetAction, "Action the server will take once the recovery target is reached (can be pause, promote or shutdown)")
+	cmd.Flags().BoolVar(&opt.pitr.recover, "recover", opt.pitr.recover, "Specify whether to run the recovery with a local postgres server before completing the restore")
+	cmd.Flags().Int32Var(&opt.pitr.recoveryTimeout, "recovery-timeout", opt.pitr.recoveryTimeout, "Time limit in seconds to wait for the recovery to complete (only applicable with --recover)")
+	cmd.Flags().StringVar(&opt.user, "user", DefaultPostgresUser, "Database user to connect to the local server with (only applicable with --recover)")
+	cmd.Flags().Int32Var(&opt.waitTimeout, "wait-timeout", opt.waitTimeout, "Time limit to wait for the local server to be ready (only applicable with --recover)")
+
+	cmd.Flags().StringVar(&opt.pitr.masterURL, "master", opt.pitr.masterURL, "The address of the Kubernetes API server (overrides any value in kubeconfig)")
+	cmd.Flags().StringVar(&opt.pitr.kubeconfigPath, "kubeconfig", opt.pitr.kubeconfigPath, "Path to kubeconfig file with authorization information (the master location is set by the master flag).")
+	cmd.Flags().StringVar(&opt.appBindingName, "appbinding", opt.appBindingName, "Name of the app binding")
+	cmd.Flags().StringVar(&opt.appBindingNamespace, "appbinding-namespace", opt.appBindingNamespace, "Namespace of the app binding")
+	addStorageFlags(cmd, &opt)
+
+	cmd.Flags().StringVar(&opt.dumpOptions.Host, "hostname", opt.dumpOptions.Host, "Name of the host machine")
+	cmd.Flags().StringVar(&opt.dumpOptions.SourceHost, "source-hostname", opt.dumpOptions.SourceHost, "Name of the host whose data will be restored")
+	cmd.Flags().StringVar(&opt.dumpOptions.Snapshot, "snapshot", opt.dumpOptions.Snapshot, "Base backup snapshot to restore (keep empty to pick the newest base backup before the target time or location)")
+
+	cmd.Flags().StringVar(&opt.outputDir, "output-dir", opt.outputDir, "Directory where output.json file will be written (keep empty if you don't need to write output in file)")
+	return cmd
+}
+
+// recoveryTarget holds the recovery_target_* setting requested by the user.
+type recoveryTarget struct {
+	name  string
+	value string
+	time  time.Time
+	lsn   uint64
+}
+
+func (t recoveryTarget) String() string {
+	return fmt.Sprintf("%s=%s", t.name, t.value)
+}
+
+// recoveryTarget validates that exactly one recovery target has been requested and parses it.
+func (o pitrOptions) recoveryTarget() (*recoveryTarget, error) {
+	var targets []*recoveryTarget
+	if o.targetTime != "" {
+		t, err := time.Parse(time.RFC3339, o.targetTime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target time %q: %v", o.targetTime, err)
+		}
+		targets = append(targets, &recoveryTarget{name: "recovery_target_time", value: o.targetTime, time: t})
+	}
+	if o.targetLSN != "" {
+		lsn, err := parseLSN(o.targetLSN)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, &recoveryTarget{name: "recovery_target_lsn", value: o.targetLSN, lsn: lsn})
+	}
+	if o.targetXID != "" {
+		if _, err := strconv.ParseUint(o.targetXID, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid target xid %q: %v", o.targetXID, err)
+		}
+		targets = append(targets, &recoveryTarget{name: "recovery_target_xid", value: o.targetXID})
+	}
+	if len(targets) != 1 {
+		return nil, fmt.Errorf("exactly one of --target-time, --target-lsn or --target-xid must be specified")
+	}
+	switch o.targetAction {
+	case "pause", "promote", "shutdown":
+	default:
+		return nil, fmt.Errorf("invalid target action %q: expected pause, promote or shutdown", o.targetAction)
+	}
+	return targets[0], nil
+}
+
+// parseLSN parses a WAL location of the form "16/B374D848".
+func parseLSN(lsn string) (uint64, error) {
+	parts := strings.Split(lsn, "/")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid lsn %q", lsn)
+	}
+	hi, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid lsn %q: %v", lsn, err)
+	}
+	lo, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid lsn %q: %v", lsn, err)
+	}
+	return hi<<32 | lo, nil
+}
+
+func (opt *postgresOptions) restorePITR(targetRef api_v1beta1.TargetRef) (*restic.RestoreOutput, error) {
+	err := license.CheckLicenseEndpoint(opt.config, licenseApiService, SupportedProducts)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := opt.pitr.recoveryTarget()
+	if err != nil {
+		return nil, err
+	}
+
+	sh := shell.NewSession()
+	resticWrapper, err := opt.newResticWrapper(sh)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := opt.getBaseBackup(resticWrapper, target)
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("Restoring base backup %s taken at %s to recover up to %s", snapshot.ID, snapshot.Time, target)
+	opt.restoreStats.Format = DumpFormatPhysical
+	opt.restoreStats.Recovery = &recoveryStats{
+		BaseBackup: snapshot.ID,
+		Target:     target.String(),
+	}
+
+	restoreOutput, err := opt.restoreBaseBackup(resticWrapper, snapshot, targetRef)
+	if err != nil {
+		return nil, err
+	}
+
+	err = opt.writeRecoveryConfig(target)
+	if err != nil {
+		return nil, err
+	}
+	if !opt.pitr.recover {
+		// the recovery will be run by the server started on the data directory
+		opt.restoreStats.Recovery.State = RecoveryConfigured
+		return restoreOutput, nil
+	}
+
+	err = runPhase(&opt.restoreStats.Phases, "recovery", opt.runRecovery)
+	if err != nil {
+		opt.restoreStats.Recovery.State = RecoveryFailed
+		opt.restoreStats.Recovery.Message = err.Error()
+		return nil, err
+	}
+	opt.restoreStats.Recovery.State = RecoveryCompleted
+	return restoreOutput, nil
+}
+
+// getBaseBackup picks the newest base backup of the source host that can be recovered up to the target.
+func (opt *postgresOptions) getBaseBackup(w *restic.ResticWrapper, target *recoveryTarget) (*restic.Snapshot, error) {
+	if opt.dumpOptions.Snapshot != "" {
+		snapshot, err := opt.getSnapshot(w)
+		if err != nil {
+			return nil, err
+		}
+		if dumpFormatOf(snapshot) != DumpFormatPhysical {
+			return nil, fmt.Errorf("snapshot %s does not hold a base backup", snapshot.ID)
+		}
+		return snapshot, nil
+	}
+
+	if target.time.IsZero() && target.lsn == 0 {
+		// a transaction ID does not tell which base backups have been taken before it
+		return nil, fmt.Errorf("the base backup to recover up to %s must be given with --snapshot", target)
+	}
+
+	snapshots, err := w.ListSnapshots(nil)
+	if err != nil {
+		return nil, err
+	}
+	sourceHost := opt.dumpOptions.SourceHost
+	if sourceHost == "" {
+		sourceHost = opt.dumpOptions.Host
+	}
+
+	var candidates []restic.Snapshot
+	for _, snapshot := range snapshots {
+		if snapshot.Hostname != sourceHost || dumpFormatOf(&snapshot) != DumpFormatPhysical {
+			continue
+		}
+		if !target.time.IsZero() && snapshot.Time.After(target.time) {
+			continue
+		}
+		candidates = append(candidates, snapshot)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Time.After(candidates[j].Time)
+	})
+
+	for i := range candidates {
+		if target.lsn == 0 {
+			return &candidates[i], nil
+		}
+		// the recovery can only stop after the base backup has become consistent
+		endLSN, err := baseBackupEndLSN(w, &candidates[i])
+		if err != nil {
+			return nil, err
+		}
+		if endLSN <= target.lsn {
+			return &candidates[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no base backup of host %s found before %s", sourceHost, target)
+}
+
+// baseBackupEndLSN reads the WAL location where the base backup became consistent from its manifest.
+func baseBackupEndLSN(w *restic.ResticWrapper, snapshot *restic.Snapshot) (uint64, error) {
+	out, err := w.DumpOnce(restic.DumpOptions{
+		Snapshot: snapshot.ID,
+		FileName: path.Join(dumpFileOf(snapshot), baseBackupManifest),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var manifest struct {
+		WALRanges []struct {
+			EndLSN string `json:"End-LSN"`
+		} `json:"WAL-Ranges"`
+	}
+	if err := json.Unmarshal(out, &manifest); err != nil {
+		return 0, err
+	}
+	if len(manifest.WALRanges) == 0 {
+		return 0, fmt.Errorf("manifest of base backup %s does not have WAL ranges", snapshot.ID)
+	}
+	return parseLSN(manifest.WALRanges[len(manifest.WALRanges)-1].EndLSN)
+}
+
+// writeRecoveryConfig puts the data directory into targeted recovery. The archived WAL is fetched
+// through the restore-wal command with the same repository settings as this restore.
+func (opt *postgresOptions) writeRecoveryConfig(target *recoveryTarget) error {
+	restoreCommand, err := opt.restoreWALCommand()
+	if err != nil {
+		return err
+	}
+	action := opt.pitr.targetAction
+	if opt.pitr.recover {
+		// the local server must leave the recovery, so that the restore can tell when it has completed
+		action = "promote"
+	}
+
+	settings := []string{
+		"",
+		"# point in time recovery settings written by stash-postgres",
+		fmt.Sprintf("restore_command = %s", quoteConfValue(restoreCommand)),
+		fmt.Sprintf("%s = %s", target.name, quoteConfValue(target.value)),
+		fmt.Sprintf("recovery_target_inclusive = %t", opt.pitr.targetInclusive),
+		fmt.Sprintf("recovery_target_action = %s", quoteConfValue(action)),
+		"",
+	}
+	f, err := os.OpenFile(filepath.Join(opt.dataDir, autoConfFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(strings.Join(settings, "\n")); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(opt.dataDir, recoverySignalFile), nil, 0o600)
+}
+
+// restoreWALCommand builds the restore_command that fetches the archived WAL from the repository.
+func (opt *postgresOptions) restoreWALCommand() (string, error) {
+	bin, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	sourceHost := opt.dumpOptions.SourceHost
+	if sourceHost == "" {
+		sourceHost = opt.dumpOptions.Host
+	}
+
+	args := []string{shellQuote(bin), "restore-wal", "%f", "%p"}
+	for _, flag := range []struct{ name, value string }{
+		{"provider", opt.setupOptions.Provider},
+		{"bucket", opt.setupOptions.Bucket},
+		{"endpoint", opt.setupOptions.Endpoint},
+		{"region", opt.setupOptions.Region},
+		{"path", opt.setupOptions.Path},
+		{"scratch-dir", opt.setupOptions.ScratchDir},
+		{"storage-secret-name", opt.storageSecret.Name},
+		{"storage-secret-namespace", opt.storageSecret.Namespace},
+		{"hostname", opt.dumpOptions.Host},
+		{"source-hostname", sourceHost},
+		{"master", opt.pitr.masterURL},
+		{"kubeconfig", opt.pitr.kubeconfigPath},
+	} {
+		if flag.value != "" {
+			args = append(args, fmt.Sprintf("--%s=%s", flag.name, shellQuote(flag.value)))
+		}
+	}
+	if opt.setupOptions.InsecureTLS {
+		args = append(args, "--insecure-tls")
+	}
+	if opt.setupOptions.MaxConnections > 0 {
+		args = append(args, fmt.Sprintf("--max-connections=%d", opt.setupOptions.MaxConnections))
+	}
+	return strings.Join(args, " "), nil
+}
+
+// runRecovery starts a local server on the restored data directory and waits until it has recovered
+// up to the target and has been promoted.
+func (opt *postgresOptions) runRecovery() error {
+	server := newLocalServer(opt.dataDir, opt.setupOptions.ScratchDir, opt.user)
+	if err := server.start(opt.waitTimeout); err != nil {
+		return fmt.Errorf("failed to start recovery: %v: %s", err, server.logTail(10))
+	}
+
+	session := server.newSession(PgRestoreCMD)
+	deadline := time.Now().Add(time.Duration(opt.pitr.recoveryTimeout) * time.Second)
+	for {
+		rows, err := session.executeQuery(DefaultPostgresDB, recoveryStatusQuery)
+		if err == nil && len(rows) == 1 && rows[0] == "f" {
+			break
+		}
+		if !server.running() {
+			return fmt.Errorf("recovery has failed: %s", server.logTail(10))
+		}
+		if time.Now().After(deadline) {
+			_ = server.stop()
+			return fmt.Errorf("recovery has not completed within %d seconds", opt.pitr.recoveryTimeout)
+		}
+		time.Sleep(5 * time.Second)
+	}
+
+	rows, err := session.executeQuery(DefaultPostgresDB, recoveryResultQuery)
+	if err == nil && len(rows) == 1 {
+		if parts := strings.Split(rows[0], "|"); len(parts) == 2 {
+			opt.restoreStats.Recovery.Timeline = parts[0]
+			opt.restoreStats.Recovery.LSN = parts[1]
+		}
+	}
+	return server.stop()
+}
+
+// shellQuote quotes a value for the shell postgres runs the restore_command with.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// quoteConfValue quotes a value for postgresql.conf.
+func quoteConfValue(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
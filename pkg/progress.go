@@ -0,0 +1,260 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"github.com/spf13/cobra"
+	"k8s.io/klog/v2"
+)
+
+const (
+	ProgressCMD = "progress"
+	// ProgressFileName is the file the progress of a restore is written into, next to the output.json file
+	ProgressFileName = "progress.json"
+)
+
+// restoreProgress shows how much of the dump has been read out of the repository.
+type restoreProgress struct {
+	Snapshot string `json:"snapshot,omitempty"`
+	// TotalBytes indicates the size of the dump recorded at backup, or the size of its snapshot if it has not been recorded
+	TotalBytes uint64 `json:"totalBytes"`
+	// Bytes indicates the number of bytes that have been passed to the restore
+	Bytes   int64   `json:"bytes"`
+	Percent float64 `json:"percent"`
+	// BytesPerSecond indicates the average throughput since the start of the restore
+	BytesPerSecond float64 `json:"bytesPerSecond"`
+	// ETA indicates the estimated time left until the whole dump has been read
+	ETA       string `json:"eta,omitempty"`
+	StartedAt string `json:"startedAt"`
+	UpdatedAt string `json:"updatedAt"`
+	// Done indicates whether the whole dump has been read
+	Done bool `json:"done"`
+}
+
+func (p restoreProgress) String() string {
+	if p.TotalBytes == 0 {
+		return fmt.Sprintf("%s at %s/s", formatBytes(float64(p.Bytes)), formatBytes(p.BytesPerSecond))
+	}
+	s := fmt.Sprintf("%s of %s (%.1f%%) at %s/s", formatBytes(float64(p.Bytes)), formatBytes(float64(p.TotalBytes)), p.Percent, formatBytes(p.BytesPerSecond))
+	if p.ETA != "" {
+		s += ", ETA " + p.ETA
+	}
+	return s
+}
+
+// formatBytes formats a size with binary units, i.e. "1.5 GiB".
+func formatBytes(n float64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	exp := 0
+	for n >= unit*unit && exp < 4 {
+		n /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", n/unit, "KMGTP"[exp])
+}
+
+// progressCounter counts the bytes flowing through the restore pipeline.
+type progressCounter struct {
+	progress  restoreProgress
+	startTime time.Time
+	file      string
+}
+
+func (c *progressCounter) Write(data []byte) (int, error) {
+	c.progress.Bytes += int64(len(data))
+	return len(data), nil
+}
+
+// update computes the progress so far and writes it into the progress file.
+func (c *progressCounter) update(done bool) error {
+	p := &c.progress
+	now := time.Now()
+	elapsed := now.Sub(c.startTime).Seconds()
+	p.UpdatedAt = now.UTC().Format(time.RFC3339)
+	p.Done = done
+	if elapsed > 0 {
+		p.BytesPerSecond = float64(p.Bytes) / elapsed
+	}
+	p.ETA = ""
+	switch {
+	case done:
+		p.Percent = 100
+	case p.TotalBytes > 0:
+		// the restore is only complete once the whole dump has been read
+		p.Percent = min(100*float64(p.Bytes)/float64(p.TotalBytes), 99.9)
+		if left := float64(p.TotalBytes) - float64(p.Bytes); left > 0 && p.BytesPerSecond > 0 {
+			p.ETA = (time.Duration(left/p.BytesPerSecond) * time.Second).String()
+		}
+	}
+	return writeProgress(c.file, *p)
+}
+
+// writeProgress replaces the progress file at once, so that its readers never see a partially written file.
+func writeProgress(file string, p restoreProgress) error {
+	tmp := file + ".tmp"
+	if err := writeOutput(tmp, p); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func readProgress(file string) (restoreProgress, error) {
+	var p restoreProgress
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return p, err
+	}
+	return p, json.Unmarshal(data, &p)
+}
+
+func NewCmdProgress() *cobra.Command {
+	var (
+		snapshot   string
+		totalBytes uint64
+		file       string
+		interval   = 10 * time.Second
+	)
+
+	cmd := &cobra.Command{
+		Use:               ProgressCMD,
+		Short:             "Copies the stdin into the stdout and writes the progress into a JSON file",
+		Long:              `Copies the stdin into the stdout and periodically writes the number of bytes copied so far into a JSON file. It is used by restore-pg as the first stage of the restore pipeline.`,
+		Hidden:            true,
+		DisableAutoGenTag: true,
+		SilenceUsage:      true,
+		Args:              cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			startTime := time.Now()
+			c := &progressCounter{
+				progress: restoreProgress{
+					Snapshot:   snapshot,
+					TotalBytes: totalBytes,
+					StartedAt:  startTime.UTC().Format(time.RFC3339),
+				},
+				startTime: startTime,
+				file:      file,
+			}
+			if err := c.update(false); err != nil {
+				return err
+			}
+
+			out := bufio.NewWriterSize(os.Stdout, 1<<20)
+			copied := make(chan error, 1)
+			go func() {
+				_, err := io.Copy(io.MultiWriter(out, c), os.Stdin)
+				if err == nil {
+					err = out.Flush()
+				}
+				copied <- err
+			}()
+
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case err := <-copied:
+					if err != nil {
+						return err
+					}
+					return c.update(true)
+				case <-ticker.C:
+					// a failure to write the progress must not fail the restore
+					if err := c.update(false); err != nil {
+						fmt.Fprintf(os.Stderr, "failed to write progress: %s\n", err)
+					}
+				}
+			}
+		},
+	}
+
+	cmd.Flags().StringVar(&snapshot, "snapshot", snapshot, "Snapshot the dump is read from")
+	cmd.Flags().Uint64Var(&totalBytes, "total-bytes", totalBytes, "Size of the dump in bytes, 0 if it is unknown")
+	cmd.Flags().StringVar(&file, "file", file, "Path of the file where the progress will be written")
+	cmd.Flags().DurationVar(&interval, "interval", interval, "Time between two updates of the progress file")
+	return cmd
+}
+
+// progressFile returns the file the progress of the restore is written into. The file is written next to the
+// output.json file, so that it can be displayed along with the output, otherwise into the scratch directory.
+func (opt *postgresOptions) progressFile() string {
+	if opt.outputDir != "" {
+		return filepath.Join(opt.outputDir, ProgressFileName)
+	}
+	return filepath.Join(opt.setupOptions.ScratchDir, ProgressFileName)
+}
+
+// trackProgress adds the progress stage in front of the restore pipeline, so that the pipeline becomes
+// restic dump | stash-postgres progress <args> | ... , and logs the progress it reports until stop is called.
+// The progress is logged by this process, so that it does not fill up the stderr kept to report the errors of the pipeline.
+func (opt *postgresOptions) trackProgress(snapshotID string, size uint64) (stop func(), err error) {
+	file := opt.progressFile()
+	stage, err := selfStage(ProgressCMD, fmt.Sprintf("--snapshot=%s", snapshotID), fmt.Sprintf("--total-bytes=%d", size), fmt.Sprintf("--file=%s", file), fmt.Sprintf("--interval=%s", opt.progressInterval))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), restic.FileModeRWXAll); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	opt.dumpOptions.StdoutPipeCommands = append([]restic.Command{stage}, opt.dumpOptions.StdoutPipeCommands...)
+
+	var (
+		done       = make(chan struct{})
+		finished   = make(chan struct{})
+		lastUpdate string
+	)
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(opt.progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			p, err := readProgress(file)
+			if err != nil || p.UpdatedAt == lastUpdate {
+				continue
+			}
+			lastUpdate = p.UpdatedAt
+			klog.Infof("Restore progress: %s", p)
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+		if p, err := readProgress(file); err == nil && p.Done && p.UpdatedAt != lastUpdate {
+			klog.Infof("Restore progress: %s", p)
+		}
+	}, nil
+}
@@ -0,0 +1,96 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProgressCounterUpdate(t *testing.T) {
+	tests := []struct {
+		name       string
+		totalBytes uint64
+		bytes      int64
+		done       bool
+		percent    float64
+		// minETA and maxETA bound the ETA, which is empty if both are zero
+		minETA, maxETA time.Duration
+	}{
+		{
+			name:       "in progress",
+			totalBytes: 4000,
+			bytes:      1000,
+			percent:    25,
+			minETA:     29 * time.Second,
+			maxETA:     30 * time.Second,
+		},
+		{
+			name:       "dump larger than recorded",
+			totalBytes: 1000,
+			bytes:      2000,
+			percent:    99.9,
+		},
+		{
+			name:  "unknown size",
+			bytes: 1000,
+		},
+		{
+			name:       "done",
+			totalBytes: 4000,
+			bytes:      4000,
+			done:       true,
+			percent:    100,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &progressCounter{
+				progress:  restoreProgress{TotalBytes: tt.totalBytes},
+				startTime: time.Now().Add(-10 * time.Second),
+				file:      filepath.Join(t.TempDir(), ProgressFileName),
+			}
+			if _, err := c.Write(make([]byte, tt.bytes)); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.update(tt.done); err != nil {
+				t.Fatalf("update() error = %v", err)
+			}
+			p, err := readProgress(c.file)
+			if err != nil {
+				t.Fatalf("failed to read the progress file: %v", err)
+			}
+			if p.Bytes != tt.bytes || p.Done != tt.done || p.Percent != tt.percent {
+				t.Errorf("progress = %d bytes, done %t, %.1f%%, want %d bytes, done %t, %.1f%%", p.Bytes, p.Done, p.Percent, tt.bytes, tt.done, tt.percent)
+			}
+			if p.BytesPerSecond < float64(tt.bytes)/11 || p.BytesPerSecond > float64(tt.bytes)/10 {
+				t.Errorf("BytesPerSecond = %.1f, want about %.1f", p.BytesPerSecond, float64(tt.bytes)/10)
+			}
+			if tt.maxETA == 0 {
+				if p.ETA != "" {
+					t.Errorf("ETA = %q, want none", p.ETA)
+				}
+				return
+			}
+			eta, err := time.ParseDuration(p.ETA)
+			if err != nil || eta < tt.minETA || eta > tt.maxETA {
+				t.Errorf("ETA = %q, want between %s and %s", p.ETA, tt.minETA, tt.maxETA)
+			}
+		})
+	}
+}
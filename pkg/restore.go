@@ -18,7 +18,12 @@ package pkg
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"os"
 	"path/filepath"
+	"slices"
+	"time"
 
 	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
 	"stash.appscode.dev/apimachinery/pkg/restic"
@@ -29,6 +34,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
 	appcatalog "kmodules.xyz/custom-resources/apis/appcatalog/v1alpha1"
 	appcatalog_cs "kmodules.xyz/custom-resources/client/clientset/versioned"
 	v1 "kmodules.xyz/offshoot-api/api/v1"
@@ -39,7 +45,13 @@ func NewCmdRestore() *cobra.Command {
 		masterURL      string
 		kubeconfigPath string
 		opt            = postgresOptions{
-			waitTimeout: 300,
+			waitTimeout:      300,
+			jobs:             1,
+			onError:          OnErrorContinue,
+			swapGracePeriod:  24 * time.Hour,
+			swapMinRowRatio:  0.5,
+			progressInterval: 30 * time.Second,
+			maxConcurrency:   1,
 			setupOptions: restic.SetupOptions{
 				ScratchDir:  restic.DefaultScratchDir,
 				EnableCache: false,
@@ -98,7 +110,11 @@ func NewCmdRestore() *cobra.Command {
 			}
 			// If output directory specified, then write the output in "output.json" file in the specified directory
 			if opt.outputDir != "" {
-				return restoreOutput.WriteOutput(filepath.Join(opt.outputDir, restic.DefaultOutputFileName))
+				out := &pgRestoreOutput{
+					RestoreOutput: restoreOutput,
+					Postgres:      &opt.restoreStats,
+				}
+				return out.WriteOutput(filepath.Join(opt.outputDir, restic.DefaultOutputFileName))
 			}
 
 			return nil
@@ -106,6 +122,19 @@ func NewCmdRestore() *cobra.Command {
 	}
 
 	cmd.Flags().StringVar(&opt.pgArgs, "pg-args", opt.pgArgs, "Additional arguments")
+	cmd.Flags().IntVar(&opt.jobs, "jobs", opt.jobs, "Number of parallel jobs used to restore the database (only applicable for the directory format). The dump is extracted into the scratch directory before restore, so it must have enough space to hold it")
+	cmd.Flags().StringVar(&opt.dataDir, "data-dir", opt.dataDir, "Path of the data directory where a physical base backup will be restored (i.e. the mount path of the PVC). It must be empty")
+	opt.filter.addFlags(cmd.Flags())
+	cmd.Flags().StringVar(&opt.onError, "on-error", opt.onError, "Specify how to handle the statements failing to restore (can only be continue, stop or single-transaction). stop stops at the first error, single-transaction rolls the whole restore back at the first error")
+	cmd.Flags().StringVar(&opt.clean, "clean", opt.clean, "Specify how to clean the databases before the restore (can only be recreate, objects or require-empty). recreate drops and creates the databases again, objects drops their schemas, require-empty refuses to restore into a database holding any object")
+	cmd.Flags().StringSliceVar(&opt.confirmDestroy, "confirm-destroy", opt.confirmDestroy, "Names of the databases that may be cleaned by --clean=recreate or --clean=objects")
+	cmd.Flags().BoolVar(&opt.swap, "swap", opt.swap, "Specify whether to restore into a staging database first, then swap it with the live database once it has been validated. The live database is given with --target-database, or with --database for a dump creating its databases. The restore stops at the first error unless single-transaction is set")
+	cmd.Flags().DurationVar(&opt.swapGracePeriod, "swap-grace-period", opt.swapGracePeriod, "Time to keep the replaced database after a swap. It is dropped by the next swap of the same database once the grace period is over")
+	cmd.Flags().Float64Var(&opt.swapMinRowRatio, "swap-min-row-ratio", opt.swapMinRowRatio, "Minimum ratio of the estimated rows of the staging database to the ones of the live database for the swap to happen (0 disables the check)")
+	cmd.Flags().BoolVar(&opt.dryRun, "dry-run", opt.dryRun, "Specify whether to only read the dump and report what it contains (i.e. databases, schemas, tables, roles and extensions) without connecting to the database")
+	cmd.Flags().BoolVar(&opt.tableValidation, "validate-tables", opt.tableValidation, "Specify whether to compare the rows of the restored tables, and the checksums of their primary keys, with the values taken at backup. The snapshot must be taken with --table-stats. A mismatch fails the restore, and prevents the swap with --swap")
+	cmd.Flags().BoolVar(&opt.overwriteTarget, "overwrite-target", opt.overwriteTarget, "Specify whether to drop the database given with --target-database if it already exists")
+	cmd.Flags().DurationVar(&opt.progressInterval, "progress-interval", opt.progressInterval, "Time between two reports of the progress of the restore. The progress is written into the progress.json file of the output directory as well")
 	cmd.Flags().StringVar(&opt.user, "user", DefaultPostgresUser, "Specifies database user (not applicable for basic authentication)")
 	cmd.Flags().Int32Var(&opt.waitTimeout, "wait-timeout", opt.waitTimeout, "Time limit to wait for the database to be ready")
 
@@ -114,23 +143,14 @@ func NewCmdRestore() *cobra.Command {
 	cmd.Flags().StringVar(&opt.namespace, "namespace", "default", "Namespace of Backup/Restore Session")
 	cmd.Flags().StringVar(&opt.appBindingName, "appbinding", opt.appBindingName, "Name of the app binding")
 	cmd.Flags().StringVar(&opt.appBindingNamespace, "appbinding-namespace", opt.appBindingNamespace, "Namespace of the app binding")
-	cmd.Flags().StringVar(&opt.storageSecret.Name, "storage-secret-name", opt.storageSecret.Name, "Name of the storage secret")
-	cmd.Flags().StringVar(&opt.storageSecret.Namespace, "storage-secret-namespace", opt.storageSecret.Namespace, "Namespace of the storage secret")
-
-	cmd.Flags().StringVar(&opt.setupOptions.Provider, "provider", opt.setupOptions.Provider, "Backend provider (i.e. gcs, s3, azure etc)")
-	cmd.Flags().StringVar(&opt.setupOptions.Bucket, "bucket", opt.setupOptions.Bucket, "Name of the cloud bucket/container (keep empty for local backend)")
-	cmd.Flags().StringVar(&opt.setupOptions.Endpoint, "endpoint", opt.setupOptions.Endpoint, "Endpoint for s3/s3 compatible backend or REST server URL")
-	cmd.Flags().BoolVar(&opt.setupOptions.InsecureTLS, "insecure-tls", opt.setupOptions.InsecureTLS, "InsecureTLS for TLS secure s3/s3 compatible backend")
-	cmd.Flags().StringVar(&opt.setupOptions.Region, "region", opt.setupOptions.Region, "Region for s3/s3 compatible backend")
-	cmd.Flags().StringVar(&opt.setupOptions.Path, "path", opt.setupOptions.Path, "Directory inside the bucket where backup will be stored")
-	cmd.Flags().StringVar(&opt.setupOptions.ScratchDir, "scratch-dir", opt.setupOptions.ScratchDir, "Temporary directory")
-	cmd.Flags().BoolVar(&opt.setupOptions.EnableCache, "enable-cache", opt.setupOptions.EnableCache, "Specify whether to enable caching for restic")
-	cmd.Flags().Int64Var(&opt.setupOptions.MaxConnections, "max-connections", opt.setupOptions.MaxConnections, "Specify maximum concurrent connections for GCS, Azure and B2 backend")
+	addStorageFlags(cmd, &opt)
 
 	cmd.Flags().StringVar(&opt.dumpOptions.Host, "hostname", opt.dumpOptions.Host, "Name of the host machine")
 	cmd.Flags().StringVar(&opt.dumpOptions.SourceHost, "source-hostname", opt.dumpOptions.SourceHost, "Name of the host whose data will be restored")
-	// TODO: sliceVar
-	cmd.Flags().StringVar(&opt.dumpOptions.Snapshot, "snapshot", opt.dumpOptions.Snapshot, "Snapshot to dump")
+	cmd.Flags().StringSliceVar(&opt.snapshots, "snapshot", opt.snapshots, "Snapshots to dump. Several snapshots (i.e. the snapshots of a per database backup) are restored in a single run")
+	cmd.Flags().StringVar(&opt.asOf, "as-of", opt.asOf, "Time (RFC3339) to restore the newest snapshot of the source host taken at or before, instead of the latest one")
+	cmd.Flags().StringVar(&opt.snapshotsFrom, "snapshots-from", opt.snapshotsFrom, "Restore the snapshots selected in the form host=<hostname>, which selects the snapshots of the latest backup of the host, along with the snapshots of its per database backup")
+	cmd.Flags().IntVar(&opt.maxConcurrency, "max-concurrency", opt.maxConcurrency, "Maximum number of snapshots of a per database backup to restore concurrently")
 
 	cmd.Flags().StringVar(&opt.outputDir, "output-dir", opt.outputDir, "Directory where output.json file will be written (keep empty if you don't need to write output in file)")
 	return cmd
@@ -180,30 +200,368 @@ func (opt *postgresOptions) restorePostgreSQL(targetRef api_v1beta1.TargetRef) (
 		return nil, err
 	}
 
-	// The backed up sql file contains command to alter the password of "postgres" user of current database with backed up database's
-	// password. The auth secret referred in the AppBinding contains the credential of the new database. When the restore process
-	// alter the password of current database with backed up one, the subsequent connections fail and overall database restore also fail.
-	// So, we are going to use "sed" to remove the password altering line from the sql file.
-	passwordOverwriteRemover := restic.Command{
-		Name: SedCMD,
-		Args: []any{sedArgs},
+	resticWrapper, err := restic.NewResticWrapperFromShell(opt.setupOptions, session.sh)
+	if err != nil {
+		return nil, err
 	}
 
-	// The backup process should follow the following pipeline: restic restore | sed <args> | psql -f dumpfile.sql .
-	// Add the commands to stdout pipe. The restic command will be automatically added at the beginning of this pipe.
+	if opt.multipleSnapshots() {
+		return opt.restoreSnapshots(resticWrapper, session, targetRef)
+	}
+	if len(opt.snapshots) == 1 {
+		opt.dumpOptions.Snapshot = opt.snapshots[0]
+	}
+
+	// find out the snapshot that will be restored and detect the format of the dump it holds
+	snapshot, err := opt.getSnapshot(resticWrapper)
+	if err != nil {
+		return nil, err
+	}
+	if opt.asOf != "" {
+		klog.Infof("Snapshot %s taken at %s is the newest snapshot as of %s", snapshot.ID, snapshot.Time.Format(time.RFC3339), opt.asOf)
+		opt.restoreStats.AsOf = opt.asOf
+	}
+	opt.restoreStats.Snapshot, opt.restoreStats.SnapshotTime = snapshot.ID, snapshot.Time.Format(time.RFC3339)
+	opt.dumpOptions.Snapshot = snapshot.ID
+	dumpFormat := dumpFormatOf(snapshot)
+	opt.dumpOptions.FileName = dumpFileOf(snapshot)
+	klog.Infof("Restoring %s dump from snapshot %s", dumpFormat, snapshot.ID)
+
+	opt.restoreStats.Format = dumpFormat
+	if len(opt.filter.databases) > 0 && dumpFormat != DumpFormatPlain {
+		return nil, fmt.Errorf("databases can only be selected out of a %s dump taken with %s", DumpFormatPlain, PgDumpallCMD)
+	}
+	if opt.filter.targetDatabase != "" && dumpFormat == DumpFormatPhysical {
+		return nil, fmt.Errorf("a base backup can not be restored as a different database")
+	}
+	if opt.clean != "" && dumpFormat == DumpFormatPhysical {
+		return nil, fmt.Errorf("clean modes are not applicable to base backups, they are restored into an empty data directory")
+	}
+	if opt.tableValidation && (opt.dryRun || dumpFormat == DumpFormatPhysical) {
+		return nil, fmt.Errorf("tables can not be validated in a dry run or after the restore of a base backup")
+	}
+	var size uint64
+	if dumpFormat != DumpFormatPhysical {
+		// the dump is checked against the checksum taken at backup as it is read out of the repository
+		manifests, err := readBackupManifests(resticWrapper, []restic.Snapshot{*snapshot})
+		if err != nil {
+			return nil, err
+		}
+		opt.manifest = manifests[snapshot.ID]
+		checksums, err := dumpChecksums(manifests, []restic.Snapshot{*snapshot})
+		if err != nil {
+			return nil, err
+		}
+		opt.checksum = checksums[snapshot.ID]
+		// the progress is measured against the size of the dump recorded at backup, the bytes are counted as the dump is read.
+		// The dumps taken without a manifest are measured against the size of their snapshot reported by restic instead.
+		if size = opt.manifest.dumpBytes(snapshot.ID); size == 0 {
+			if size, err = resticWrapper.GetSnapshotSize(snapshot.ID); err != nil {
+				return nil, err
+			}
+		}
+		stopProgress, err := opt.trackProgress(snapshot.ID, size)
+		if err != nil {
+			return nil, err
+		}
+		defer stopProgress()
+	}
+	if opt.dryRun {
+		return opt.dryRunRestore(resticWrapper, snapshot, dumpFormat, size, targetRef)
+	}
+	if dumpFormat == DumpFormatPhysical {
+		// a base backup is laid down as a data directory, it does not need a running database.
+		return opt.restoreBaseBackup(resticWrapper, snapshot, targetRef)
+	}
+	if opt.jobs < 1 || (opt.jobs > 1 && dumpFormat != DumpFormatDir) {
+		return nil, fmt.Errorf("invalid number of jobs %d: parallel jobs are only supported by the %s format", opt.jobs, DumpFormatDir)
+	}
+	if err = opt.validateErrorMode(snapshot, dumpFormat); err != nil {
+		return nil, err
+	}
+	opt.restoreStats.OnError = opt.onError
+	if opt.tableValidation && !opt.manifest.hasTableStats() {
+		return nil, fmt.Errorf("the rows of the tables of snapshot %s have not been counted at backup, it must be taken with --table-stats to validate its tables", shortID(snapshot.ID))
+	}
 
 	err = session.waitForDBReady(opt.waitTimeout)
 	if err != nil {
 		return nil, err
 	}
 
-	session.setUserArgs(opt.pgArgs)
+	// archives are restored into the postgres database, unless they are restored as a different database
+	restoreDB := DefaultPostgresDB
+	var swap *swapStats
+	switch {
+	case opt.swap:
+		// the dump is restored into a staging database, which replaces the live database once it has been validated
+		if swap, err = opt.prepareSwap(session, snapshot, dumpFormat); err != nil {
+			return nil, err
+		}
+		restoreDB = swap.Staging
+	case opt.filter.targetDatabase != "":
+		if err = opt.prepareTargetDatabase(session, snapshot, dumpFormat); err != nil {
+			return nil, err
+		}
+		restoreDB = opt.filter.targetDatabase
+	}
+	if opt.clean != "" {
+		if err = opt.cleanDatabases(session, snapshot, dumpFormat, restoreDB); err != nil {
+			return nil, err
+		}
+	}
+	if dumpFormat != DumpFormatPlain || opt.connectRestoreDB {
+		// pg_restore restores an archive into an existing database, like psql restores a dump that does not create it
+		if err = session.ensureDatabase(restoreDB); err != nil {
+			return nil, err
+		}
+	}
 
-	opt.dumpOptions.StdoutPipeCommands = append(opt.dumpOptions.StdoutPipeCommands, passwordOverwriteRemover, *session.cmd)
-	resticWrapper, err := restic.NewResticWrapperFromShell(opt.setupOptions, session.sh)
+	if swap != nil {
+		return opt.restoreWithSwap(resticWrapper, session, dumpFormat, swap, targetRef)
+	}
+	return opt.replayDump(resticWrapper, session, dumpFormat, restoreDB, targetRef)
+}
+
+// dryRunRestore reads the dump of the snapshot and reports what it contains, without touching the database.
+func (opt *postgresOptions) dryRunRestore(w *restic.ResticWrapper, snapshot *restic.Snapshot, dumpFormat string, size uint64, targetRef api_v1beta1.TargetRef) (*restic.RestoreOutput, error) {
+	if dumpFormat == DumpFormatPhysical {
+		return nil, fmt.Errorf("a dry run is not supported for base backups")
+	}
+	startTime := time.Now()
+	contents, err := opt.inspectDump(w, snapshot, dumpFormat, size)
+	if err != nil {
+		return nil, err
+	}
+	opt.restoreStats.DryRun = contents
+	for _, db := range contents.Databases {
+		klog.Infof("Dump holds database %q with %d schemas, %d tables and %d extensions", db.Name, len(db.Schemas), len(db.Tables), len(db.Extensions))
+	}
+	if contents.Complete != nil && !*contents.Complete {
+		klog.Warningf("Dump of snapshot %s does not end with the completion trailer, it may have been cut short", snapshot.ID)
+	}
+
+	return &restic.RestoreOutput{
+		RestoreTargetStatus: api_v1beta1.RestoreMemberStatus{
+			Ref: targetRef,
+			Stats: []api_v1beta1.HostRestoreStats{
+				{
+					Hostname: opt.dumpOptions.Host,
+					Phase:    api_v1beta1.HostRestoreSucceeded,
+					Duration: time.Since(startTime).String(),
+				},
+			},
+		},
+	}, nil
+}
+
+// replayDump restores the dump of the snapshot into the database, then validates the restored tables if requested.
+func (opt *postgresOptions) replayDump(resticWrapper *restic.ResticWrapper, session *sessionWrapper, dumpFormat, restoreDB string, targetRef api_v1beta1.TargetRef) (*restic.RestoreOutput, error) {
+	opt.restoreStats.Tables, opt.restoreStats.Schemas = opt.filter.tables, opt.filter.schemas
+	selector := newObjectSelector(opt.filter.tables, opt.filter.schemas)
+	var (
+		restoreOutput *restic.RestoreOutput
+		err           error
+	)
+	if dumpFormat == DumpFormatDir || (dumpFormat == DumpFormatCustom && selector != nil) {
+		restoreOutput, err = opt.restoreArchive(resticWrapper, session, restoreDB, dumpFormat, selector, targetRef)
+	} else {
+		restoreOutput, err = opt.streamDump(resticWrapper, session, dumpFormat, restoreDB, selector, targetRef)
+	}
+	if err != nil || !opt.tableValidation {
+		return restoreOutput, err
+	}
+	err = runPhase(&opt.restoreStats.Phases, "validate-tables", func() error {
+		return opt.validateTables(session, dumpFormat, restoreDB)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return restoreOutput, nil
+}
+
+// streamDump restores the dump while it is being read out of the repository.
+func (opt *postgresOptions) streamDump(resticWrapper *restic.ResticWrapper, session *sessionWrapper, dumpFormat, restoreDB string, selector *objectSelector, targetRef api_v1beta1.TargetRef) (*restic.RestoreOutput, error) {
+	// the errors of psql and pg_restore in the pipeline are written into a report, which tells the failed statement
+	reportFile := filepath.Join(opt.setupOptions.ScratchDir, "restore-errors.json")
+	if dumpFormat == DumpFormatPlain && (len(opt.filter.databases) > 0 || selector != nil) {
+		opt.restoreStats.Databases = opt.filter.databases
+	}
+
+	verifyChecksum, err := addChecksumStage(&opt.dumpOptions, opt.checksum, filepath.Join(opt.setupOptions.ScratchDir, "restore-checksum.json"))
+	if err != nil {
+		return nil, err
+	}
+	stages, err := opt.restoreStages(session, dumpFormat, restoreDB, reportFile)
 	if err != nil {
 		return nil, err
 	}
+	// Add the commands to stdout pipe. The restic command will be automatically added at the beginning of this pipe.
+	opt.dumpOptions.StdoutPipeCommands = append(opt.dumpOptions.StdoutPipeCommands, stages...)
 	// Run dump
-	return resticWrapper.Dump(opt.dumpOptions, targetRef)
+	restoreOutput, err := resticWrapper.Dump(opt.dumpOptions, targetRef)
+	report, reportErr := readErrorReport(reportFile)
+	if err == nil {
+		// the pipeline has succeeded, so run-restore must have written its report
+		err = reportErr
+	}
+	if err = opt.applyErrorReport(restoreOutput, report, err); err != nil {
+		return restoreOutput, err
+	}
+	// the statements have already been replayed, but a dump that differs from the one taken at backup fails the restore
+	if err = verifyChecksum(); err != nil {
+		return nil, err
+	}
+	opt.restoreStats.Checksum = opt.checksum
+	return restoreOutput, nil
+}
+
+// restoreStages returns the stages of the pipeline that restore a dump streamed out of the repository.
+// The errors they report are written into the report file, which tells the failed statement.
+func (opt *postgresOptions) restoreStages(session *sessionWrapper, dumpFormat, restoreDB, reportFile string) ([]restic.Command, error) {
+	if dumpFormat == DumpFormatCustom {
+		// The custom format archive is restored by pg_restore. It must be connected to a database,
+		// otherwise it just writes the SQL script to the stdout.
+		// The restore process should follow the following pipeline: restic dump | stash-postgres run-restore -- pg_restore --dbname=<db> .
+		pgRestore := restic.Command{
+			Name: PgArchiveRestore,
+			Args: append(session.newArgs(), fmt.Sprintf("--dbname=%s", restoreDB)),
+		}
+		modeArgs, err := opt.errorModeArgs(PgArchiveRestore)
+		if err != nil {
+			return nil, err
+		}
+		pgRestore.Args = append(pgRestore.Args, modeArgs...)
+		pgRestore.Args = appendUserArgs(pgRestore.Args, opt.pgArgs)
+		stage, err := withErrorReport(pgRestore, reportFile)
+		if err != nil {
+			return nil, err
+		}
+		return []restic.Command{stage}, nil
+	}
+
+	// The backed up sql file contains command to alter the password of the restoring user with backed up database's password.
+	// The auth secret referred in the AppBinding contains the credential of the new database. When the restore process
+	// alter the password of current database with backed up one, the subsequent connections fail and overall database restore also fail.
+	// So, the dump is passed through the SQL filter, which drops the password change of the restoring user along with
+	// the changes requested by the user. The password of the "postgres" user is kept as well, like it always has been.
+	filter := opt.filter
+	filter.passwordRoles = append(slices.Clone(opt.filter.passwordRoles), DefaultPostgresUser, session.user)
+	sqlFilter, err := filter.command()
+	if err != nil {
+		return nil, err
+	}
+
+	// psql reports the SQLSTATE and the failed statement along with the line of the error. The filter keeps the lines
+	// of the dropped statements as empty lines, so the line is the same as the line of the dump.
+	psql := restic.Command{
+		Name: PgRestoreCMD,
+		Args: session.newArgs(),
+	}
+	modeArgs, err := opt.errorModeArgs(PgRestoreCMD)
+	if err != nil {
+		return nil, err
+	}
+	psql.Args = append(psql.Args, modeArgs...)
+	if opt.connectRestoreDB {
+		psql.Args = append(psql.Args, fmt.Sprintf("--dbname=%s", restoreDB))
+	}
+	psql.Args = append(psql.Args, "--set=VERBOSITY=verbose", "--echo-errors")
+	psql.Args = appendUserArgs(psql.Args, opt.pgArgs)
+
+	// The restore process should follow the following pipeline: restic dump | stash-postgres filter-sql <args> | stash-postgres run-restore -- psql .
+	stage, err := withErrorReport(psql, reportFile)
+	if err != nil {
+		return nil, err
+	}
+	return []restic.Command{sqlFilter, stage}, nil
+}
+
+// restoreArchive downloads an archive into the scratch directory, then restores it with pg_restore.
+// A directory format archive is extracted out of its tar archive and restored with parallel jobs.
+// pg_restore has to read the archive twice to restore the selected objects only, once to list its entries,
+// so a custom format archive is downloaded as well when the objects to restore have been selected.
+func (opt *postgresOptions) restoreArchive(w *restic.ResticWrapper, session *sessionWrapper, database, dumpFormat string, selector *objectSelector, targetRef api_v1beta1.TargetRef) (*restic.RestoreOutput, error) {
+	startTime := time.Now()
+
+	dumpDir := filepath.Join(opt.setupOptions.ScratchDir, "dump")
+	if err := os.RemoveAll(dumpDir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dumpDir, 0o755); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dumpDir)
+
+	verifyChecksum, err := addChecksumStage(&opt.dumpOptions, opt.checksum, filepath.Join(opt.setupOptions.ScratchDir, "restore-checksum.json"))
+	if err != nil {
+		return nil, err
+	}
+	archive := dumpDir
+	if dumpFormat == DumpFormatDir {
+		// The download should follow the following pipeline: restic dump | tar -x -f - -C <dump dir> .
+		opt.dumpOptions.StdoutPipeCommands = append(opt.dumpOptions.StdoutPipeCommands, restic.Command{
+			Name: TarCMD,
+			Args: []any{"-x", "-f", "-", "-C", dumpDir},
+		})
+	} else {
+		// The download should follow the following pipeline: restic dump | dd of=<dump dir>/dumpfile.dump .
+		archive = filepath.Join(dumpDir, PgCustomDumpFile)
+		opt.dumpOptions.StdoutPipeCommands = append(opt.dumpOptions.StdoutPipeCommands, restic.Command{
+			Name: "dd",
+			Args: []any{fmt.Sprintf("of=%s", archive)},
+		})
+	}
+	var restoreOutput *restic.RestoreOutput
+	err = runPhase(&opt.restoreStats.Phases, "download", func() error {
+		var err error
+		restoreOutput, err = w.Dump(opt.dumpOptions, targetRef)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the archive is only restored if it is the one taken at backup
+	if err = verifyChecksum(); err != nil {
+		return nil, err
+	}
+	opt.restoreStats.Checksum = opt.checksum
+
+	session.cmd.Name = PgArchiveRestore
+	session.cmd.Args = append(session.cmd.Args, fmt.Sprintf("--dbname=%s", database))
+	if dumpFormat == DumpFormatDir {
+		session.cmd.Args = append(session.cmd.Args, "--format=directory", fmt.Sprintf("--jobs=%d", opt.jobs))
+		opt.restoreStats.Jobs = opt.jobs
+	}
+	modeArgs, err := opt.errorModeArgs(PgArchiveRestore)
+	if err != nil {
+		return nil, err
+	}
+	session.cmd.Args = append(session.cmd.Args, modeArgs...)
+	if selector != nil {
+		listFile := filepath.Join(opt.setupOptions.ScratchDir, "restore.list")
+		defer os.Remove(listFile)
+		if err := session.writeArchiveRestoreList(archive, listFile, selector); err != nil {
+			return nil, err
+		}
+		session.cmd.Args = append(session.cmd.Args, fmt.Sprintf("--use-list=%s", listFile))
+	}
+	session.setUserArgs(opt.pgArgs)
+	session.cmd.Args = append(session.cmd.Args, archive)
+	// pg_restore reports the archive entry of the failed statement
+	parser := &restoreErrorParser{}
+	session.sh.Stderr = io.MultiWriter(os.Stderr, parser)
+	err = runPhase(&opt.restoreStats.Phases, "restore", func() error {
+		return session.sh.Command(session.cmd.Name, session.cmd.Args...).Run()
+	})
+	session.sh.Stderr = os.Stderr
+	if err = opt.applyErrorReport(restoreOutput, parser.result(), parser.outcome(err)); err != nil {
+		return nil, err
+	}
+
+	// the dump only took the download into account, so update the duration with the total time taken
+	for i := range restoreOutput.RestoreTargetStatus.Stats {
+		restoreOutput.RestoreTargetStatus.Stats[i].Duration = time.Since(startTime).String()
+	}
+	return restoreOutput, nil
 }
@@ -43,6 +43,17 @@ func NewRootCmd() *cobra.Command {
 	rootCmd.AddCommand(v.NewCmdVersion())
 	rootCmd.AddCommand(NewCmdBackup())
 	rootCmd.AddCommand(NewCmdRestore())
+	rootCmd.AddCommand(NewCmdArchiveWAL())
+	rootCmd.AddCommand(NewCmdRestoreWAL())
+	rootCmd.AddCommand(NewCmdRestorePITR())
+	rootCmd.AddCommand(NewCmdVerify())
+	rootCmd.AddCommand(NewCmdListSnapshots())
+	rootCmd.AddCommand(NewCmdFilterSQL())
+	rootCmd.AddCommand(NewCmdRunRestore())
+	rootCmd.AddCommand(NewCmdInspectDump())
+	rootCmd.AddCommand(NewCmdCheckDump())
+	rootCmd.AddCommand(NewCmdProgress())
+	rootCmd.AddCommand(NewCmdChecksum())
 
 	return rootCmd
 }
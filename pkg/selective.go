@@ -0,0 +1,335 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// pg_dump writes a comment naming the object before each of its entries in a plain dump.
+var entryMarkerRegex = regexp.MustCompile(`^-- (?:Data for )?Name: (.*); Type: (.*); Schema: (.*); Owner: ([^;]*)(?:; Tablespace: .*)?\s*$`)
+
+// tocEntryTypes are the types of the entries of a pg_dump archive consisting of multiple words.
+var tocEntryTypes = []string{
+	"CHECK CONSTRAINT", "DATABASE PROPERTIES", "DEFAULT ACL", "FK CONSTRAINT", "FOREIGN TABLE", "INDEX ATTACH",
+	"MATERIALIZED VIEW DATA", "MATERIALIZED VIEW", "ROW SECURITY", "SECURITY LABEL", "SEQUENCE OWNED BY",
+	"SEQUENCE SET", "TABLE ATTACH", "TABLE DATA",
+}
+
+// databaseEntryTypes are the entries that set up the database itself, they are restored along with any object.
+var databaseEntryTypes = map[string]bool{
+	"DATABASE":            true,
+	"DATABASE PROPERTIES": true,
+	"ENCODING":            true,
+	"STDSTRINGS":          true,
+	"SEARCHPATH":          true,
+}
+
+// tocEntry describes an object of a dump, as listed by "pg_restore --list" or by the comments of a plain dump.
+type tocEntry struct {
+	desc   string
+	schema string
+	name   string
+	// table is the table an index belongs to. It is not listed, so it is found from the definition of the index.
+	table string
+}
+
+// tableOf returns the table (or the view or the sequence) the entry belongs to.
+func (e tocEntry) tableOf() string {
+	switch e.desc {
+	case "TABLE", "TABLE DATA", "TABLE ATTACH", "FOREIGN TABLE", "VIEW", "MATERIALIZED VIEW", "MATERIALIZED VIEW DATA",
+		"SEQUENCE", "SEQUENCE SET", "SEQUENCE OWNED BY", "ROW SECURITY":
+		return e.name
+	case "CONSTRAINT", "FK CONSTRAINT", "CHECK CONSTRAINT", "TRIGGER", "DEFAULT", "POLICY", "RULE":
+		// the name of these entries is "<table> <name>"
+		table, _, _ := strings.Cut(e.name, " ")
+		return table
+	case "COMMENT", "ACL", "SECURITY LABEL":
+		// the name of these entries is "<type> <name>", i.e. "TABLE orders" or "COLUMN orders.id"
+		for _, kind := range []string{"TABLE ", "FOREIGN TABLE ", "MATERIALIZED VIEW ", "VIEW ", "SEQUENCE "} {
+			if strings.HasPrefix(e.name, kind) {
+				return strings.TrimPrefix(e.name, kind)
+			}
+		}
+		if column, ok := strings.CutPrefix(e.name, "COLUMN "); ok {
+			table, _, _ := strings.Cut(column, ".")
+			return table
+		}
+	case "INDEX":
+		return e.table
+	}
+	return ""
+}
+
+// schemaOf returns the schema the entry is about, i.e. the schema a CREATE SCHEMA creates.
+func (e tocEntry) schemaOf() string {
+	if e.desc == "SCHEMA" {
+		return e.name
+	}
+	if e.desc == "COMMENT" || e.desc == "ACL" || e.desc == "SECURITY LABEL" {
+		if schema, ok := strings.CutPrefix(e.name, "SCHEMA "); ok {
+			return schema
+		}
+	}
+	return e.schema
+}
+
+type tablePattern struct {
+	schema, table *regexp.Regexp
+}
+
+// objectSelector selects the objects to restore by the name of their table or their schema.
+type objectSelector struct {
+	tables  []tablePattern
+	schemas []*regexp.Regexp
+}
+
+// newObjectSelector builds a selector out of the --table and --schema patterns. The patterns may contain the
+// "*" and "?" wildcards. A table pattern without a schema matches the tables of any schema.
+func newObjectSelector(tables, schemas []string) *objectSelector {
+	if len(tables) == 0 && len(schemas) == 0 {
+		return nil
+	}
+	s := &objectSelector{}
+	for _, pattern := range tables {
+		schema, table, ok := strings.Cut(pattern, ".")
+		if !ok {
+			schema, table = "*", pattern
+		}
+		s.tables = append(s.tables, tablePattern{schema: wildcardRegex(schema), table: wildcardRegex(table)})
+	}
+	for _, pattern := range schemas {
+		s.schemas = append(s.schemas, wildcardRegex(pattern))
+	}
+	return s
+}
+
+func wildcardRegex(pattern string) *regexp.Regexp {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(expr)
+	return regexp.MustCompile("^" + expr + "$")
+}
+
+// selects checks whether the entry has to be restored.
+func (s *objectSelector) selects(e tocEntry) bool {
+	if databaseEntryTypes[e.desc] {
+		return true
+	}
+	schema := e.schemaOf()
+	for _, pattern := range s.schemas {
+		if pattern.MatchString(schema) {
+			return true
+		}
+	}
+	table := e.tableOf()
+	if table == "" {
+		return false
+	}
+	for _, pattern := range s.tables {
+		if pattern.schema.MatchString(e.schema) && pattern.table.MatchString(table) {
+			return true
+		}
+	}
+	return false
+}
+
+// enterEntry records that the statements of an entry of a plain dump have started.
+func (f *sqlFilter) enterEntry(e tocEntry) {
+	f.entry = &e
+	f.entrySelected = f.selector.selects(e)
+	if f.entrySelected && !databaseEntryTypes[e.desc] {
+		f.selected = true
+	}
+}
+
+// keepEntry checks whether the statements of the current entry have to be restored.
+// The statements that do not belong to any entry (i.e. the settings of the session) are always kept.
+func (f *sqlFilter) keepEntry() bool {
+	return f.selector == nil || f.entry == nil || f.entrySelected
+}
+
+// parseEntryMarker parses the comment pg_dump writes before an entry of a plain dump.
+func parseEntryMarker(line []byte) (tocEntry, bool) {
+	m := entryMarkerRegex.FindSubmatch(bytes.TrimRight(line, "\r\n"))
+	if m == nil {
+		return tocEntry{}, false
+	}
+	return tocEntry{desc: string(m[2]), schema: string(m[3]), name: string(m[1])}, true
+}
+
+// parseTOCLine parses an entry listed by "pg_restore --list", i.e. "215; 1259 16386 TABLE public orders postgres".
+func parseTOCLine(line string) (tocEntry, bool) {
+	_, rest, ok := strings.Cut(line, "; ")
+	if !ok || strings.HasPrefix(line, ";") {
+		return tocEntry{}, false
+	}
+	// skip the catalog table and the object id
+	fields := strings.SplitN(strings.TrimSpace(rest), " ", 3)
+	if len(fields) < 3 {
+		return tocEntry{}, false
+	}
+	rest = fields[2]
+
+	var e tocEntry
+	for _, desc := range tocEntryTypes {
+		if strings.HasPrefix(rest, desc+" ") {
+			e.desc = desc
+			break
+		}
+	}
+	if e.desc == "" {
+		e.desc, _, _ = strings.Cut(rest, " ")
+	}
+	rest = strings.TrimPrefix(rest, e.desc+" ")
+
+	// the rest is "<schema> <name> <owner>", where the name may contain spaces
+	schema, rest, ok := strings.Cut(rest, " ")
+	if !ok {
+		return tocEntry{}, false
+	}
+	e.schema = schema
+	e.name = rest
+	if i := strings.LastIndex(rest, " "); i >= 0 {
+		e.name = rest[:i]
+	}
+	return e, true
+}
+
+// indexTable returns the schema and the table a CREATE INDEX statement is on.
+func indexTable(tokens []sqlToken) (schema, table string, ok bool) {
+	if len(tokens) < 2 || !tokens[0].is("create") {
+		return "", "", false
+	}
+	for i := 1; i < len(tokens); i++ {
+		if !tokens[i].is("on") {
+			continue
+		}
+		i++
+		if i < len(tokens) && tokens[i].is("only") {
+			i++
+		}
+		if i+2 < len(tokens) && tokens[i+1].is(".") {
+			return tokens[i].identifier(), tokens[i+2].identifier(), true
+		}
+		if i < len(tokens) {
+			return "", tokens[i].identifier(), true
+		}
+		break
+	}
+	return "", "", false
+}
+
+// indexTables maps the indexes ("<schema>.<index>") defined by a SQL script to their tables.
+func indexTables(r io.Reader) (map[string]string, error) {
+	tables := make(map[string]string)
+	s := newSQLScanner(r)
+	for {
+		chunk, err := s.next()
+		if err == io.EOF {
+			return tables, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if chunk.kind != sqlChunkStatement {
+			continue
+		}
+		tokens := tokenizeSQL(chunk.text)
+		schema, table, ok := indexTable(tokens)
+		if !ok {
+			continue
+		}
+		// CREATE [UNIQUE] INDEX <name> ON ...
+		for i := 1; i+1 < len(tokens); i++ {
+			if tokens[i].is("index") {
+				tables[schema+"."+tokens[i+1].identifier()] = table
+				break
+			}
+		}
+	}
+}
+
+// writeRestoreList writes the list of the selected entries of an archive, to be used by "pg_restore --use-list".
+// The entries that are not selected are commented out.
+func writeRestoreList(path string, toc string, selector *objectSelector, indexes map[string]string) (int, error) {
+	var (
+		buf      bytes.Buffer
+		selected int
+	)
+	for _, line := range strings.Split(strings.TrimRight(toc, "\n"), "\n") {
+		e, ok := parseTOCLine(line)
+		if ok && e.desc == "INDEX" {
+			e.table = indexes[e.schema+"."+e.name]
+		}
+		if ok && selector.selects(e) {
+			if !databaseEntryTypes[e.desc] {
+				selected++
+			}
+		} else if line != "" && !strings.HasPrefix(line, ";") {
+			line = ";" + line
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	if selected == 0 {
+		return 0, fmt.Errorf("no object of the archive matches the given tables and schemas")
+	}
+	return selected, os.WriteFile(path, buf.Bytes(), 0o600)
+}
+
+// writeArchiveRestoreList lists the entries of an archive and writes the list of the selected ones. The list does
+// not show the table of an index, so the definitions of the indexes are extracted out of the archive to find them.
+func (session *sessionWrapper) writeArchiveRestoreList(archive, listFile string, selector *objectSelector) error {
+	toc, err := session.sh.Command(PgArchiveRestore, "--list", archive).Output()
+	if err != nil {
+		return err
+	}
+
+	var indexList strings.Builder
+	for _, line := range strings.Split(string(toc), "\n") {
+		if e, ok := parseTOCLine(line); ok && e.desc == "INDEX" {
+			indexList.WriteString(line + "\n")
+		}
+	}
+	indexes := make(map[string]string)
+	if indexList.Len() > 0 {
+		if err := os.WriteFile(listFile, []byte(indexList.String()), 0o600); err != nil {
+			return err
+		}
+		definitions, err := session.sh.Command(PgArchiveRestore, fmt.Sprintf("--use-list=%s", listFile), "--file=-", archive).Output()
+		if err != nil {
+			return err
+		}
+		if indexes, err = indexTables(bytes.NewReader(definitions)); err != nil {
+			return err
+		}
+	}
+
+	selected, err := writeRestoreList(listFile, string(toc), selector, indexes)
+	if err != nil {
+		return err
+	}
+	klog.Infof("Restoring %d selected entries of the archive", selected)
+	return nil
+}
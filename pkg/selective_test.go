@@ -0,0 +1,196 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTOCLine(t *testing.T) {
+	tests := []struct {
+		in     string
+		want   tocEntry
+		wantOK bool
+	}{
+		{
+			in:     "215; 1259 16386 TABLE public orders postgres",
+			want:   tocEntry{desc: "TABLE", schema: "public", name: "orders"},
+			wantOK: true,
+		},
+		{
+			in:     "3340; 0 16386 TABLE DATA public orders postgres",
+			want:   tocEntry{desc: "TABLE DATA", schema: "public", name: "orders"},
+			wantOK: true,
+		},
+		{
+			in:     "3190; 2606 16390 CONSTRAINT public orders orders_pkey postgres",
+			want:   tocEntry{desc: "CONSTRAINT", schema: "public", name: "orders orders_pkey"},
+			wantOK: true,
+		},
+		{
+			in:     "3341; 0 0 COMMENT public COLUMN orders.id postgres",
+			want:   tocEntry{desc: "COMMENT", schema: "public", name: "COLUMN orders.id"},
+			wantOK: true,
+		},
+		{in: ";"},
+		{in: "; Archive created at 2024-01-01 00:00:00 UTC"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, ok := parseTOCLine(tt.in)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("got (%+v, %v), want (%+v, %v)", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestParseEntryMarker(t *testing.T) {
+	tests := []struct {
+		in     string
+		want   tocEntry
+		wantOK bool
+	}{
+		{
+			in:     "-- Name: orders; Type: TABLE; Schema: public; Owner: app\n",
+			want:   tocEntry{desc: "TABLE", schema: "public", name: "orders"},
+			wantOK: true,
+		},
+		{
+			in:     "-- Data for Name: orders; Type: TABLE DATA; Schema: public; Owner: app; Tablespace: \n",
+			want:   tocEntry{desc: "TABLE DATA", schema: "public", name: "orders"},
+			wantOK: true,
+		},
+		{in: "-- PostgreSQL database dump\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, ok := parseEntryMarker([]byte(tt.in))
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("got (%+v, %v), want (%+v, %v)", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestObjectSelector(t *testing.T) {
+	tests := []struct {
+		name    string
+		tables  []string
+		schemas []string
+		entry   tocEntry
+		want    bool
+	}{
+		{name: "table", tables: []string{"orders"}, entry: tocEntry{desc: "TABLE", schema: "public", name: "orders"}, want: true},
+		{name: "table data", tables: []string{"orders"}, entry: tocEntry{desc: "TABLE DATA", schema: "sales", name: "orders"}, want: true},
+		{name: "other table", tables: []string{"orders"}, entry: tocEntry{desc: "TABLE", schema: "public", name: "users"}},
+		{name: "qualified table", tables: []string{"sales.orders"}, entry: tocEntry{desc: "TABLE", schema: "public", name: "orders"}},
+		{name: "wildcard", tables: []string{"sales.ord*"}, entry: tocEntry{desc: "TABLE", schema: "sales", name: "orders_2024"}, want: true},
+		{name: "single character wildcard", tables: []string{"t?"}, entry: tocEntry{desc: "TABLE", schema: "public", name: "t10"}},
+		{name: "constraint", tables: []string{"orders"}, entry: tocEntry{desc: "FK CONSTRAINT", schema: "public", name: "orders orders_user_fkey"}, want: true},
+		{name: "column comment", tables: []string{"orders"}, entry: tocEntry{desc: "COMMENT", schema: "public", name: "COLUMN orders.id"}, want: true},
+		{name: "index", tables: []string{"orders"}, entry: tocEntry{desc: "INDEX", schema: "public", name: "orders_idx", table: "orders"}, want: true},
+		{name: "schema", schemas: []string{"sales"}, entry: tocEntry{desc: "SCHEMA", schema: "-", name: "sales"}, want: true},
+		{name: "object of a schema", schemas: []string{"sales"}, entry: tocEntry{desc: "FUNCTION", schema: "sales", name: "total()"}, want: true},
+		{name: "database entry", tables: []string{"orders"}, entry: tocEntry{desc: "ENCODING", schema: "-", name: "ENCODING"}, want: true},
+		{name: "function", tables: []string{"orders"}, entry: tocEntry{desc: "FUNCTION", schema: "public", name: "orders()"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newObjectSelector(tt.tables, tt.schemas).selects(tt.entry); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIndexTables(t *testing.T) {
+	script := "CREATE INDEX orders_idx ON public.orders USING btree (id);\n" +
+		"CREATE UNIQUE INDEX \"Users_idx\" ON ONLY sales.\"Users\" USING btree (id);\n" +
+		"CREATE TABLE public.t (id int);\n"
+	got, err := indexTables(strings.NewReader(script))
+	if err != nil {
+		t.Fatalf("failed to read the indexes: %v", err)
+	}
+	want := map[string]string{"public.orders_idx": "orders", "sales.Users_idx": "Users"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for index, table := range want {
+		if got[index] != table {
+			t.Errorf("index %s: got table %q, want %q", index, got[index], table)
+		}
+	}
+}
+
+func TestWriteRestoreList(t *testing.T) {
+	toc := ";\n; Archive created at 2024-01-01 00:00:00 UTC\n" +
+		"3300; 0 0 ENCODING - ENCODING \n" +
+		"215; 1259 16386 TABLE public orders postgres\n" +
+		"216; 1259 16390 TABLE public users postgres\n" +
+		"3190; 1259 16400 INDEX public orders_idx postgres\n" +
+		"3340; 0 16386 TABLE DATA public orders postgres\n" +
+		"3341; 0 16390 TABLE DATA public users postgres\n"
+	indexes := map[string]string{"public.orders_idx": "orders"}
+
+	tests := []struct {
+		name    string
+		tables  []string
+		want    int
+		wantErr bool
+	}{
+		{name: "selected table", tables: []string{"orders"}, want: 3},
+		{name: "all tables", tables: []string{"*"}, want: 5},
+		{name: "no table", tables: []string{"missing"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "restore.list")
+			got, err := writeRestoreList(path, toc, newObjectSelector(tt.tables, nil), indexes)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error for a list without any selected entry")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to write the list: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %d selected entries, want %d", got, tt.want)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+			var listed int
+			for _, line := range lines {
+				if !strings.HasPrefix(line, ";") {
+					listed++
+				}
+			}
+			// the ENCODING entry is listed along with the selected entries
+			if listed != tt.want+1 {
+				t.Errorf("got %d listed entries, want %d:\n%s", listed, tt.want+1, data)
+			}
+		})
+	}
+}
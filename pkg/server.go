@@ -0,0 +1,114 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	shell "gomodules.xyz/go-sh"
+	"k8s.io/klog/v2"
+)
+
+const (
+	PgCtlCMD = "pg_ctl"
+
+	localServerHBA = "local all all trust\n"
+)
+
+// localServer is a throwaway postgres server running on a data directory inside the restore pod.
+// It does not listen on TCP, the clients connect through a unix socket inside the scratch directory.
+type localServer struct {
+	dataDir   string
+	socketDir string
+	hbaFile   string
+	logFile   string
+	user      string
+	sh        *shell.Session
+}
+
+func newLocalServer(dataDir, scratchDir, user string) *localServer {
+	return &localServer{
+		dataDir:   dataDir,
+		socketDir: filepath.Join(scratchDir, "socket"),
+		hbaFile:   filepath.Join(scratchDir, "pg_hba.conf"),
+		logFile:   filepath.Join(scratchDir, "postgres.log"),
+		user:      user,
+		sh:        shell.NewSession(),
+	}
+}
+
+// start starts the server and waits until it accepts connections. The authentication settings of the
+// data directory are replaced, so that the local clients can connect without password.
+func (s *localServer) start(waitTimeout int32) error {
+	if err := os.MkdirAll(s.socketDir, 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.hbaFile, []byte(localServerHBA), 0o600); err != nil {
+		return err
+	}
+	klog.Infof("Starting local postgres server on %s", s.dataDir)
+	options := fmt.Sprintf("-c listen_addresses='' -c unix_socket_directories='%s' -c hba_file='%s'", s.socketDir, s.hbaFile)
+	return s.sh.Command(PgCtlCMD, "start",
+		fmt.Sprintf("--pgdata=%s", s.dataDir),
+		fmt.Sprintf("--log=%s", s.logFile),
+		fmt.Sprintf("--timeout=%d", waitTimeout),
+		fmt.Sprintf("--options=%s", options),
+		"--wait",
+	).Run()
+}
+
+// stop shuts the server down gracefully and waits until it has stopped.
+func (s *localServer) stop() error {
+	klog.Infof("Stopping local postgres server on %s", s.dataDir)
+	return s.sh.Command(PgCtlCMD, "stop", fmt.Sprintf("--pgdata=%s", s.dataDir), "--mode=fast", "--wait").Run()
+}
+
+// running reports whether the server is still running.
+func (s *localServer) running() bool {
+	return s.sh.Command(PgCtlCMD, "status", fmt.Sprintf("--pgdata=%s", s.dataDir)).Run() == nil
+}
+
+// newSession returns a session that connects to the server through its socket.
+func (s *localServer) newSession(cmd string) *sessionWrapper {
+	session := &sessionWrapper{
+		sh:  s.sh,
+		cmd: &restic.Command{Name: cmd},
+	}
+	session.addConnectionArgs(
+		fmt.Sprintf("--username=%s", s.user),
+		fmt.Sprintf("--host=%s", s.socketDir),
+	)
+	return session
+}
+
+// logTail returns the last lines of the server log, which usually explain why the server has failed.
+func (s *localServer) logTail(lines int) string {
+	data, err := os.ReadFile(s.logFile)
+	if err != nil {
+		return ""
+	}
+	parts := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(parts) > lines {
+		parts = parts[len(parts)-lines:]
+	}
+	return strings.Join(parts, "\n")
+}
@@ -0,0 +1,85 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"time"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+// getSnapshot returns the snapshot that is going to be restored. If no snapshot has been specified,
+// the latest snapshot of the source host is used, or the newest one taken at or before the --as-of time.
+func (opt *postgresOptions) getSnapshot(w *restic.ResticWrapper) (*restic.Snapshot, error) {
+	asOf, err := opt.asOfTime()
+	if err != nil {
+		return nil, err
+	}
+	var snapshotIDs []string
+	if opt.dumpOptions.Snapshot != "" {
+		snapshotIDs = append(snapshotIDs, opt.dumpOptions.Snapshot)
+	}
+	snapshots, err := w.ListSnapshots(snapshotIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	sourceHost := opt.dumpOptions.SourceHost
+	if sourceHost == "" {
+		sourceHost = opt.dumpOptions.Host
+	}
+
+	var latest *restic.Snapshot
+	for i := range snapshots {
+		// a specific snapshot has been requested, so the host does not matter
+		if len(snapshotIDs) == 0 && snapshots[i].Hostname != sourceHost {
+			continue
+		}
+		if !asOf.IsZero() && snapshots[i].Time.After(asOf) {
+			continue
+		}
+		if latest == nil || snapshots[i].Time.After(latest.Time) {
+			latest = &snapshots[i]
+		}
+	}
+	if latest == nil {
+		if len(snapshotIDs) != 0 {
+			return nil, fmt.Errorf("snapshot %s not found", opt.dumpOptions.Snapshot)
+		}
+		if !asOf.IsZero() {
+			return nil, fmt.Errorf("no snapshot found for host %s taken at or before %s", sourceHost, opt.asOf)
+		}
+		return nil, fmt.Errorf("no snapshot found for host %s", sourceHost)
+	}
+	return latest, nil
+}
+
+// asOfTime parses the --as-of time. It is zero if no time has been given.
+func (opt *postgresOptions) asOfTime() (time.Time, error) {
+	if opt.asOf == "" {
+		return time.Time{}, nil
+	}
+	if len(opt.snapshots) > 0 || opt.dumpOptions.Snapshot != "" {
+		return time.Time{}, fmt.Errorf("--as-of can not be used along with --snapshot")
+	}
+	t, err := time.Parse(time.RFC3339, opt.asOf)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid as-of time %q: %v", opt.asOf, err)
+	}
+	return t, nil
+}
@@ -0,0 +1,774 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+const FilterSQLCMD = "filter-sql"
+
+// sqlFilterOptions configures the rules applied on the statements of a plain SQL dump while it is being restored.
+type sqlFilterOptions struct {
+	// dropPasswords drops the password changes of all the roles
+	dropPasswords bool
+	// passwordRoles are the roles whose password changes are dropped
+	passwordRoles []string
+	// skipRoles are the roles whose statements are dropped altogether
+	skipRoles []string
+	// ownerMap maps the owners of the objects to new owners
+	ownerMap map[string]string
+	// databases are the databases to restore out of a pg_dumpall dump
+	databases []string
+	// includeGlobals specifies whether to restore the globals (i.e. roles and tablespaces) along with the selected databases
+	includeGlobals bool
+	// targetDatabase is the name the selected database is restored as
+	targetDatabase string
+	// tables and schemas are the patterns of the tables and the schemas to restore
+	tables  []string
+	schemas []string
+	// existingDatabases are the databases that are kept by the clean mode, so they must not be created
+	existingDatabases []string
+}
+
+func NewCmdFilterSQL() *cobra.Command {
+	var opt sqlFilterOptions
+
+	cmd := &cobra.Command{
+		Use:               FilterSQLCMD,
+		Short:             "Filters a plain SQL dump read from the stdin",
+		Long:              `Filters a plain SQL dump read from the stdin and writes the result into the stdout. It is used by restore-pg as a stage of the restore pipeline.`,
+		Hidden:            true,
+		DisableAutoGenTag: true,
+		SilenceUsage:      true,
+		Args:              cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			out := bufio.NewWriterSize(os.Stdout, 1<<20)
+			if err := opt.newSQLFilter().filter(os.Stdin, out); err != nil {
+				return err
+			}
+			return out.Flush()
+		},
+	}
+
+	opt.addFlags(cmd.Flags())
+	cmd.Flags().StringSliceVar(&opt.passwordRoles, "drop-password-of", opt.passwordRoles, "Roles whose password changes will be dropped")
+	cmd.Flags().StringSliceVar(&opt.existingDatabases, "existing-database", opt.existingDatabases, "Databases that already exist, whose CREATE DATABASE statements will be dropped")
+	return cmd
+}
+
+// addFlags registers the flags of the rules that can be configured by the user.
+func (opt *sqlFilterOptions) addFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(&opt.dropPasswords, "drop-passwords", opt.dropPasswords, "Specify whether to drop the password changes of all the roles from a plain SQL dump. The password of the restoring user is never changed")
+	fs.StringSliceVar(&opt.skipRoles, "skip-role", opt.skipRoles, "Roles whose statements (i.e. CREATE, ALTER and COMMENT ON ROLE) will be dropped from a plain SQL dump")
+	fs.StringToStringVar(&opt.ownerMap, "owner-map", opt.ownerMap, "Owners of the objects in a plain SQL dump to rewrite, in the form old=new")
+	fs.StringSliceVar(&opt.databases, "database", opt.databases, "Databases to restore out of a pg_dumpall dump (keep empty to restore the whole dump)")
+	fs.StringVar(&opt.targetDatabase, "target-database", opt.targetDatabase, "Name of the database the dump will be restored as. A plain dump must hold a single database, or the database must be selected with --database. A plain dump taken by pg_dump without --create is restored into the target database, which is created if it does not exist")
+	fs.StringSliceVar(&opt.tables, "table", opt.tables, "Tables to restore along with their data, in the form schema.table (wildcards * and ? are allowed)")
+	fs.StringSliceVar(&opt.schemas, "schema", opt.schemas, "Schemas to restore along with all of their objects (wildcards * and ? are allowed)")
+	fs.BoolVar(&opt.includeGlobals, "include-globals", opt.includeGlobals, "Specify whether to restore the globals (i.e. roles and tablespaces) along with the databases selected with --database")
+}
+
+// command returns the pipe stage that filters the dump with these options.
+func (opt *sqlFilterOptions) command() (restic.Command, error) {
+	var args []any
+	if opt.dropPasswords {
+		args = append(args, "--drop-passwords")
+	}
+	for _, role := range opt.passwordRoles {
+		args = append(args, fmt.Sprintf("--drop-password-of=%s", role))
+	}
+	for _, role := range opt.skipRoles {
+		args = append(args, fmt.Sprintf("--skip-role=%s", role))
+	}
+	owners := make([]string, 0, len(opt.ownerMap))
+	for owner := range opt.ownerMap {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	for _, owner := range owners {
+		args = append(args, fmt.Sprintf("--owner-map=%s=%s", owner, opt.ownerMap[owner]))
+	}
+	for _, database := range opt.databases {
+		args = append(args, fmt.Sprintf("--database=%s", database))
+	}
+	if opt.includeGlobals {
+		args = append(args, "--include-globals")
+	}
+	if opt.targetDatabase != "" {
+		args = append(args, fmt.Sprintf("--target-database=%s", opt.targetDatabase))
+	}
+	for _, table := range opt.tables {
+		args = append(args, fmt.Sprintf("--table=%s", table))
+	}
+	for _, schema := range opt.schemas {
+		args = append(args, fmt.Sprintf("--schema=%s", schema))
+	}
+	for _, database := range opt.existingDatabases {
+		args = append(args, fmt.Sprintf("--existing-database=%s", database))
+	}
+	return selfStage(FilterSQLCMD, args...)
+}
+
+type sqlFilter struct {
+	dropPasswords  bool
+	passwordRoles  map[string]bool
+	skipRoles      map[string]bool
+	ownerMap       map[string]string
+	databases      map[string]bool
+	includeGlobals bool
+	// found are the selected databases that have been found in the dump
+	found map[string]bool
+	// renameFrom is the selected database that is restored as the target database
+	renameFrom     string
+	targetDatabase string
+	// selector selects the objects to restore, entry is the object the current part of the dump belongs to
+	selector      *objectSelector
+	entry         *tocEntry
+	entrySelected bool
+	// selected indicates whether any object has been selected
+	selected bool
+	// existingDatabases are the databases that must not be created
+	existingDatabases map[string]bool
+}
+
+func (opt *sqlFilterOptions) newSQLFilter() *sqlFilter {
+	f := &sqlFilter{
+		dropPasswords:     opt.dropPasswords,
+		passwordRoles:     make(map[string]bool),
+		skipRoles:         make(map[string]bool),
+		ownerMap:          opt.ownerMap,
+		includeGlobals:    opt.includeGlobals,
+		found:             make(map[string]bool),
+		selector:          newObjectSelector(opt.tables, opt.schemas),
+		existingDatabases: make(map[string]bool),
+	}
+	for _, database := range opt.existingDatabases {
+		f.existingDatabases[database] = true
+	}
+	if opt.targetDatabase != "" && len(opt.databases) == 1 {
+		f.renameFrom, f.targetDatabase = opt.databases[0], opt.targetDatabase
+	}
+	if len(opt.databases) > 0 {
+		f.databases = make(map[string]bool)
+		for _, database := range opt.databases {
+			f.databases[database] = true
+		}
+	}
+	for _, role := range opt.passwordRoles {
+		f.passwordRoles[role] = true
+	}
+	for _, role := range opt.skipRoles {
+		f.skipRoles[role] = true
+	}
+	return f
+}
+
+// filter copies the dump from r into w, applying the rules on each statement.
+func (f *sqlFilter) filter(r io.Reader, w io.Writer) error {
+	s := newSQLScanner(r)
+	skipCopyData := false
+	// section is the database the current part of a pg_dumpall dump belongs to, it is empty for the globals
+	section := ""
+	for {
+		chunk, err := s.next()
+		if err == io.EOF {
+			if f.selector != nil && !f.selected {
+				return fmt.Errorf("no object of the dump matches the given tables and schemas")
+			}
+			return f.checkDatabases()
+		}
+		if err != nil {
+			return err
+		}
+
+		text, keep := chunk.text, true
+		switch chunk.kind {
+		case sqlChunkOther:
+			if database, ok := databaseDumpMarker(text); ok {
+				section = f.enterSection(database)
+				f.entry = nil
+			}
+			if e, ok := parseEntryMarker(text); ok && f.selector != nil {
+				f.enterEntry(e)
+			}
+			keep = f.keepSection(section) && f.keepEntry()
+		case sqlChunkMeta:
+			// the meta-commands other than \connect (i.e. \restrict) affect the psql session, so they are always kept
+			if database, ok := connectTarget(text); ok {
+				section = f.enterSection(database)
+				f.entry = nil
+				keep = f.keepSection(section)
+				if keep && f.renameFrom != "" && database == f.renameFrom {
+					text = connectMeta(f.targetDatabase)
+				}
+			}
+		case sqlChunkStatement:
+			tokens := tokenizeSQL(text)
+			if database := createDatabaseTarget(tokens); database != "" {
+				section = f.enterSection(database)
+			}
+			if f.entry != nil && f.entry.desc == "INDEX" {
+				// the table of an index is only known from its definition
+				if _, table, ok := indexTable(tokens); ok {
+					f.entry.table = table
+					f.enterEntry(*f.entry)
+				}
+			}
+			keep = f.keepSection(section) && f.keepEntry()
+			if keep {
+				// a dropped statement keeps its text, so that its lines are kept below
+				var rewritten []byte
+				if rewritten, keep = f.rewrite(text, tokens); keep {
+					text = rewritten
+				}
+			}
+			// the data of a dropped COPY statement must be dropped as well
+			skipCopyData = !keep
+		case sqlChunkCopyData:
+			keep = !skipCopyData
+		}
+		if !keep {
+			// the lines of the dropped parts are kept empty, so that the errors of psql point to the lines of the dump
+			text = bytes.Repeat([]byte{'\n'}, bytes.Count(text, []byte{'\n'}))
+		}
+		if _, err := w.Write(text); err != nil {
+			return err
+		}
+	}
+}
+
+type sqlEdit struct {
+	start, end int
+	text       string
+}
+
+// rewrite applies the rules on a statement. It returns false if the statement has to be dropped.
+func (f *sqlFilter) rewrite(stmt []byte, tokens []sqlToken) ([]byte, bool) {
+	var edits []sqlEdit
+
+	if database := createDatabaseTarget(tokens); database != "" {
+		if f.renameFrom != "" && database == f.renameFrom {
+			database = f.targetDatabase
+		}
+		if f.existingDatabases[database] {
+			return nil, false
+		}
+	}
+	if role, alter := roleStatement(tokens); role != "" {
+		if f.skipRoles[role] {
+			return nil, false
+		}
+		if alter && (f.dropPasswords || f.passwordRoles[role]) {
+			edits = append(edits, passwordEdits(tokens)...)
+		}
+	}
+	if len(f.ownerMap) > 0 {
+		edits = append(edits, f.ownerEdits(tokens)...)
+	}
+	if f.renameFrom != "" {
+		edits = append(edits, f.databaseEdits(tokens)...)
+	}
+
+	if len(edits) == 0 {
+		return stmt, true
+	}
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	var out bytes.Buffer
+	pos := 0
+	for _, e := range edits {
+		out.Write(stmt[pos:e.start])
+		out.WriteString(e.text)
+		pos = e.end
+	}
+	out.Write(stmt[pos:])
+	return out.Bytes(), true
+}
+
+// roleStatement returns the role a CREATE, ALTER or COMMENT ON ROLE statement is about.
+// alter indicates whether the statement can set the attributes (i.e. the password) of the role.
+func roleStatement(tokens []sqlToken) (role string, alter bool) {
+	switch {
+	case len(tokens) >= 3 && (tokens[0].is("create") || tokens[0].is("alter")) && (tokens[1].is("role") || tokens[1].is("user")):
+		return tokens[2].identifier(), true
+	case len(tokens) >= 4 && tokens[0].is("comment") && tokens[1].is("on") && tokens[2].is("role"):
+		return tokens[3].identifier(), false
+	}
+	return "", false
+}
+
+// passwordEdits removes the "[ENCRYPTED] PASSWORD '...'" option from a role statement.
+func passwordEdits(tokens []sqlToken) []sqlEdit {
+	var edits []sqlEdit
+	for i := 1; i+1 < len(tokens); i++ {
+		if !tokens[i].is("password") || (tokens[i+1].kind != sqlTokenString && !tokens[i+1].is("null")) {
+			continue
+		}
+		first := i
+		if tokens[i-1].is("encrypted") {
+			first = i - 1
+		}
+		if first == 0 {
+			continue
+		}
+		edits = append(edits, sqlEdit{start: tokens[first-1].end, end: tokens[i+1].end})
+	}
+	return edits
+}
+
+// ownerEdits rewrites the owners given by "OWNER TO <role>" and "OWNER = <role>".
+func (f *sqlFilter) ownerEdits(tokens []sqlToken) []sqlEdit {
+	var edits []sqlEdit
+	for i := 0; i+2 < len(tokens); i++ {
+		if !tokens[i].is("owner") || !(tokens[i+1].is("to") || tokens[i+1].is("=")) {
+			continue
+		}
+		owner := tokens[i+2]
+		if newOwner, ok := f.ownerMap[owner.identifier()]; ok && owner.kind != sqlTokenString {
+			edits = append(edits, sqlEdit{start: owner.start, end: owner.end, text: quoteIdentifier(newOwner)})
+		}
+	}
+	return edits
+}
+
+// databaseEdits renames the restored database wherever it is referred as "DATABASE <name>",
+// i.e. in CREATE DATABASE, ALTER DATABASE, COMMENT ON DATABASE and GRANT ... ON DATABASE statements.
+func (f *sqlFilter) databaseEdits(tokens []sqlToken) []sqlEdit {
+	var edits []sqlEdit
+	for i := 0; i+1 < len(tokens); i++ {
+		name := tokens[i+1]
+		if tokens[i].is("database") && name.kind != sqlTokenString && name.identifier() == f.renameFrom {
+			edits = append(edits, sqlEdit{start: name.start, end: name.end, text: quoteIdentifier(f.targetDatabase)})
+		}
+	}
+	return edits
+}
+
+// quoteIdentifier quotes a SQL identifier, so that it is used as it is.
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+type sqlChunkKind int
+
+const (
+	// sqlChunkOther holds the whitespaces and the comments between the statements
+	sqlChunkOther sqlChunkKind = iota
+	// sqlChunkMeta holds a psql meta-command (i.e. \connect)
+	sqlChunkMeta
+	// sqlChunkStatement holds a SQL statement including the terminating semicolon
+	sqlChunkStatement
+	// sqlChunkCopyData holds a line of the data following a COPY ... FROM stdin statement
+	sqlChunkCopyData
+)
+
+type sqlChunk struct {
+	kind sqlChunkKind
+	text []byte
+}
+
+// sqlScanner splits a SQL script into statements the same way psql does. It keeps track of the quoted
+// strings and identifiers, the dollar quoted strings, the comments and the SQL-standard function bodies,
+// so that a semicolon inside them does not end the statement. The data of the COPY statements is passed
+// line by line.
+type sqlScanner struct {
+	r      *bufio.Reader
+	inCopy bool
+}
+
+func newSQLScanner(r io.Reader) *sqlScanner {
+	return &sqlScanner{r: bufio.NewReaderSize(r, 1<<20)}
+}
+
+func (s *sqlScanner) next() (sqlChunk, error) {
+	if s.inCopy {
+		line, err := s.readLine()
+		if err != nil {
+			return sqlChunk{}, err
+		}
+		if l := bytes.TrimRight(line, "\r\n"); string(l) == `\.` {
+			s.inCopy = false
+		}
+		return sqlChunk{kind: sqlChunkCopyData, text: line}, nil
+	}
+
+	b, err := s.r.Peek(2)
+	if len(b) == 0 {
+		return sqlChunk{}, err
+	}
+	switch {
+	case isSpace(b[0]):
+		var text []byte
+		for {
+			c, err := s.r.ReadByte()
+			if err != nil {
+				break
+			}
+			if !isSpace(c) {
+				_ = s.r.UnreadByte()
+				break
+			}
+			text = append(text, c)
+		}
+		return sqlChunk{kind: sqlChunkOther, text: text}, nil
+	case len(b) == 2 && b[0] == '-' && b[1] == '-':
+		line, err := s.readLine()
+		return sqlChunk{kind: sqlChunkOther, text: line}, err
+	case b[0] == '\\':
+		line, err := s.readLine()
+		return sqlChunk{kind: sqlChunkMeta, text: line}, err
+	}
+	return s.statement()
+}
+
+// readLine reads up to and including the next newline. The last line of the input may not end with a newline.
+func (s *sqlScanner) readLine() ([]byte, error) {
+	line, err := s.r.ReadBytes('\n')
+	if err == io.EOF && len(line) > 0 {
+		return line, nil
+	}
+	return line, err
+}
+
+const (
+	scanNormal = iota
+	scanQuote
+	scanEscapeQuote
+	scanIdentifier
+	scanLineComment
+	scanBlockComment
+	scanDollarQuote
+)
+
+func (s *sqlScanner) statement() (sqlChunk, error) {
+	var (
+		buf   []byte
+		state = scanNormal
+		// depth of the nested block comments
+		commentDepth int
+		// tag of the current dollar quoted string and where its body starts
+		tag      []byte
+		tagStart int
+		// the previous word and where it ends, to detect E'...' strings
+		lastWord    string
+		lastWordEnd int
+		// a SQL-standard function body (BEGIN ATOMIC ... END) contains semicolons
+		words       int
+		isCreate    bool
+		isRoutine   bool
+		atomicDepth int
+	)
+	for {
+		c, err := s.r.ReadByte()
+		if err == io.EOF && len(buf) > 0 {
+			// the script does not end with a semicolon
+			return sqlChunk{kind: sqlChunkStatement, text: buf}, nil
+		}
+		if err != nil {
+			return sqlChunk{}, err
+		}
+		buf = append(buf, c)
+
+		switch state {
+		case scanNormal:
+			switch {
+			case c == '\'':
+				state = scanQuote
+				if lastWordEnd == len(buf)-1 && strings.EqualFold(lastWord, "e") {
+					state = scanEscapeQuote
+				}
+			case c == '"':
+				state = scanIdentifier
+			case c == '-' && s.peekIs('-'):
+				state = scanLineComment
+			case c == '/' && s.peekIs('*'):
+				buf = append(buf, s.mustReadByte())
+				state, commentDepth = scanBlockComment, 1
+			case c == '$':
+				if t := s.dollarTag(); t != nil {
+					for range t[1:] {
+						buf = append(buf, s.mustReadByte())
+					}
+					state, tag, tagStart = scanDollarQuote, t, len(buf)
+				}
+			case c == ';' && atomicDepth == 0:
+				s.inCopy = isCopyFromStdin(buf)
+				return sqlChunk{kind: sqlChunkStatement, text: buf}, nil
+			case isIdentStart(c):
+				wordStart := len(buf) - 1
+				for {
+					b, err := s.r.Peek(1)
+					if err != nil || !isIdentByte(b[0]) {
+						break
+					}
+					buf = append(buf, s.mustReadByte())
+				}
+				lastWord, lastWordEnd = string(buf[wordStart:]), len(buf)
+				word := strings.ToLower(lastWord)
+				if words == 0 && word == "create" {
+					isCreate = true
+				}
+				words++
+				if isCreate && (word == "function" || word == "procedure") {
+					isRoutine = true
+				}
+				if isRoutine {
+					switch word {
+					case "begin":
+						atomicDepth++
+					case "case":
+						if atomicDepth > 0 {
+							atomicDepth++
+						}
+					case "end":
+						if atomicDepth > 0 {
+							atomicDepth--
+						}
+					}
+				}
+			}
+		case scanQuote, scanEscapeQuote:
+			switch {
+			case c == '\\' && state == scanEscapeQuote:
+				if b, err := s.r.ReadByte(); err == nil {
+					buf = append(buf, b)
+				}
+			case c == '\'':
+				if s.peekIs('\'') {
+					buf = append(buf, s.mustReadByte())
+				} else {
+					state = scanNormal
+				}
+			}
+		case scanIdentifier:
+			if c == '"' {
+				if s.peekIs('"') {
+					buf = append(buf, s.mustReadByte())
+				} else {
+					state = scanNormal
+				}
+			}
+		case scanLineComment:
+			if c == '\n' {
+				state = scanNormal
+			}
+		case scanBlockComment:
+			switch {
+			case c == '/' && s.peekIs('*'):
+				buf = append(buf, s.mustReadByte())
+				commentDepth++
+			case c == '*' && s.peekIs('/'):
+				buf = append(buf, s.mustReadByte())
+				if commentDepth--; commentDepth == 0 {
+					state = scanNormal
+				}
+			}
+		case scanDollarQuote:
+			if c == '$' && len(buf)-tagStart >= len(tag) && bytes.HasSuffix(buf[tagStart:], tag) {
+				state = scanNormal
+			}
+		}
+	}
+}
+
+// dollarTag returns the tag (i.e. $$ or $body$) of a dollar quoted string starting at the "$" that has just been read.
+func (s *sqlScanner) dollarTag() []byte {
+	b, _ := s.r.Peek(64)
+	for i, c := range b {
+		switch {
+		case c == '$':
+			return append([]byte{'$'}, b[:i+1]...)
+		case i == 0 && !isIdentStart(c), i > 0 && !isIdentByte(c), c == '$':
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *sqlScanner) peekIs(c byte) bool {
+	b, err := s.r.Peek(1)
+	return err == nil && b[0] == c
+}
+
+// mustReadByte reads a byte which has already been peeked.
+func (s *sqlScanner) mustReadByte() byte {
+	c, _ := s.r.ReadByte()
+	return c
+}
+
+// isCopyFromStdin checks whether the statement is followed by the data to copy.
+func isCopyFromStdin(stmt []byte) bool {
+	tokens := tokenizeSQL(stmt)
+	if len(tokens) == 0 || !tokens[0].is("copy") {
+		return false
+	}
+	for i := 1; i+1 < len(tokens); i++ {
+		if tokens[i].is("from") && tokens[i+1].is("stdin") {
+			return true
+		}
+	}
+	return false
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isIdentByte(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9') || c == '$'
+}
+
+type sqlTokenKind int
+
+const (
+	// sqlTokenWord is a keyword, an unquoted identifier or a number
+	sqlTokenWord sqlTokenKind = iota
+	// sqlTokenIdentifier is a quoted identifier
+	sqlTokenIdentifier
+	// sqlTokenString is a string constant in any of the quoting styles
+	sqlTokenString
+	// sqlTokenOther is any other character (i.e. an operator or a punctuation)
+	sqlTokenOther
+)
+
+type sqlToken struct {
+	kind       sqlTokenKind
+	text       string
+	start, end int
+}
+
+// is checks whether the token is the given keyword or character.
+func (t sqlToken) is(s string) bool {
+	return (t.kind == sqlTokenWord || t.kind == sqlTokenOther) && strings.EqualFold(t.text, s)
+}
+
+// identifier returns the name the token refers to. Unquoted identifiers are folded to lower case.
+func (t sqlToken) identifier() string {
+	switch t.kind {
+	case sqlTokenWord:
+		return strings.ToLower(t.text)
+	case sqlTokenIdentifier:
+		return strings.ReplaceAll(t.text[1:len(t.text)-1], `""`, `"`)
+	}
+	return t.text
+}
+
+// tokenizeSQL splits a single statement into tokens, skipping the whitespaces and the comments.
+func tokenizeSQL(stmt []byte) []sqlToken {
+	var tokens []sqlToken
+	for i := 0; i < len(stmt); {
+		c := stmt[i]
+		start := i
+		kind := sqlTokenOther
+		switch {
+		case isSpace(c):
+			i++
+			continue
+		case c == '-' && i+1 < len(stmt) && stmt[i+1] == '-':
+			for i < len(stmt) && stmt[i] != '\n' {
+				i++
+			}
+			continue
+		case c == '/' && i+1 < len(stmt) && stmt[i+1] == '*':
+			depth := 0
+			for ; i < len(stmt); i++ {
+				if stmt[i] == '/' && i+1 < len(stmt) && stmt[i+1] == '*' {
+					depth++
+					i++
+				} else if stmt[i] == '*' && i+1 < len(stmt) && stmt[i+1] == '/' {
+					i++
+					if depth--; depth == 0 {
+						i++
+						break
+					}
+				}
+			}
+			continue
+		case (c == 'e' || c == 'E') && i+1 < len(stmt) && stmt[i+1] == '\'':
+			kind, i = sqlTokenString, skipQuoted(stmt, i+1, '\'', true)
+		case c == '\'':
+			kind, i = sqlTokenString, skipQuoted(stmt, i, '\'', false)
+		case c == '"':
+			kind, i = sqlTokenIdentifier, skipQuoted(stmt, i, '"', false)
+		case c == '$' && dollarTagAt(stmt, i) != "":
+			tag := dollarTagAt(stmt, i)
+			kind = sqlTokenString
+			if end := strings.Index(string(stmt[i+len(tag):]), tag); end >= 0 {
+				i += len(tag) + end + len(tag)
+			} else {
+				i = len(stmt)
+			}
+		case isIdentByte(c):
+			kind = sqlTokenWord
+			for i < len(stmt) && isIdentByte(stmt[i]) {
+				i++
+			}
+		default:
+			i++
+		}
+		tokens = append(tokens, sqlToken{kind: kind, text: string(stmt[start:i]), start: start, end: i})
+	}
+	return tokens
+}
+
+// skipQuoted returns the position following the quoted string or identifier starting at i.
+func skipQuoted(stmt []byte, i int, quote byte, escape bool) int {
+	for i++; i < len(stmt); i++ {
+		switch {
+		case escape && stmt[i] == '\\':
+			i++
+		case stmt[i] == quote:
+			if i+1 < len(stmt) && stmt[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(stmt)
+}
+
+// dollarTagAt returns the tag of the dollar quoted string starting at i, if any.
+func dollarTagAt(stmt []byte, i int) string {
+	if i > 0 && isIdentByte(stmt[i-1]) {
+		return ""
+	}
+	for j := i + 1; j < len(stmt); j++ {
+		switch {
+		case stmt[j] == '$':
+			return string(stmt[i : j+1])
+		case j == i+1 && !isIdentStart(stmt[j]), !isIdentByte(stmt[j]):
+			return ""
+		}
+	}
+	return ""
+}
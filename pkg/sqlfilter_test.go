@@ -0,0 +1,307 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func scanChunks(t *testing.T, script string) []sqlChunk {
+	t.Helper()
+	s := newSQLScanner(strings.NewReader(script))
+	var chunks []sqlChunk
+	for {
+		chunk, err := s.next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatalf("failed to scan the script: %v", err)
+		}
+		chunks = append(chunks, chunk)
+	}
+}
+
+func TestSQLScanner(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		// statements are the statements expected out of the script, in order
+		statements []string
+		// copyData are the lines of the COPY data expected out of the script, in order
+		copyData []string
+		meta     []string
+	}{
+		{
+			name:       "statements",
+			in:         "SET x = 1;\nSELECT 1;\n",
+			statements: []string{"SET x = 1;", "SELECT 1;"},
+		},
+		{
+			name:       "semicolon in a string",
+			in:         "INSERT INTO t VALUES ('a;b', 'it''s;');\n",
+			statements: []string{"INSERT INTO t VALUES ('a;b', 'it''s;');"},
+		},
+		{
+			name:       "escape string",
+			in:         "SELECT E'a\\';b';\nSELECT 2;\n",
+			statements: []string{"SELECT E'a\\';b';", "SELECT 2;"},
+		},
+		{
+			name:       "quoted identifier",
+			in:         "CREATE TABLE \"a;\"\"b\" (id int);\n",
+			statements: []string{"CREATE TABLE \"a;\"\"b\" (id int);"},
+		},
+		{
+			name:       "dollar quoted body",
+			in:         "CREATE FUNCTION f() RETURNS int AS $body$ SELECT 1; $body$ LANGUAGE sql;\nSELECT $$;$$;\n",
+			statements: []string{"CREATE FUNCTION f() RETURNS int AS $body$ SELECT 1; $body$ LANGUAGE sql;", "SELECT $$;$$;"},
+		},
+		{
+			name:       "comments",
+			in:         "SELECT 1 /* a; /* nested; */ b; */ -- c;\n;\n",
+			statements: []string{"SELECT 1 /* a; /* nested; */ b; */ -- c;\n;"},
+		},
+		{
+			name: "sql standard function body",
+			in: "CREATE FUNCTION f(a int) RETURNS int LANGUAGE sql BEGIN ATOMIC SELECT CASE WHEN a > 0 THEN 1 END; SELECT 2; END;\n" +
+				"SELECT 3;\n",
+			statements: []string{
+				"CREATE FUNCTION f(a int) RETURNS int LANGUAGE sql BEGIN ATOMIC SELECT CASE WHEN a > 0 THEN 1 END; SELECT 2; END;",
+				"SELECT 3;",
+			},
+		},
+		{
+			name:       "copy data",
+			in:         "COPY public.t (id, v) FROM stdin;\n1\ta;b\n2\t\\N\n\\.\nSELECT 1;\n",
+			statements: []string{"COPY public.t (id, v) FROM stdin;", "SELECT 1;"},
+			copyData:   []string{"\n", "1\ta;b\n", "2\t\\N\n", "\\.\n"},
+		},
+		{
+			name:       "meta-command",
+			in:         "\\connect postgres\nSELECT 1;\n",
+			statements: []string{"SELECT 1;"},
+			meta:       []string{"\\connect postgres\n"},
+		},
+		{
+			name:       "no final semicolon",
+			in:         "SELECT 1",
+			statements: []string{"SELECT 1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				out                        bytes.Buffer
+				statements, copyData, meta []string
+			)
+			for _, chunk := range scanChunks(t, tt.in) {
+				out.Write(chunk.text)
+				switch chunk.kind {
+				case sqlChunkStatement:
+					statements = append(statements, string(chunk.text))
+				case sqlChunkCopyData:
+					copyData = append(copyData, string(chunk.text))
+				case sqlChunkMeta:
+					meta = append(meta, string(chunk.text))
+				}
+			}
+			if out.String() != tt.in {
+				t.Errorf("chunks do not add up to the script: got %q", out.String())
+			}
+			if !reflect.DeepEqual(statements, tt.statements) {
+				t.Errorf("statements: got %q, want %q", statements, tt.statements)
+			}
+			if !reflect.DeepEqual(copyData, tt.copyData) {
+				t.Errorf("copy data: got %q, want %q", copyData, tt.copyData)
+			}
+			if !reflect.DeepEqual(meta, tt.meta) {
+				t.Errorf("meta-commands: got %q, want %q", meta, tt.meta)
+			}
+		})
+	}
+}
+
+func TestTokenizeSQL(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{in: "ALTER ROLE postgres;", want: []string{"ALTER", "ROLE", "postgres", ";"}},
+		{in: `CREATE DATABASE "my ""db"" x" OWNER = bob;`, want: []string{"CREATE", "DATABASE", `"my ""db"" x"`, "OWNER", "=", "bob", ";"}},
+		{in: "SELECT E'a\\'b', 'c''d', $t$x$t$; -- done", want: []string{"SELECT", "E'a\\'b'", ",", "'c''d'", ",", "$t$x$t$", ";"}},
+		{in: "SELECT /* a /* b */ c */ 1", want: []string{"SELECT", "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			var got []string
+			for _, token := range tokenizeSQL([]byte(tt.in)) {
+				got = append(got, token.text)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordEdits(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "password",
+			in:   "ALTER ROLE postgres WITH SUPERUSER LOGIN PASSWORD 'secret';",
+			want: "ALTER ROLE postgres WITH SUPERUSER LOGIN;",
+		},
+		{
+			name: "encrypted password",
+			in:   "CREATE ROLE app WITH LOGIN ENCRYPTED PASSWORD 'SCRAM-SHA-256$4096:abc' VALID UNTIL 'infinity';",
+			want: "CREATE ROLE app WITH LOGIN VALID UNTIL 'infinity';",
+		},
+		{
+			name: "null password",
+			in:   "ALTER USER app PASSWORD NULL;",
+			want: "ALTER USER app;",
+		},
+		{
+			name: "dollar quoted password",
+			in:   "ALTER ROLE app PASSWORD $p$it's$p$ LOGIN;",
+			want: "ALTER ROLE app LOGIN;",
+		},
+		{
+			name: "role named password",
+			in:   "ALTER ROLE password WITH LOGIN;",
+			want: "ALTER ROLE password WITH LOGIN;",
+		},
+		{
+			name: "no password",
+			in:   "ALTER ROLE app WITH NOLOGIN;",
+			want: "ALTER ROLE app WITH NOLOGIN;",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmt := []byte(tt.in)
+			var out bytes.Buffer
+			pos := 0
+			for _, e := range passwordEdits(tokenizeSQL(stmt)) {
+				out.Write(stmt[pos:e.start])
+				out.WriteString(e.text)
+				pos = e.end
+			}
+			out.Write(stmt[pos:])
+			if out.String() != tt.want {
+				t.Errorf("got %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSQLFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		opt     sqlFilterOptions
+		in      string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "password of a role",
+			opt:  sqlFilterOptions{passwordRoles: []string{"postgres"}},
+			in: "ALTER ROLE postgres WITH LOGIN PASSWORD 'a';\n" +
+				"ALTER ROLE app WITH LOGIN PASSWORD 'b';\n",
+			want: "ALTER ROLE postgres WITH LOGIN;\n" +
+				"ALTER ROLE app WITH LOGIN PASSWORD 'b';\n",
+		},
+		{
+			name: "quoted role",
+			opt:  sqlFilterOptions{passwordRoles: []string{"Admin"}},
+			in:   "ALTER ROLE \"Admin\" PASSWORD 'a';\nALTER ROLE admin PASSWORD 'b';\n",
+			want: "ALTER ROLE \"Admin\";\nALTER ROLE admin PASSWORD 'b';\n",
+		},
+		{
+			name: "all passwords",
+			opt:  sqlFilterOptions{dropPasswords: true},
+			in:   "CREATE ROLE a;\nALTER ROLE a WITH LOGIN PASSWORD 'a';\n",
+			want: "CREATE ROLE a;\nALTER ROLE a WITH LOGIN;\n",
+		},
+		{
+			name: "skipped role keeps the lines",
+			opt:  sqlFilterOptions{skipRoles: []string{"replicator"}},
+			in:   "CREATE ROLE replicator;\nALTER ROLE replicator WITH\n  REPLICATION;\nCREATE ROLE app;\n",
+			want: "\n\n\nCREATE ROLE app;\n",
+		},
+		{
+			name: "owner map",
+			opt:  sqlFilterOptions{ownerMap: map[string]string{"old": "new owner"}},
+			in:   "ALTER TABLE public.t OWNER TO old;\nALTER TABLE public.u OWNER TO other;\n",
+			want: "ALTER TABLE public.t OWNER TO \"new owner\";\nALTER TABLE public.u OWNER TO other;\n",
+		},
+		{
+			name: "copy data is not rewritten",
+			opt:  sqlFilterOptions{dropPasswords: true},
+			in:   "COPY public.t (v) FROM stdin;\nALTER ROLE a PASSWORD 'x';\n\\.\n",
+			want: "COPY public.t (v) FROM stdin;\nALTER ROLE a PASSWORD 'x';\n\\.\n",
+		},
+		{
+			name: "selected table",
+			opt:  sqlFilterOptions{tables: []string{"orders"}},
+			in: "SET statement_timeout = 0;\n" +
+				"-- Name: orders; Type: TABLE; Schema: public; Owner: app\n" +
+				"CREATE TABLE public.orders (id int);\n" +
+				"-- Name: users; Type: TABLE; Schema: public; Owner: app\n" +
+				"CREATE TABLE public.users (id int);\n" +
+				"-- Data for Name: users; Type: TABLE DATA; Schema: public; Owner: app\n" +
+				"COPY public.users (id) FROM stdin;\n1\n\\.\n",
+			want: "SET statement_timeout = 0;\n" +
+				"-- Name: orders; Type: TABLE; Schema: public; Owner: app\n" +
+				"CREATE TABLE public.orders (id int);\n" +
+				"\n\n\n\n\n\n",
+		},
+		{
+			name:    "no selected table",
+			opt:     sqlFilterOptions{tables: []string{"missing"}},
+			in:      "-- Name: orders; Type: TABLE; Schema: public; Owner: app\nCREATE TABLE public.orders (id int);\n",
+			wantErr: "no object of the dump matches the given tables and schemas",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := tt.opt.newSQLFilter().filter(strings.NewReader(tt.in), &out)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to filter the dump: %v", err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", out.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// the replaced databases are marked with a comment holding the time they can be dropped at
+	swapCommentPrefix = "stash-postgres: replaced by a restore, keep until "
+	swapTimeFormat    = "20060102150405"
+	// PostgreSQL truncates the identifiers longer than this
+	maxIdentifierLength = 63
+
+	tableEstimatesQuery = `SELECT count(*), coalesce(sum(greatest(c.reltuples, 0)), 0)::bigint FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace WHERE c.relkind IN ('r', 'p') AND n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg\_toast%'`
+)
+
+// prepareSwap finds out the live database the dump will replace, and the staging database it will be restored into.
+// The replaced copies of the live database whose grace period is over are dropped.
+func (opt *postgresOptions) prepareSwap(session *sessionWrapper, snapshot *restic.Snapshot, dumpFormat string) (*swapStats, error) {
+	if opt.clean != "" {
+		return nil, fmt.Errorf("clean modes can not be used along with swap, the dump is restored into a new database")
+	}
+	if len(opt.filter.tables) > 0 || len(opt.filter.schemas) > 0 {
+		return nil, fmt.Errorf("a database can not be swapped with a partial restore of selected tables or schemas")
+	}
+
+	live := opt.filter.targetDatabase
+	if dumpFormat == DumpFormatPlain && !opt.dumpCreatesDatabase(snapshot) {
+		// the dump is restored into the staging database, which is created like the database of an archive
+		opt.connectRestoreDB = true
+	} else if dumpFormat == DumpFormatPlain {
+		opt.selectPerDatabaseDump(snapshot)
+		if len(opt.filter.databases) != 1 {
+			return nil, fmt.Errorf("exactly one database must be selected with --database to restore it with swap")
+		}
+		if live == "" {
+			live = opt.filter.databases[0]
+		}
+	}
+	// the live database is never guessed, a swap replaces it
+	if live == "" {
+		return nil, fmt.Errorf("the database to replace must be given with --target-database to restore it with swap")
+	}
+
+	now := time.Now().UTC()
+	swap := &swapStats{
+		Database: live,
+		Staging:  swapName(live, "staging", now),
+	}
+	opt.restoreStats.Swap = swap
+	if err := session.dropExpiredCopies(live, now); err != nil {
+		return nil, err
+	}
+	exists, err := session.databaseExists(swap.Staging)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, fmt.Errorf("staging database %s already exists", swap.Staging)
+	}
+	// a plain dump creates the database itself, so the database it holds is renamed to the staging database
+	opt.filter.targetDatabase = swap.Staging
+	klog.Infof("Restoring database %s into staging database %s", live, swap.Staging)
+	return swap, nil
+}
+
+// restoreWithSwap restores the dump into the staging database and validates it. Then, the live database is renamed
+// aside and the staging database is renamed into its place. The live database is not touched unless the restore and
+// the validation have succeeded, the staging database is dropped otherwise.
+func (opt *postgresOptions) restoreWithSwap(w *restic.ResticWrapper, session *sessionWrapper, dumpFormat string, swap *swapStats, targetRef api_v1beta1.TargetRef) (*restic.RestoreOutput, error) {
+	restoreOutput, err := opt.replayDump(w, session, dumpFormat, swap.Staging, targetRef)
+	if err == nil {
+		err = runPhase(&opt.restoreStats.Phases, "validate", func() error {
+			return opt.validateStaging(session, swap)
+		})
+	}
+	if err == nil {
+		err = runPhase(&opt.restoreStats.Phases, "swap", func() error {
+			return opt.swapDatabases(session, swap)
+		})
+	}
+	if err != nil {
+		klog.Infof("Dropping staging database %s", swap.Staging)
+		if _, dropErr := session.dropDatabase(swap.Staging); dropErr != nil {
+			klog.Errorf("failed to drop staging database %s: %v", swap.Staging, dropErr)
+		}
+		return nil, err
+	}
+	return restoreOutput, nil
+}
+
+// validateStaging checks that the staging database holds a plausible amount of data compared to the live database.
+func (opt *postgresOptions) validateStaging(session *sessionWrapper, swap *swapStats) error {
+	// the estimates of the staging database are only known once it has been analyzed
+	if _, err := session.executeQuery(swap.Staging, "ANALYZE"); err != nil {
+		return err
+	}
+	var err error
+	if swap.Tables, swap.Rows, err = session.tableEstimates(swap.Staging); err != nil {
+		return err
+	}
+
+	exists, err := session.databaseExists(swap.Database)
+	if err != nil || !exists {
+		return err
+	}
+	liveTables, liveRows, err := session.tableEstimates(swap.Database)
+	if err != nil {
+		return err
+	}
+	if liveTables > 0 && swap.Tables == 0 {
+		return fmt.Errorf("staging database %s holds no table while database %s holds %d", swap.Staging, swap.Database, liveTables)
+	}
+	if opt.swapMinRowRatio > 0 && liveRows > 0 && float64(swap.Rows) < opt.swapMinRowRatio*float64(liveRows) {
+		return fmt.Errorf("staging database %s holds about %d rows while database %s holds about %d: it is below the minimum ratio %g",
+			swap.Staging, swap.Rows, swap.Database, liveRows, opt.swapMinRowRatio)
+	}
+	return nil
+}
+
+// tableEstimates returns the number of tables of the database and the estimated number of their rows.
+func (session *sessionWrapper) tableEstimates(database string) (int64, int64, error) {
+	rows, err := session.executeQuery(database, tableEstimatesQuery)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(rows) != 1 {
+		return 0, 0, fmt.Errorf("unexpected result of the table estimates of database %s: %v", database, rows)
+	}
+	tables, rowCount, _ := strings.Cut(rows[0], "|")
+	t, err := strconv.ParseInt(tables, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	r, err := strconv.ParseInt(rowCount, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return t, r, nil
+}
+
+// swapDatabases renames the live database aside and the staging database into its place in a single transaction.
+// The live database does not accept new connections while it is being renamed.
+func (opt *postgresOptions) swapDatabases(session *sessionWrapper, swap *swapStats) error {
+	maintenance := maintenanceDB(swap.Database)
+	if _, err := session.terminateConnections(swap.Staging); err != nil {
+		return err
+	}
+	exists, err := session.databaseExists(swap.Database)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err = session.executeQuery(maintenance, fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", quoteIdentifier(swap.Staging), quoteIdentifier(swap.Database)))
+		return err
+	}
+
+	now := time.Now().UTC()
+	swap.Previous = swapName(swap.Database, "old", now)
+	if _, err = session.executeQuery(maintenance, fmt.Sprintf("ALTER DATABASE %s ALLOW_CONNECTIONS false", quoteIdentifier(swap.Database))); err != nil {
+		return err
+	}
+	if _, err = session.terminateConnections(swap.Database); err == nil {
+		_, err = session.executeQuery(maintenance, fmt.Sprintf("ALTER DATABASE %s RENAME TO %s; ALTER DATABASE %s RENAME TO %s",
+			quoteIdentifier(swap.Database), quoteIdentifier(swap.Previous), quoteIdentifier(swap.Staging), quoteIdentifier(swap.Database)))
+	}
+	if err != nil {
+		// the live database has not been renamed, so let it accept connections again
+		if _, e := session.executeQuery(maintenance, fmt.Sprintf("ALTER DATABASE %s ALLOW_CONNECTIONS true", quoteIdentifier(swap.Database))); e != nil {
+			klog.Errorf("failed to allow connections to database %s: %v", swap.Database, e)
+		}
+		swap.Previous = ""
+		return err
+	}
+	klog.Infof("Database %s has been replaced, the previous one has been renamed to %s", swap.Database, swap.Previous)
+
+	if opt.swapGracePeriod <= 0 {
+		_, err = session.dropDatabase(swap.Previous)
+		return err
+	}
+	keepUntil := now.Add(opt.swapGracePeriod)
+	swap.KeepUntil = keepUntil.Format(time.RFC3339)
+	_, err = session.executeQuery(DefaultPostgresDB, fmt.Sprintf("ALTER DATABASE %s ALLOW_CONNECTIONS true; COMMENT ON DATABASE %s IS %s",
+		quoteIdentifier(swap.Previous), quoteIdentifier(swap.Previous), quoteLiteral(swapCommentPrefix+swap.KeepUntil)))
+	return err
+}
+
+// dropExpiredCopies drops the replaced copies of the database whose grace period is over.
+func (session *sessionWrapper) dropExpiredCopies(database string, now time.Time) error {
+	rows, err := session.executeQuery(DefaultPostgresDB, fmt.Sprintf("SELECT shobj_description(oid, 'pg_database'), datname FROM pg_database WHERE starts_with(shobj_description(oid, 'pg_database'), %s)", quoteLiteral(swapCommentPrefix)))
+	if err != nil {
+		return err
+	}
+	prefix := swapNamePrefix(database, "old")
+	for _, row := range rows {
+		comment, name, _ := strings.Cut(row, "|")
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		keepUntil, err := time.Parse(time.RFC3339, strings.TrimPrefix(comment, swapCommentPrefix))
+		if err != nil || now.Before(keepUntil) {
+			continue
+		}
+		klog.Infof("Dropping database %s, it has been replaced by a restore and its grace period is over", name)
+		if _, err := session.dropDatabase(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// swapName returns the name of the staging or the replaced copy of a database, i.e. "orders_old_20261017220000".
+func swapName(database, kind string, t time.Time) string {
+	return swapNamePrefix(database, kind) + t.Format(swapTimeFormat)
+}
+
+func swapNamePrefix(database, kind string) string {
+	suffix := "_" + kind + "_"
+	if limit := maxIdentifierLength - len(suffix) - len(swapTimeFormat); len(database) > limit {
+		database = database[:limit]
+	}
+	return database + suffix
+}
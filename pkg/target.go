@@ -0,0 +1,153 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"k8s.io/klog/v2"
+)
+
+// prepareTargetDatabase makes sure the dump can be restored as the target database. A plain dump usually creates
+// the database itself, so the database it holds is selected and renamed by the SQL filter. An archive, or a plain
+// dump taken without --create, is restored into an existing database, which is created once the existing databases
+// have been cleaned.
+func (opt *postgresOptions) prepareTargetDatabase(session *sessionWrapper, snapshot *restic.Snapshot, dumpFormat string) error {
+	target := opt.filter.targetDatabase
+	if dumpFormat == DumpFormatPlain && !opt.dumpCreatesDatabase(snapshot) {
+		opt.connectRestoreDB = true
+	} else if dumpFormat == DumpFormatPlain {
+		opt.selectPerDatabaseDump(snapshot)
+		if len(opt.filter.databases) != 1 {
+			return fmt.Errorf("exactly one database must be selected with --database to restore it as %s", target)
+		}
+	}
+
+	exists, err := session.databaseExists(target)
+	if err != nil {
+		return err
+	}
+	// the clean mode decides what happens to an existing database
+	if exists && opt.clean == "" {
+		if !opt.overwriteTarget {
+			return fmt.Errorf("database %s already exists: set --overwrite-target to replace it", target)
+		}
+		klog.Infof("Dropping existing database %s to restore over it", target)
+		if _, err := session.dropDatabase(target); err != nil {
+			return err
+		}
+	}
+	opt.restoreStats.TargetDatabase = target
+	return nil
+}
+
+// selectPerDatabaseDump selects the database held by the snapshot of a per database backup, so that it can be
+// handled the same way as a database selected out of a pg_dumpall dump.
+func (opt *postgresOptions) selectPerDatabaseDump(snapshot *restic.Snapshot) {
+	if database := perDatabaseDumpOf(snapshot); len(opt.filter.databases) == 0 && database != "" {
+		opt.filter.databases = []string{database}
+	}
+}
+
+// dumpCreatesDatabase tells whether a plain dump creates the database it holds, which is recorded in the manifest
+// of the backup. The dumps of pg_dumpall and of a per database backup always create their databases.
+func (opt *postgresOptions) dumpCreatesDatabase(snapshot *restic.Snapshot) bool {
+	if perDatabaseDumpOf(snapshot) != "" || opt.manifest == nil || opt.manifest.BackupCMD != PgDumpCMD {
+		return true
+	}
+	return opt.manifest.CreateDatabase
+}
+
+// perDatabaseDumpOf returns the database held by a snapshot of a per database backup.
+func perDatabaseDumpOf(snapshot *restic.Snapshot) string {
+	// restic stores the dump read from stdin under the root of the snapshot
+	file := path.Base(dumpFileOf(snapshot))
+	database := strings.TrimSuffix(file, filepath.Ext(file))
+	if strings.HasSuffix(snapshot.Hostname, "/"+database) {
+		return database
+	}
+	return ""
+}
+
+// databaseExists checks whether a database with the given name exists in the cluster.
+func (session *sessionWrapper) databaseExists(database string) (bool, error) {
+	rows, err := session.executeQuery(DefaultPostgresDB, fmt.Sprintf("SELECT 1 FROM pg_database WHERE datname = %s", quoteLiteral(database)))
+	if err != nil {
+		return false, err
+	}
+	return len(rows) > 0, nil
+}
+
+// ensureDatabase creates the database if it does not exist.
+func (session *sessionWrapper) ensureDatabase(database string) error {
+	exists, err := session.databaseExists(database)
+	if err != nil || exists {
+		return err
+	}
+	_, err = session.executeQuery(maintenanceDB(database), fmt.Sprintf("CREATE DATABASE %s TEMPLATE template0", quoteIdentifier(database)))
+	return err
+}
+
+// terminateConnections terminates the other connections to the database and returns how many have been terminated.
+func (session *sessionWrapper) terminateConnections(database string) (int, error) {
+	rows, err := session.executeQuery(maintenanceDB(database), fmt.Sprintf("SELECT pid FROM pg_stat_activity WHERE datname = %s AND pid <> pg_backend_pid() AND pg_terminate_backend(pid)", quoteLiteral(database)))
+	return len(rows), err
+}
+
+// dropDatabase refuses the new connections to the database and terminates the existing ones, then drops it. It
+// returns the number of terminated connections. The new connections are refused first, so that a client reconnecting
+// in between does not make the drop fail.
+func (session *sessionWrapper) dropDatabase(database string) (int, error) {
+	exists, err := session.databaseExists(database)
+	if err != nil || !exists {
+		return 0, err
+	}
+	maintenance := maintenanceDB(database)
+	if _, err := session.executeQuery(maintenance, fmt.Sprintf("ALTER DATABASE %s ALLOW_CONNECTIONS false", quoteIdentifier(database))); err != nil {
+		return 0, err
+	}
+	terminated, err := session.terminateConnections(database)
+	if err == nil {
+		_, err = session.executeQuery(maintenance, "DROP DATABASE "+quoteIdentifier(database))
+	}
+	if err != nil {
+		// the database has not been dropped, so let it accept connections again
+		if _, e := session.executeQuery(maintenance, fmt.Sprintf("ALTER DATABASE %s ALLOW_CONNECTIONS true", quoteIdentifier(database))); e != nil {
+			klog.Errorf("failed to allow connections to database %s: %v", database, e)
+		}
+		return terminated, err
+	}
+	return terminated, nil
+}
+
+// maintenanceDB returns the database to connect to in order to create or drop the given database.
+func maintenanceDB(database string) string {
+	if database == DefaultPostgresDB {
+		return "template1"
+	}
+	return DefaultPostgresDB
+}
+
+// quoteLiteral quotes a SQL string constant.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
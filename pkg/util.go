@@ -23,6 +23,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	stash "stash.appscode.dev/apimachinery/client/clientset/versioned"
 	"stash.appscode.dev/apimachinery/pkg/restic"
@@ -46,17 +47,30 @@ const (
 	EnvPGSSLMODE     = "PGSSLMODE"
 	EnvPgPassword    = "PGPASSWORD"
 	PgDumpFile       = "dumpfile.sql"
+	PgCustomDumpFile = "dumpfile.dump"
+	PgDirDumpFile    = "dumpfile.tar"
+	PgGlobalsFile    = "globals.sql"
 	PgDumpCMD        = "pg_dump"
 	PgDumpallCMD     = "pg_dumpall"
 	PgRestoreCMD     = "psql"
+	PgArchiveRestore = "pg_restore"
+	PgBaseBackupCMD  = "pg_basebackup"
+	PgBaseBackupDir  = "basebackup"
+
+	DumpFormatPlain  = "plain"
+	DumpFormatCustom = "custom"
+	DumpFormatDir    = "directory"
+	// DumpFormatPhysical indicates a physical base backup taken by pg_basebackup
+	DumpFormatPhysical = "physical"
 
 	// Deprecated
 	envPostgresUser = "POSTGRES_USER"
 	// Deprecated
 	envPostgresPassword = "POSTGRES_PASSWORD"
 	DefaultPostgresUser = "postgres"
-	SedCMD              = "sed"
-	sedArgs             = "/ALTER ROLE postgres WITH SUPERUSER INHERIT CREATEROLE CREATEDB LOGIN REPLICATION BYPASSRLS PASSWORD/d"
+	DefaultPostgresDB   = "postgres"
+	TarCMD              = "tar"
+	listDatabasesQuery  = "SELECT datname FROM pg_database WHERE datallowconn AND NOT datistemplate ORDER BY datname"
 )
 
 type postgresOptions struct {
@@ -69,16 +83,54 @@ type postgresOptions struct {
 	appBindingName      string
 	appBindingNamespace string
 	backupCMD           string
+	dumpFormat          string
 	pgArgs              string
 	user                string
 	outputDir           string
 	storageSecret       kmapi.ObjectReference
 	waitTimeout         int32
+	jobs                int
+	perDatabase         bool
+	maxConcurrency      int
+	dataDir             string
+	incremental         bool
+	exportSnapshot      bool
+	overwriteTarget     bool
+	clean               string
+	confirmDestroy      []string
+	swap                bool
+	onError             string
+	swapGracePeriod     time.Duration
+	swapMinRowRatio     float64
+	dryRun              bool
+	progressInterval    time.Duration
+	snapshots           []string
+	snapshotsFrom       string
+	asOf                string
+	tableStats          bool
+	tableChecksums      bool
+	tableValidation     bool
 
 	setupOptions  restic.SetupOptions
 	backupOptions restic.BackupOptions
 	dumpOptions   restic.DumpOptions
 	config        *restclient.Config
+
+	pitr   pitrOptions
+	filter sqlFilterOptions
+
+	backupStats  backupStats
+	restoreStats restoreStats
+
+	// dumpChecksums holds the checksums and the sizes of the dumps taken by a backup, keyed by the hosts of their snapshots
+	dumpChecksums map[string]streamChecksum
+	// checksum is the checksum recorded at backup of the dump that is being restored, empty if there is none
+	checksum string
+	// manifest is the manifest of the backup the restored snapshot has been taken by, nil if there is none
+	manifest *backupManifest
+	// connectRestoreDB indicates whether psql connects to the database a plain dump is restored into, as the dump
+	// does not create it
+	connectRestoreDB bool
 }
 
 func must(v []byte, err error) string {
@@ -91,6 +143,10 @@ func must(v []byte, err error) string {
 type sessionWrapper struct {
 	sh  *shell.Session
 	cmd *restic.Command
+	// connectionArgs holds the arguments required to connect with the database
+	connectionArgs []any
+	// user is the role used to connect with the database
+	user string
 }
 
 func (opt *postgresOptions) newSessionWrapper(cmd string) *sessionWrapper {
@@ -153,7 +209,8 @@ func (opt *postgresOptions) setDatabaseCredentials(appBinding *appcatalog.AppBin
 		session.sh.SetEnv(EnvPGSSLMODE, pgSSlmode)
 	}
 
-	session.cmd.Args = append(session.cmd.Args, fmt.Sprintf("--username=%s", userName))
+	session.user = userName
+	session.addConnectionArgs(fmt.Sprintf("--username=%s", userName))
 	return nil
 }
 
@@ -162,7 +219,7 @@ func (session *sessionWrapper) setDatabaseConnectionParameters(appBinding *appca
 	if err != nil {
 		return err
 	}
-	session.cmd.Args = append(session.cmd.Args, fmt.Sprintf("--host=%s", hostname))
+	session.addConnectionArgs(fmt.Sprintf("--host=%s", hostname))
 
 	port, err := appBinding.Port()
 	if err != nil {
@@ -172,15 +229,26 @@ func (session *sessionWrapper) setDatabaseConnectionParameters(appBinding *appca
 		port = 5432
 	}
 
-	session.cmd.Args = append(session.cmd.Args, fmt.Sprintf("--port=%d", port))
+	session.addConnectionArgs(fmt.Sprintf("--port=%d", port))
 
 	return nil
 }
 
+func (session *sessionWrapper) addConnectionArgs(args ...any) {
+	session.connectionArgs = append(session.connectionArgs, args...)
+	session.cmd.Args = append(session.cmd.Args, args...)
+}
+
 func (session *sessionWrapper) setUserArgs(args string) {
+	session.cmd.Args = appendUserArgs(session.cmd.Args, args)
+}
+
+// appendUserArgs appends the additional arguments given by the user to the arguments of a command.
+func appendUserArgs(cmdArgs []any, args string) []any {
 	for _, arg := range strings.Fields(args) {
-		session.cmd.Args = append(session.cmd.Args, arg)
+		cmdArgs = append(cmdArgs, arg)
 	}
+	return cmdArgs
 }
 
 func (session *sessionWrapper) setTLSParameters(appBinding *appcatalog.AppBinding, scratchDir string) error {
@@ -197,11 +265,43 @@ func (session *sessionWrapper) setTLSParameters(appBinding *appcatalog.AppBindin
 func (session *sessionWrapper) waitForDBReady(waitTimeout int32) error {
 	klog.Infoln("Waiting for the database to be ready.....")
 
-	args := append(session.cmd.Args, fmt.Sprintf("--timeout=%d", waitTimeout))
+	args := append(session.newArgs(), fmt.Sprintf("--timeout=%d", waitTimeout))
 
 	return session.sh.Command("pg_isready", args...).Run()
 }
 
+// newArgs returns a copy of the connection arguments, so that they can be extended for a new command.
+func (session *sessionWrapper) newArgs() []any {
+	return append([]any{}, session.connectionArgs...)
+}
+
+// executeQuery runs the query in the given database through psql and returns the rows of the result.
+func (session *sessionWrapper) executeQuery(database, query string) ([]string, error) {
+	args := append(session.newArgs(),
+		"--no-psqlrc",
+		"--tuples-only",
+		"--no-align",
+		fmt.Sprintf("--dbname=%s", database),
+		fmt.Sprintf("--command=%s", query),
+	)
+	out, err := session.sh.Command(PgRestoreCMD, args...).Output()
+	if err != nil {
+		return nil, err
+	}
+	return queryRows(out), nil
+}
+
+// queryRows splits the output of psql into the rows of the result.
+func queryRows(out []byte) []string {
+	var rows []string
+	for _, row := range strings.Split(string(out), "\n") {
+		if row != "" {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
 func getSSLMODE(appBinding *appcatalog.AppBinding) (string, error) {
 	if appBinding.Spec.ClientConfig.Service != nil {
 		sslmodeString := appBinding.Spec.ClientConfig.Service.Query
@@ -226,3 +326,57 @@ func getSSLMODE(appBinding *appcatalog.AppBinding) (string, error) {
 
 	return "", nil
 }
+
+// dumpFileName returns the name of the file a dump of the given format is stored as in the repository.
+func dumpFileName(format string) string {
+	switch format {
+	case DumpFormatCustom:
+		return PgCustomDumpFile
+	case DumpFormatDir:
+		return PgDirDumpFile
+	default:
+		return PgDumpFile
+	}
+}
+
+// databaseDumpFileName returns the name of the file the dump of a single database is stored as in the repository.
+func databaseDumpFileName(database, format string) string {
+	return database + filepath.Ext(dumpFileName(format))
+}
+
+// databaseHostname returns the hostname the snapshots of a single database are taken under in per database backup.
+func databaseHostname(host, database string) string {
+	return host + "/" + database
+}
+
+// dumpFileOf returns the name of the dump file stored in a snapshot.
+func dumpFileOf(snapshot *restic.Snapshot) string {
+	if len(snapshot.Paths) == 0 {
+		return PgDumpFile
+	}
+	return snapshot.Paths[0]
+}
+
+// dumpFormatOf detects the format of the dump stored in a snapshot from the name of the backed up file.
+func dumpFormatOf(snapshot *restic.Snapshot) string {
+	// base backups are stored as a directory of tar archives
+	if filepath.Base(dumpFileOf(snapshot)) == PgBaseBackupDir {
+		return DumpFormatPhysical
+	}
+	switch filepath.Ext(dumpFileOf(snapshot)) {
+	case filepath.Ext(PgCustomDumpFile):
+		return DumpFormatCustom
+	case filepath.Ext(PgDirDumpFile):
+		return DumpFormatDir
+	default:
+		return DumpFormatPlain
+	}
+}
+
+// shortID returns the short form of a snapshot ID, the same way restic shows it.
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
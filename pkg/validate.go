@@ -0,0 +1,167 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// hasTableStats checks whether the rows of the tables have been counted at backup.
+func (m *backupManifest) hasTableStats() bool {
+	if m == nil {
+		return false
+	}
+	for _, db := range m.Databases {
+		for _, table := range db.Tables {
+			if table.Rows != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validatedDatabases returns the databases of the manifest that have been restored, keyed by the names they have
+// been restored as. An archive is restored into the given database, and a plain dump restored as the target or
+// the staging database is renamed. A plain dump of pg_dump only creates its database if it has been taken with
+// --create, otherwise it is restored into the database psql connects to.
+func (opt *postgresOptions) validatedDatabases(session *sessionWrapper, dumpFormat, restoreDB string) (map[string]manifestDatabase, error) {
+	manifest := opt.manifest
+	// the snapshots of a per database backup are taken under "<host>/<database>"
+	perDatabase := ""
+	for _, s := range manifest.Snapshots {
+		if s.Snapshot == opt.dumpOptions.Snapshot && s.Hostname != manifest.Hostname {
+			perDatabase = strings.TrimPrefix(s.Hostname, manifest.Hostname+"/")
+		}
+	}
+	restored := make(map[string]manifestDatabase)
+	for _, db := range manifest.Databases {
+		if (perDatabase != "" && db.Name != perDatabase) || (len(opt.filter.databases) > 0 && !slices.Contains(opt.filter.databases, db.Name)) {
+			continue
+		}
+		name := db.Name
+		switch {
+		case dumpFormat != DumpFormatPlain, restoreDB != DefaultPostgresDB:
+			name = restoreDB
+		case manifest.BackupCMD == PgDumpCMD && perDatabase == "":
+			exists, err := session.databaseExists(db.Name)
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				if name = databaseFromArgs(opt.pgArgs); name == "" {
+					name = session.user
+				}
+			}
+		}
+		restored[name] = db
+	}
+	return restored, nil
+}
+
+// validateTables compares the rows of the restored tables, and the checksums of their key columns, with the values
+// taken at backup. Only the tables selected with --table and --schema are compared. The verdict of each table is
+// reported in the output, and any mismatch fails the restore.
+func (opt *postgresOptions) validateTables(session *sessionWrapper, dumpFormat, restoreDB string) error {
+	validation := &verificationStats{}
+	opt.restoreStats.Validation = validation
+	if path.Base(opt.dumpOptions.FileName) == PgGlobalsFile {
+		klog.Infoln("The globals of a per database backup do not hold any table to validate")
+		validation.Passed = true
+		return nil
+	}
+	databases, err := opt.validatedDatabases(session, dumpFormat, restoreDB)
+	if err != nil {
+		return err
+	}
+	selector := newObjectSelector(opt.filter.tables, opt.filter.schemas)
+	for _, name := range sortedKeys(databases) {
+		exists, err := session.databaseExists(name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			validation.Checks = append(validation.Checks, verificationCheck{Name: "database", Database: name, Message: "the database does not exist"})
+			continue
+		}
+		rows, err := session.executeQuery(name, listTablesQuery)
+		if err != nil {
+			return err
+		}
+		var tables []manifestTable
+		for _, table := range databases[name].Tables {
+			schema, relname, _ := strings.Cut(table.Name, ".")
+			if table.Rows == nil || (selector != nil && !selector.selects(tocEntry{desc: "TABLE", schema: schema, name: relname})) {
+				continue
+			}
+			if !slices.Contains(rows, table.Name) {
+				validation.Checks = append(validation.Checks, verificationCheck{Name: "table", Database: name, Table: table.Name, Message: "the table does not exist"})
+				continue
+			}
+			tables = append(tables, table)
+		}
+		stats, err := session.tableStats(name, "", tables)
+		if err != nil {
+			return err
+		}
+		for _, table := range tables {
+			s := stats[table.Name]
+			check := verificationCheck{
+				Name:     "rows",
+				Database: name,
+				Table:    table.Name,
+				Expected: strconv.FormatInt(*table.Rows, 10),
+				Actual:   strconv.FormatInt(s.Rows, 10),
+			}
+			check.Passed = check.Expected == check.Actual
+			if !check.Passed {
+				check.Message = "the table does not hold the rows counted at backup"
+			}
+			validation.Checks = append(validation.Checks, check)
+			if table.Checksum == "" || s.Checksum == nil {
+				continue
+			}
+			check = verificationCheck{Name: "checksum", Database: name, Table: table.Name, Expected: table.Checksum, Actual: *s.Checksum}
+			check.Passed = check.Expected == check.Actual
+			if !check.Passed {
+				check.Message = fmt.Sprintf("the checksum of the key columns %s differs from the checksum taken at backup", strings.Join(table.KeyColumns, ", "))
+			}
+			validation.Checks = append(validation.Checks, check)
+		}
+	}
+
+	var failed []string
+	for _, c := range validation.Checks {
+		if !c.Passed {
+			failed = append(failed, fmt.Sprintf("%s %s: %s", c.Database, c.Table, c.Message))
+		}
+	}
+	validation.Passed = len(failed) == 0
+	if !validation.Passed {
+		sort.Strings(failed)
+		return fmt.Errorf("validation of the restored tables has failed: %d of %d checks have failed: %s", len(failed), len(validation.Checks), strings.Join(failed, "; "))
+	}
+	klog.Infof("Validation of the restored tables has passed %d checks", len(validation.Checks))
+	return nil
+}
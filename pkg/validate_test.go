@@ -0,0 +1,197 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func int64Ptr(n int64) *int64 { return &n }
+
+// countedManifest describes a per database backup of host pg whose tables have been counted with --table-stats.
+func countedManifest() *backupManifest {
+	return &backupManifest{
+		Hostname:  "pg",
+		BackupCMD: PgDumpallCMD,
+		Format:    DumpFormatPlain,
+		Snapshots: []manifestSnapshot{
+			{Hostname: "pg", Snapshot: "cluster"},
+			{Hostname: databaseHostname("pg", "shop"), Snapshot: "shop"},
+		},
+		Databases: []manifestDatabase{
+			{Name: "app", Tables: []manifestTable{{Name: "public.users", RowsEstimate: 10, Rows: int64Ptr(12), KeyColumns: []string{"id"}, Checksum: "42"}}},
+			{Name: "shop", Tables: []manifestTable{{Name: "public.orders", RowsEstimate: -1, Rows: int64Ptr(3)}}},
+		},
+	}
+}
+
+func TestStoredManifestTableStats(t *testing.T) {
+	opt, w := newTestRepository(t, "pg")
+	dump := backupTestDump(t, w, "pg", PgDumpFile, "CREATE TABLE users ();")
+	stored := countedManifest()
+	stored.Snapshots[0].Snapshot = dump.ID
+	if err := opt.storeManifest(w, stored); err != nil {
+		t.Fatalf("failed to store the manifest: %v", err)
+	}
+
+	manifest, err := readBackupManifest(w, &dump)
+	if err != nil {
+		t.Fatalf("failed to read the manifest: %v", err)
+	}
+	if !manifest.hasTableStats() {
+		t.Fatalf("the manifest read back does not hold the table stats: %+v", manifest)
+	}
+	if !reflect.DeepEqual(manifest.Databases, stored.Databases) {
+		t.Errorf("databases read back = %+v, want %+v", manifest.Databases, stored.Databases)
+	}
+	opt.manifest = manifest
+	opt.dumpOptions.Snapshot = dump.ID
+	restored, err := opt.validatedDatabases(nil, DumpFormatPlain, DefaultPostgresDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sortedKeys(restored); !reflect.DeepEqual(got, []string{"app", "shop"}) {
+		t.Errorf("validated databases = %v, want [app shop]", got)
+	}
+}
+
+func TestHasTableStats(t *testing.T) {
+	uncounted := countedManifest()
+	for i := range uncounted.Databases {
+		for j := range uncounted.Databases[i].Tables {
+			uncounted.Databases[i].Tables[j].Rows = nil
+		}
+	}
+	tests := []struct {
+		name     string
+		manifest *backupManifest
+		want     bool
+	}{
+		{name: "counted", manifest: countedManifest(), want: true},
+		{name: "not counted", manifest: uncounted},
+		{name: "no manifest"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.manifest.hasTableStats(); got != tt.want {
+				t.Errorf("hasTableStats() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatedDatabases(t *testing.T) {
+	tests := []struct {
+		name       string
+		snapshot   string
+		dumpFormat string
+		restoreDB  string
+		databases  []string
+		// want maps the names the databases have been restored as to the databases of the manifest
+		want map[string]string
+	}{
+		{
+			name:       "whole cluster dump",
+			snapshot:   "cluster",
+			dumpFormat: DumpFormatPlain,
+			restoreDB:  DefaultPostgresDB,
+			want:       map[string]string{"app": "app", "shop": "shop"},
+		},
+		{
+			name:       "selected database",
+			snapshot:   "cluster",
+			dumpFormat: DumpFormatPlain,
+			restoreDB:  DefaultPostgresDB,
+			databases:  []string{"shop"},
+			want:       map[string]string{"shop": "shop"},
+		},
+		{
+			name:       "per database snapshot",
+			snapshot:   "shop",
+			dumpFormat: DumpFormatPlain,
+			restoreDB:  DefaultPostgresDB,
+			want:       map[string]string{"shop": "shop"},
+		},
+		{
+			name:       "archive restored into a database",
+			snapshot:   "shop",
+			dumpFormat: DumpFormatCustom,
+			restoreDB:  "shop_restored",
+			want:       map[string]string{"shop_restored": "shop"},
+		},
+		{
+			name:       "plain dump restored as the target database",
+			snapshot:   "shop",
+			dumpFormat: DumpFormatPlain,
+			restoreDB:  "shop_staging",
+			want:       map[string]string{"shop_staging": "shop"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := &postgresOptions{manifest: countedManifest()}
+			opt.dumpOptions.Snapshot = tt.snapshot
+			opt.filter.databases = tt.databases
+			restored, err := opt.validatedDatabases(nil, tt.dumpFormat, tt.restoreDB)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]string)
+			for name, db := range restored {
+				got[name] = db.Name
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("validatedDatabases() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTableStatsQueries(t *testing.T) {
+	tables := []manifestTable{
+		{Name: "public.users", KeyColumns: []string{"id", "Tenant"}},
+		{Name: `sales.order"s`},
+	}
+	want := []string{
+		`SELECT json_build_object('table', 'public.users', 'rows', count(*), 'checksum', coalesce(sum(('x' || substr(md5(ROW("id", "Tenant")::text), 1, 15))::bit(60)::bigint), 0)::text) FROM "public"."users"` +
+			` UNION ALL ` +
+			`SELECT json_build_object('table', 'sales.order"s', 'rows', count(*), 'checksum', NULL::text) FROM "sales"."order""s"`,
+	}
+	if got := tableStatsQueries(tables); !reflect.DeepEqual(got, want) {
+		t.Errorf("tableStatsQueries() = %q, want %q", got, want)
+	}
+
+	var many []manifestTable
+	for i := 0; i < 2*tableStatsBatchSize+1; i++ {
+		many = append(many, manifestTable{Name: fmt.Sprintf("public.t%03d", i)})
+	}
+	queries := tableStatsQueries(many)
+	var counted []int
+	for _, query := range queries {
+		counted = append(counted, strings.Count(query, "json_build_object"))
+	}
+	if !reflect.DeepEqual(counted, []int{tableStatsBatchSize, tableStatsBatchSize, 1}) {
+		t.Errorf("tables counted by each query = %v, want batches of %d", counted, tableStatsBatchSize)
+	}
+	if !sort.StringsAreSorted(queries) {
+		t.Errorf("the tables are not counted in their order")
+	}
+}
@@ -0,0 +1,342 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"github.com/spf13/cobra"
+	license "go.bytebuilders.dev/license-verifier/kubernetes"
+	"gomodules.xyz/flags"
+	shell "gomodules.xyz/go-sh"
+	"k8s.io/klog/v2"
+	appcatalog "kmodules.xyz/custom-resources/apis/appcatalog/v1alpha1"
+)
+
+const (
+	InitdbCMD = "initdb"
+
+	listTablesQuery = "SELECT n.nspname || '.' || c.relname FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace WHERE c.relkind IN ('r', 'p', 'f')"
+)
+
+type verificationStats struct {
+	// Passed indicates whether all the checks have passed
+	Passed bool `json:"passed"`
+	// Checks shows the outcome of each check
+	Checks []verificationCheck `json:"checks,omitempty"`
+}
+
+type verificationCheck struct {
+	// Name indicates what has been checked, i.e. restore, database, table or rows
+	Name     string `json:"name"`
+	Database string `json:"database,omitempty"`
+	Table    string `json:"table,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	Passed   bool   `json:"passed"`
+	// Message explains why the check has failed
+	Message string `json:"message,omitempty"`
+}
+
+func NewCmdVerify() *cobra.Command {
+	var (
+		masterURL      string
+		kubeconfigPath string
+		opt            = postgresOptions{
+			waitTimeout: 300,
+			jobs:        1,
+			onError:     OnErrorContinue,
+			setupOptions: restic.SetupOptions{
+				ScratchDir:  restic.DefaultScratchDir,
+				EnableCache: false,
+			},
+			dumpOptions: restic.DumpOptions{
+				Host: restic.DefaultHost,
+			},
+		}
+	)
+
+	cmd := &cobra.Command{
+		Use:               "verify-pg",
+		Short:             "Verifies a Postgres DB Backup by restoring it into a throwaway local server",
+		Long:              `Verifies a Postgres DB Backup by restoring it into a throwaway postgres server initialized in the scratch directory. The restore must complete without errors, and the databases and the tables of the dump must exist with the rows of the dump afterwards.`,
+		DisableAutoGenTag: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags.EnsureRequiredFlags(cmd, "provider", "storage-secret-name", "storage-secret-namespace")
+
+			err := opt.prepareClients(masterURL, kubeconfigPath)
+			if err != nil {
+				return err
+			}
+
+			targetRef := api_v1beta1.TargetRef{
+				APIVersion: appcatalog.SchemeGroupVersion.String(),
+				Kind:       appcatalog.ResourceKindApp,
+				Name:       opt.appBindingName,
+				Namespace:  opt.appBindingNamespace,
+			}
+			var restoreOutput *restic.RestoreOutput
+			restoreOutput, err = opt.verifyPostgreSQL(targetRef)
+			if err != nil {
+				restoreOutput = &restic.RestoreOutput{
+					RestoreTargetStatus: api_v1beta1.RestoreMemberStatus{
+						Ref: targetRef,
+						Stats: []api_v1beta1.HostRestoreStats{
+							{
+								Hostname: opt.dumpOptions.Host,
+								Phase:    api_v1beta1.HostRestoreFailed,
+								Error:    err.Error(),
+							},
+						},
+					},
+				}
+			}
+			// If output directory specified, then write the output in "output.json" file in the specified directory
+			if opt.outputDir != "" {
+				out := &pgRestoreOutput{
+					RestoreOutput: restoreOutput,
+					Postgres:      &opt.restoreStats,
+				}
+				return out.WriteOutput(filepath.Join(opt.outputDir, restic.DefaultOutputFileName))
+			}
+			return err
+		},
+	}
+
+	cmd.Flags().StringVar(&opt.pgArgs, "pg-args", opt.pgArgs, "Additional arguments")
+	cmd.Flags().IntVar(&opt.jobs, "jobs", opt.jobs, "Number of parallel jobs used to restore the database (only applicable for the directory format)")
+	cmd.Flags().StringVar(&opt.onError, "on-error", opt.onError, "Specify how to handle the statements failing to restore (can only be continue, stop or single-transaction). Any failed statement fails the verification")
+	cmd.Flags().StringVar(&opt.user, "user", DefaultPostgresUser, "Name of the superuser of the local server. initdb can not run as root, so the command must run as a non-root user")
+	cmd.Flags().Int32Var(&opt.waitTimeout, "wait-timeout", opt.waitTimeout, "Time limit to wait for the local server to be ready")
+
+	cmd.Flags().StringVar(&masterURL, "master", masterURL, "The address of the Kubernetes API server (overrides any value in kubeconfig)")
+	cmd.Flags().StringVar(&kubeconfigPath, "kubeconfig", kubeconfigPath, "Path to kubeconfig file with authorization information (the master location is set by the master flag).")
+	cmd.Flags().StringVar(&opt.appBindingName, "appbinding", opt.appBindingName, "Name of the app binding")
+	cmd.Flags().StringVar(&opt.appBindingNamespace, "appbinding-namespace", opt.appBindingNamespace, "Namespace of the app binding")
+	addStorageFlags(cmd, &opt)
+
+	cmd.Flags().StringVar(&opt.dumpOptions.Host, "hostname", opt.dumpOptions.Host, "Name of the host machine")
+	cmd.Flags().StringVar(&opt.dumpOptions.SourceHost, "source-hostname", opt.dumpOptions.SourceHost, "Name of the host whose backup will be verified")
+	cmd.Flags().StringVar(&opt.dumpOptions.Snapshot, "snapshot", opt.dumpOptions.Snapshot, "Snapshot to verify (keep empty to verify the latest snapshot of the source host)")
+	cmd.Flags().StringVar(&opt.asOf, "as-of", opt.asOf, "Time (RFC3339) to verify the newest snapshot of the source host taken at or before, instead of the latest one")
+
+	cmd.Flags().StringVar(&opt.outputDir, "output-dir", opt.outputDir, "Directory where output.json file will be written (keep empty if you don't need to write output in file)")
+	return cmd
+}
+
+// verifyPostgreSQL restores the snapshot into a local server initialized in the scratch directory, through the
+// same pipeline restore-pg uses. The contents of the dump are collected while it is being restored, then the
+// restored databases are checked against them.
+func (opt *postgresOptions) verifyPostgreSQL(targetRef api_v1beta1.TargetRef) (*restic.RestoreOutput, error) {
+	err := license.CheckLicenseEndpoint(opt.config, licenseApiService, SupportedProducts)
+	if err != nil {
+		return nil, err
+	}
+
+	sh := shell.NewSession()
+	resticWrapper, err := opt.newResticWrapper(sh)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := opt.getSnapshot(resticWrapper)
+	if err != nil {
+		return nil, err
+	}
+	dumpFormat := dumpFormatOf(snapshot)
+	if dumpFormat == DumpFormatPhysical {
+		return nil, fmt.Errorf("a base backup can not be verified, use restore-pg-pitr --recover to recover it into a data directory instead")
+	}
+	opt.dumpOptions.Snapshot = snapshot.ID
+	opt.dumpOptions.FileName = dumpFileOf(snapshot)
+	opt.restoreStats.Snapshot, opt.restoreStats.SnapshotTime = snapshot.ID, snapshot.Time.Format(time.RFC3339)
+	opt.restoreStats.Format = dumpFormat
+	if opt.jobs < 1 || (opt.jobs > 1 && dumpFormat != DumpFormatDir) {
+		return nil, fmt.Errorf("invalid number of jobs %d: parallel jobs are only supported by the %s format", opt.jobs, DumpFormatDir)
+	}
+	if err = opt.validateErrorMode(snapshot, dumpFormat); err != nil {
+		return nil, err
+	}
+	opt.restoreStats.OnError = opt.onError
+	manifests, err := readBackupManifests(resticWrapper, []restic.Snapshot{*snapshot})
+	if err != nil {
+		return nil, err
+	}
+	opt.manifest = manifests[snapshot.ID]
+	checksums, err := dumpChecksums(manifests, []restic.Snapshot{*snapshot})
+	if err != nil {
+		return nil, err
+	}
+	opt.checksum = checksums[snapshot.ID]
+	// the restored tables are compared with the rows counted at backup, if they have been counted
+	opt.tableValidation = opt.manifest.hasTableStats()
+	klog.Infof("Verifying %s dump of snapshot %s", dumpFormat, snapshot.ID)
+
+	dataDir := filepath.Join(opt.setupOptions.ScratchDir, "verify")
+	if err := os.RemoveAll(dataDir); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dataDir)
+	server := newLocalServer(dataDir, opt.setupOptions.ScratchDir, opt.user)
+	err = runPhase(&opt.restoreStats.Phases, "initdb", func() error {
+		return server.sh.Command(InitdbCMD,
+			fmt.Sprintf("--pgdata=%s", dataDir),
+			fmt.Sprintf("--username=%s", opt.user),
+			"--auth=trust",
+			"--encoding=UTF8",
+		).Run()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := server.start(opt.waitTimeout); err != nil {
+		return nil, fmt.Errorf("failed to start the local server: %v: %s", err, server.logTail(10))
+	}
+	defer func() {
+		if err := server.stop(); err != nil {
+			klog.Errorf("Failed to stop the local server: %v", err)
+		}
+	}()
+	session := server.newSession(PgRestoreCMD)
+	session.user = opt.user
+	// the superuser of the local server already exists, so the statements of its role would fail
+	opt.filter.skipRoles = append(opt.filter.skipRoles, opt.user)
+
+	// The dump is inspected on its way to the restore, the pipeline becomes
+	// restic dump | stash-postgres inspect-dump --passthrough <args> | <restore stages> .
+	contentsFile := filepath.Join(opt.setupOptions.ScratchDir, "verify-contents.json")
+	stage, err := reportStage(InspectDumpCMD, contentsFile, "--passthrough", fmt.Sprintf("--format=%s", dumpFormat))
+	if err != nil {
+		return nil, err
+	}
+	opt.dumpOptions.StdoutPipeCommands = append(opt.dumpOptions.StdoutPipeCommands, stage)
+	var restoreOutput *restic.RestoreOutput
+	restoreErr := runPhase(&opt.restoreStats.Phases, "restore", func() error {
+		var err error
+		restoreOutput, err = opt.replayDump(resticWrapper, session, dumpFormat, DefaultPostgresDB, targetRef)
+		return err
+	})
+
+	verification := &verificationStats{}
+	opt.restoreStats.Verification = verification
+	check := verificationCheck{Name: "restore", Passed: restoreErr == nil && opt.restoreStats.Errors == 0}
+	switch {
+	case restoreErr != nil:
+		check.Message = restoreErr.Error()
+	case opt.restoreStats.FailedStatement != nil:
+		check.Message = restoreErrorReport{Errors: opt.restoreStats.Errors, First: opt.restoreStats.FailedStatement}.summary()
+	}
+	verification.Checks = append(verification.Checks, check)
+
+	var contents dumpContents
+	if err := readReport(contentsFile, &contents); err != nil && restoreErr == nil {
+		return nil, fmt.Errorf("failed to read the contents of the dump: %v", err)
+	}
+	err = runPhase(&opt.restoreStats.Phases, "verify", func() error {
+		return opt.verifyContents(session, contents, verification)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	failed := 0
+	for _, c := range verification.Checks {
+		if !c.Passed {
+			failed++
+			klog.Errorf("Verification check %s failed: database %q table %q: %s", c.Name, c.Database, c.Table, c.Message)
+		}
+	}
+	verification.Passed = failed == 0
+	if !verification.Passed {
+		return nil, fmt.Errorf("verification of snapshot %s has failed: %d of %d checks have failed", snapshot.ID, failed, len(verification.Checks))
+	}
+	klog.Infof("Verification of snapshot %s has passed %d checks", snapshot.ID, len(verification.Checks))
+	return restoreOutput, nil
+}
+
+// verifyContents checks that the databases and the tables of the dump exist in the local server,
+// and that the tables hold as many rows as the data of the dump.
+func (opt *postgresOptions) verifyContents(session *sessionWrapper, contents dumpContents, verification *verificationStats) error {
+	for _, db := range contents.Databases {
+		if len(db.Tables) == 0 && len(db.Rows) == 0 {
+			// i.e. template1 in a pg_dumpall dump, which is only connected to
+			continue
+		}
+		database := db.Name
+		if database == "" {
+			// a dump without CREATE DATABASE is restored into the database psql and pg_restore connect to
+			database = DefaultPostgresDB
+		}
+		exists, err := session.databaseExists(database)
+		if err != nil {
+			return err
+		}
+		check := verificationCheck{Name: "database", Database: database, Passed: exists}
+		if !exists {
+			check.Message = "the database does not exist"
+		}
+		verification.Checks = append(verification.Checks, check)
+		if !exists {
+			continue
+		}
+
+		rows, err := session.executeQuery(database, listTablesQuery)
+		if err != nil {
+			return err
+		}
+		tables := make(map[string]bool, len(rows))
+		for _, table := range rows {
+			tables[table] = true
+		}
+		for _, table := range db.Tables {
+			check := verificationCheck{Name: "table", Database: database, Table: table, Passed: tables[table]}
+			if !check.Passed {
+				check.Message = "the table does not exist"
+			}
+			verification.Checks = append(verification.Checks, check)
+		}
+
+		for _, table := range sortedKeys(db.Rows) {
+			if !tables[table] {
+				continue
+			}
+			schema, name, _ := strings.Cut(table, ".")
+			count, err := session.executeQuery(database, fmt.Sprintf("SELECT count(*) FROM %s.%s", quoteIdentifier(schema), quoteIdentifier(name)))
+			if err != nil {
+				return err
+			}
+			expected := strconv.FormatInt(db.Rows[table], 10)
+			check := verificationCheck{Name: "rows", Database: database, Table: table, Expected: expected}
+			if len(count) == 1 {
+				check.Actual = count[0]
+			}
+			check.Passed = check.Actual == expected
+			if !check.Passed {
+				check.Message = "the table does not hold the rows of the dump"
+			}
+			verification.Checks = append(verification.Checks, check)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"github.com/spf13/cobra"
+	license "go.bytebuilders.dev/license-verifier/kubernetes"
+	"gomodules.xyz/flags"
+	shell "gomodules.xyz/go-sh"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+	v1 "kmodules.xyz/offshoot-api/api/v1"
+)
+
+const Sha256SumCMD = "sha256sum"
+
+func NewCmdArchiveWAL() *cobra.Command {
+	var (
+		masterURL      string
+		kubeconfigPath string
+		opt            = postgresOptions{
+			setupOptions: restic.SetupOptions{
+				ScratchDir:  restic.DefaultScratchDir,
+				EnableCache: false,
+			},
+			backupOptions: restic.BackupOptions{
+				Host: restic.DefaultHost,
+			},
+		}
+	)
+
+	cmd := &cobra.Command{
+		Use:               "archive-wal <path> <name>",
+		Short:             "Archives a WAL segment into the repository (to be used as archive_command)",
+		Long:              `Archives a WAL segment into the repository. It is meant to be used as archive_command, i.e. archive_command = 'stash-postgres archive-wal %p %f <flags>'`,
+		Args:              cobra.ExactArgs(2),
+		DisableAutoGenTag: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			flags.EnsureRequiredFlags(cmd, "provider", "storage-secret-name", "storage-secret-namespace")
+
+			err := opt.prepareClients(masterURL, kubeconfigPath)
+			if err == nil {
+				err = opt.archiveWAL(args[0], args[1])
+			}
+			exitForPostgres(err)
+		},
+	}
+
+	cmd.Flags().StringVar(&masterURL, "master", masterURL, "The address of the Kubernetes API server (overrides any value in kubeconfig)")
+	cmd.Flags().StringVar(&kubeconfigPath, "kubeconfig", kubeconfigPath, "Path to kubeconfig file with authorization information (the master location is set by the master flag).")
+	cmd.Flags().StringVar(&opt.namespace, "namespace", "default", "Namespace of Backup/Restore Session")
+	cmd.Flags().StringVar(&opt.backupOptions.Host, "hostname", opt.backupOptions.Host, "Name of the host machine. The WAL segments are stored under the <hostname>/pg_wal host")
+	addStorageFlags(cmd, &opt)
+
+	return cmd
+}
+
+func NewCmdRestoreWAL() *cobra.Command {
+	var (
+		masterURL      string
+		kubeconfigPath string
+		opt            = postgresOptions{
+			setupOptions: restic.SetupOptions{
+				ScratchDir:  restic.DefaultScratchDir,
+				EnableCache: false,
+			},
+			dumpOptions: restic.DumpOptions{
+				Host: restic.DefaultHost,
+			},
+		}
+	)
+
+	cmd := &cobra.Command{
+		Use:               "restore-wal <name> <path>",
+		Short:             "Restores an archived WAL segment from the repository (to be used as restore_command)",
+		Long:              `Restores an archived WAL segment from the repository. It is meant to be used as restore_command, i.e. restore_command = 'stash-postgres restore-wal %f %p <flags>'`,
+		Args:              cobra.ExactArgs(2),
+		DisableAutoGenTag: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			flags.EnsureRequiredFlags(cmd, "provider", "storage-secret-name", "storage-secret-namespace")
+
+			err := opt.prepareClients(masterURL, kubeconfigPath)
+			if err == nil {
+				err = opt.restoreWAL(args[0], args[1])
+			}
+			exitForPostgres(err)
+		},
+	}
+
+	cmd.Flags().StringVar(&masterURL, "master", masterURL, "The address of the Kubernetes API server (overrides any value in kubeconfig)")
+	cmd.Flags().StringVar(&kubeconfigPath, "kubeconfig", kubeconfigPath, "Path to kubeconfig file with authorization information (the master location is set by the master flag).")
+	cmd.Flags().StringVar(&opt.dumpOptions.Host, "hostname", opt.dumpOptions.Host, "Name of the host machine")
+	cmd.Flags().StringVar(&opt.dumpOptions.SourceHost, "source-hostname", opt.dumpOptions.SourceHost, "Name of the host whose WAL segments will be restored")
+	addStorageFlags(cmd, &opt)
+
+	return cmd
+}
+
+// prepareClients builds the kubernetes client required to read the storage secret.
+func (opt *postgresOptions) prepareClients(masterURL, kubeconfigPath string) error {
+	config, err := clientcmd.BuildConfigFromFlags(masterURL, kubeconfigPath)
+	if err != nil {
+		return err
+	}
+	opt.config = config
+
+	opt.kubeClient, err = kubernetes.NewForConfig(config)
+	return err
+}
+
+// newResticWrapper reads the storage secret and prepares a restic wrapper that runs its commands in the given session.
+func (opt *postgresOptions) newResticWrapper(sh *shell.Session) (*restic.ResticWrapper, error) {
+	var err error
+	opt.setupOptions.StorageSecret, err = opt.kubeClient.CoreV1().Secrets(opt.storageSecret.Namespace).Get(context.TODO(), opt.storageSecret.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// apply nice, ionice settings from env
+	opt.setupOptions.Nice, err = v1.NiceSettingsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	opt.setupOptions.IONice, err = v1.IONiceSettingsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return restic.NewResticWrapperFromShell(opt.setupOptions, sh)
+}
+
+// walHostname returns the hostname the WAL segments of a host are archived under.
+func walHostname(host string) string {
+	return host + "/pg_wal"
+}
+
+// archiveWAL pushes a WAL segment into the repository. Postgres may call the archive_command again for a
+// segment that has already been archived, i.e. after a crash. In that case, it succeeds only if the archived
+// segment is identical to the given one.
+func (opt *postgresOptions) archiveWAL(walPath, walName string) error {
+	err := license.CheckLicenseEndpoint(opt.config, licenseApiService, SupportedProducts)
+	if err != nil {
+		return err
+	}
+
+	sh := shell.NewSession()
+	resticWrapper, err := opt.newResticWrapper(sh)
+	if err != nil {
+		return err
+	}
+
+	err = resticWrapper.EnsureNoExclusiveLock(opt.kubeClient, opt.namespace)
+	if err != nil {
+		return err
+	}
+
+	localSum, err := sha256Sum(walPath)
+	if err != nil {
+		return err
+	}
+	archivedSum, archived, err := opt.archivedWALSum(resticWrapper, walName)
+	if err != nil {
+		return err
+	}
+	if archived {
+		if archivedSum != localSum {
+			return fmt.Errorf("WAL segment %s has already been archived with different content", walName)
+		}
+		klog.Infof("WAL segment %s has already been archived", walName)
+		return nil
+	}
+
+	// The backup process should follow the following pipeline: cat <path> | restic backup --stdin .
+	opt.backupOptions.StdinFileName = walName
+	opt.backupOptions.StdinPipeCommands = []restic.Command{
+		{
+			Name: "cat",
+			Args: []any{walPath},
+		},
+	}
+	opt.backupOptions.Host = walHostname(opt.backupOptions.Host)
+	_, err = resticWrapper.RunBackup(opt.backupOptions, api_v1beta1.TargetRef{})
+	return err
+}
+
+// archivedWALSum returns the checksum of an archived WAL segment, and whether the segment has been archived.
+// The snapshot of the segment is looked up first, so that a failure to read the repository is returned
+// instead of being taken for a segment that has not been archived yet.
+func (opt *postgresOptions) archivedWALSum(w *restic.ResticWrapper, walName string) (string, bool, error) {
+	snapshots, err := w.ListSnapshots(nil)
+	if err != nil {
+		return "", false, err
+	}
+	host := walHostname(opt.backupOptions.Host)
+	var archived *restic.Snapshot
+	for i := range snapshots {
+		if snapshots[i].Hostname != host || !slices.Contains(snapshots[i].Paths, "/"+walName) {
+			continue
+		}
+		if archived == nil || snapshots[i].Time.After(archived.Time) {
+			archived = &snapshots[i]
+		}
+	}
+	if archived == nil {
+		return "", false, nil
+	}
+
+	out, err := w.DumpOnce(restic.DumpOptions{
+		Snapshot: archived.ID,
+		FileName: walName,
+		StdoutPipeCommands: []restic.Command{
+			{Name: Sha256SumCMD},
+		},
+	})
+	if err != nil {
+		return "", true, err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", true, fmt.Errorf("failed to read checksum of archived WAL segment %s", walName)
+	}
+	return fields[0], true, nil
+}
+
+// restoreWAL fetches an archived WAL segment from the repository into the path requested by postgres.
+func (opt *postgresOptions) restoreWAL(walName, walPath string) error {
+	err := license.CheckLicenseEndpoint(opt.config, licenseApiService, SupportedProducts)
+	if err != nil {
+		return err
+	}
+
+	sh := shell.NewSession()
+	resticWrapper, err := opt.newResticWrapper(sh)
+	if err != nil {
+		return err
+	}
+
+	sourceHost := opt.dumpOptions.SourceHost
+	if sourceHost == "" {
+		sourceHost = opt.dumpOptions.Host
+	}
+	// The restore process should follow the following pipeline: restic dump <name> | dd of=<path> .
+	opt.dumpOptions.SourceHost = walHostname(sourceHost)
+	opt.dumpOptions.FileName = walName
+	opt.dumpOptions.Path = "/" + walName
+	opt.dumpOptions.StdoutPipeCommands = []restic.Command{
+		{
+			Name: "dd",
+			Args: []any{fmt.Sprintf("of=%s", walPath)},
+		},
+	}
+	_, err = resticWrapper.DumpOnce(opt.dumpOptions)
+	if err != nil {
+		// do not leave a partially written segment behind
+		_ = os.Remove(walPath)
+	}
+	return err
+}
+
+func sha256Sum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// exitForPostgres terminates the process with the exit code expected from an archive_command or restore_command.
+// Postgres aborts the archiver or the recovery on an exit code above 125, so any failure must exit with 1.
+func exitForPostgres(err error) {
+	if err != nil {
+		klog.Errorln(err)
+		klog.Flush()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,63 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"testing"
+)
+
+func TestArchivedWALSum(t *testing.T) {
+	const segment = "000000010000000000000003"
+	opt, w := newTestRepository(t, "pg")
+	backupTestDump(t, w, walHostname("pg"), segment, "wal")
+	// a file stored under the host itself, instead of its WAL host, is not an archived segment
+	backupTestDump(t, w, "pg", "000000010000000000000004", "dump")
+	sum := sha256.Sum256([]byte("wal\n"))
+
+	tests := []struct {
+		name     string
+		walName  string
+		archived bool
+		sum      string
+	}{
+		{name: "archived segment", walName: segment, archived: true, sum: hex.EncodeToString(sum[:])},
+		{name: "segment not archived", walName: "000000010000000000000004"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, archived, err := opt.archivedWALSum(w, tt.walName)
+			if err != nil {
+				t.Fatalf("archivedWALSum() error = %v", err)
+			}
+			if archived != tt.archived || got != tt.sum {
+				t.Errorf("archivedWALSum() = %q, %t, want %q, %t", got, archived, tt.sum, tt.archived)
+			}
+		})
+	}
+
+	t.Run("repository not readable", func(t *testing.T) {
+		if err := os.RemoveAll(opt.setupOptions.Bucket); err != nil {
+			t.Fatal(err)
+		}
+		if _, archived, err := opt.archivedWALSum(w, segment); err == nil || archived {
+			t.Errorf("archivedWALSum() = archived %t, error %v, want an error", archived, err)
+		}
+	})
+}